@@ -0,0 +1,385 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/tav/elko/pkg/config"
+	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// The service manager lets connections with this service ID make calls, but
+// doesn't route any calls to them.
+const cliServiceID = "elko.cli"
+
+// callClient handles the messages received from the service manager on behalf
+// of elko call.
+type callClient struct {
+	hello chan *pb.ServerHello
+	resp  chan *pb.ServerResponse
+}
+
+func (c *callClient) Handle(opcode byte, msg []byte) error {
+	switch pb.OP(opcode) {
+	case pb.OP_SERVER_HELLO:
+		hello := &pb.ServerHello{}
+		err := proto.Unmarshal(msg, hello)
+		if err != nil {
+			return err
+		}
+		c.hello <- hello
+	case pb.OP_SERVER_RESPONSE:
+		resp := &pb.ServerResponse{}
+		err := proto.Unmarshal(msg, resp)
+		if err != nil {
+			return err
+		}
+		c.resp <- resp
+	}
+	return nil
+}
+
+func cmdCall(argv []string, usage string) {
+
+	opts := createOpts("call SERVICE.METHOD [ARGS] [OPTIONS]",
+		`Call a service method and print its result as JSON. The args are given
+  as JSON, with an array being treated as the list of args, and any other
+  value as a single arg. If the args are omitted or given as -, they are read
+  from stdin when it isn't a terminal.`)
+
+	addr := opts.Flags("--addr").Label("ADDR").String(
+		"the address of the service manager to connect to (defaults to localhost on $ELKO_PORT or 9000)")
+
+	admin := opts.Flags("--admin").Label("ADDR").String(
+		"validate the call against the schema served by the admin API at the given address")
+
+	async := opts.Flags("--async").Bool(
+		"send the call without waiting for a response")
+
+	auth := opts.Flags("--auth").Label("TOKEN").String(
+		"the auth token to send with the call")
+
+	socket := opts.Flags("--socket").Label("PATH").String(
+		"connect to the service manager over the given Unix socket (defaults to $ELKO_SOCKET or the socket of elko run)")
+
+	timeout := opts.Flags("--timeout").Label("DURATION").Duration(
+		"how long to wait for the call to complete [30s]")
+
+	traceParent := opts.Flags("--trace").Label("TRACEPARENT").String(
+		"the W3C traceparent to make the call under")
+
+	args := opts.Parse(argv)
+	if len(args) < 1 || len(args) > 2 {
+		opts.PrintUsage()
+		os.Exit(1)
+	}
+
+	serviceID, method, err := parseCallTarget(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var input []byte
+	if len(args) == 2 && args[1] != "-" {
+		input = []byte(args[1])
+	} else if len(args) == 2 || !isTerminal(os.Stdin) {
+		input, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Couldn't read args from stdin: %s", err)
+		}
+	}
+	callArgs, err := parseCallArgs(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *admin != "" {
+		err = validateCall(*admin, serviceID, method, callArgs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *timeout <= 0 {
+		*timeout = 30 * time.Second
+	}
+	deadline, err := ptypes.TimestampProto(time.Now().Add(*timeout))
+	if err != nil {
+		log.Fatal(err)
+	}
+	param, err := protocol.Marshal(callArgs)
+	if err != nil {
+		log.Fatalf("Couldn't encode args: %s", err)
+	}
+	req := &pb.ClientRequest{
+		Async:         *async,
+		AuthToken:     *auth,
+		Deadline:      deadline,
+		ID:            1,
+		ServiceID:     serviceID,
+		ServiceMethod: method,
+		ServiceParam:  param,
+		TraceID:       *traceParent,
+	}
+
+	resp, err := sendCall(*addr, *socket, req, *timeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp == nil {
+		return
+	}
+	if resp.ErrorCode != pb.ErrorCode_NONE {
+		printCallError(resp)
+		os.Exit(1)
+	}
+	if len(resp.Result) == 0 {
+		return
+	}
+	out, err := protocol.ToJSON(resp.Result)
+	if err != nil {
+		log.Fatalf("Couldn't decode result: %s", err)
+	}
+	fmt.Println(string(out))
+
+}
+
+// dialManager connects to the service manager. If neither addr nor socket are
+// given, it prefers $ELKO_SOCKET, followed by the socket of elko run within the
+// current project, and then localhost on $ELKO_PORT.
+func dialManager(addr string, socket string) (net.Conn, error) {
+	if socket == "" && addr == "" {
+		socket = os.Getenv("ELKO_SOCKET")
+		if socket == "" {
+			socket = projectSocket()
+		}
+	}
+	if socket != "" {
+		return net.Dial("unix", socket)
+	}
+	if addr == "" {
+		port := os.Getenv("ELKO_PORT")
+		if port == "" {
+			port = "9000"
+		}
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// projectSocket returns the path of the socket that elko run listens on in the
+// current project, if it exists.
+func projectSocket() string {
+	root, err := config.GetRoot()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(root, ".elko", "elko.sock")
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return ""
+	}
+	return path
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// normalizeJSON converts the numbers in a decoded JSON value into integers
+// where possible, so that they can be decoded into integer args.
+func normalizeJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalizeJSON(elem)
+		}
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = normalizeJSON(elem)
+		}
+	}
+	return v
+}
+
+// parseCallArgs encodes each of the args given as JSON separately, as expected
+// by the runtimes.
+func parseCallArgs(input []byte) ([][]byte, error) {
+	input = bytes.TrimSpace(input)
+	if len(input) == 0 {
+		return [][]byte{}, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse args as JSON: %s", err)
+	}
+	if dec.More() {
+		return nil, errors.New("couldn't parse args as JSON: unexpected data after the args")
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	args := make([][]byte, len(list))
+	for i, arg := range list {
+		args[i], err = protocol.Marshal(normalizeJSON(arg))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode arg %d: %s", i+1, err)
+		}
+	}
+	return args, nil
+}
+
+// parseCallTarget splits SERVICE.METHOD, or SERVICE/METHOD, into its parts. As
+// service IDs can contain dots, the method is taken from after the last one.
+func parseCallTarget(target string) (string, string, error) {
+	idx := strings.LastIndexByte(target, '/')
+	if idx == -1 {
+		idx = strings.LastIndexByte(target, '.')
+	}
+	if idx <= 0 || idx == len(target)-1 {
+		return "", "", fmt.Errorf("invalid call target %q: expected SERVICE.METHOD", target)
+	}
+	return target[:idx], target[idx+1:], nil
+}
+
+func printCallError(resp *pb.ServerResponse) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", resp.ErrorCode)
+	if resp.ErrorType != "" {
+		fmt.Fprintf(os.Stderr, "Type: %s\n", resp.ErrorType)
+	}
+	if resp.ErrorMessage != "" {
+		fmt.Fprintf(os.Stderr, "Message: %s\n", resp.ErrorMessage)
+	}
+}
+
+// sendCall makes the call over a fresh connection to the service manager. It
+// returns a nil response for async calls.
+func sendCall(addr string, socket string, req *pb.ClientRequest, timeout time.Duration) (*pb.ServerResponse, error) {
+	conn, err := dialManager(addr, socket)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to the service manager: %s", err)
+	}
+	_, err = conn.Write([]byte{1})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := &callClient{
+		hello: make(chan *pb.ServerHello, 1),
+		resp:  make(chan *pb.ServerResponse, 1),
+	}
+	pconn := protocol.New(conn, cliServiceID)
+	defer pconn.Close()
+	pconn.Run(client, 0)
+	hello, err := proto.Marshal(&pb.ClientHello{
+		ProtocolVersion: protocol.Version,
+		Runtime:         "elko call",
+		ServiceID:       cliServiceID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = pconn.Write(byte(pb.OP_CLIENT_HELLO), hello)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-client.hello:
+	case <-pconn.Done():
+		return nil, errors.New("the service manager closed the connection during the hello exchange")
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for the service manager to reply to the hello")
+	}
+	msg, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	err = pconn.Write(byte(pb.OP_CLIENT_REQUEST), msg)
+	if err != nil {
+		return nil, err
+	}
+	if req.Async {
+		// The service manager handles messages in order, so once it has closed
+		// the connection in response to the shutdown, the call has been
+		// routed.
+		if !shutdownCall(pconn, timer.C) {
+			return nil, errors.New("timed out waiting for the service manager to accept the call")
+		}
+		return nil, nil
+	}
+	select {
+	case resp := <-client.resp:
+		shutdownCall(pconn, timer.C)
+		return resp, nil
+	case <-pconn.Done():
+		return nil, errors.New("the service manager closed the connection before responding")
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for a response")
+	}
+}
+
+// shutdownCall asks the service manager to close the connection, and returns
+// whether it did so before the timeout.
+func shutdownCall(pconn *protocol.Conn, timeout <-chan time.Time) bool {
+	shutdown, _ := proto.Marshal(&pb.ClientShutdown{})
+	pconn.Write(byte(pb.OP_CLIENT_SHUTDOWN), shutdown)
+	select {
+	case <-pconn.Done():
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// validateCall checks the call against the schema of the service, if it has
+// published one.
+func validateCall(admin string, serviceID string, method string, args [][]byte) error {
+	schema, err := fetchSchema(admin, serviceID)
+	if err != nil {
+		// Services which don't publish a schema can still be called.
+		if err == errNoSchema {
+			return nil
+		}
+		return err
+	}
+	m := schema.Method(method)
+	if m == nil {
+		return fmt.Errorf("%s has no method %q, run elko describe %s to see its methods", serviceID, method, serviceID)
+	}
+	if len(args) > len(m.Args) {
+		return fmt.Errorf("%s.%s takes %d args, got %d", serviceID, m.Name, len(m.Args), len(args))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tav/elko/pkg/protocol"
+	"github.com/tav/golly/log"
+)
+
+// errNoSchema is returned by fetchSchema if the service hasn't published a
+// schema.
+var errNoSchema = errors.New("no schema has been published for the service")
+
+func cmdDescribe(argv []string, usage string) {
+
+	opts := createOpts("describe SERVICE [OPTIONS]",
+		`Show the methods of a service, along with the types of their args and
+  results, as published to the service manager's schema registry.`)
+
+	admin := opts.Flags("--admin").Label("ADDR").String(
+		"the address of the service manager's admin API [127.0.0.1:9001]")
+
+	asJSON := opts.Flags("--json").Bool(
+		"print the schema as JSON")
+
+	args := opts.Parse(argv)
+	if len(args) != 1 {
+		opts.PrintUsage()
+		os.Exit(1)
+	}
+
+	addr := *admin
+	if addr == "" {
+		addr = "127.0.0.1:9001"
+	}
+
+	schema, err := fetchSchema(addr, args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		out, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	printSchema(schema)
+
+}
+
+// collectStructs adds the named structs referenced by t to structs, in the
+// order they are first seen.
+func collectStructs(t *protocol.TypeSchema, structs *[]*protocol.TypeSchema, seen map[string]bool) {
+	if t == nil {
+		return
+	}
+	if t.Kind == protocol.KindStruct && len(t.Fields) > 0 {
+		if t.Name != "" {
+			if seen[t.Name] {
+				return
+			}
+			seen[t.Name] = true
+			*structs = append(*structs, t)
+		}
+		for _, f := range t.Fields {
+			collectStructs(f.Type, structs, seen)
+		}
+		return
+	}
+	collectStructs(t.Key, structs, seen)
+	collectStructs(t.Elem, structs, seen)
+}
+
+func fetchSchema(addr string, serviceID string) (*protocol.ServiceSchema, error) {
+	resp, err := http.Get("http://" + addr + "/schemas?service=" + url.QueryEscape(serviceID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoSchema
+	}
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("got %d response code from the admin API: %s",
+			resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	schema := &protocol.ServiceSchema{}
+	err = json.NewDecoder(resp.Body).Decode(schema)
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func printSchema(schema *protocol.ServiceSchema) {
+	fmt.Printf("Service: %s\n", schema.ServiceID)
+	if schema.Version != "" {
+		fmt.Printf("Version: %s\n", schema.Version)
+	}
+	fmt.Printf("\nMethods:\n\n")
+	structs := []*protocol.TypeSchema{}
+	seen := map[string]bool{}
+	for _, m := range schema.Methods {
+		if m.Web {
+			fmt.Printf("  %s(WebRequest) -> WebResponse  [web]\n", m.Name)
+			continue
+		}
+		args := make([]string, len(m.Args))
+		for i, arg := range m.Args {
+			args[i] = arg.String()
+			collectStructs(arg, &structs, seen)
+		}
+		result := ""
+		if m.Result != nil {
+			result = " -> " + m.Result.String()
+			collectStructs(m.Result, &structs, seen)
+		}
+		fmt.Printf("  %s(%s)%s\n", m.Name, strings.Join(args, ", "), result)
+	}
+	if len(structs) == 0 {
+		return
+	}
+	fmt.Printf("\nTypes:\n")
+	for _, t := range structs {
+		fmt.Printf("\n  %s {\n", t.Name)
+		for _, f := range t.Fields {
+			fmt.Printf("    %s: %s\n", f.Name, f.Type)
+		}
+		fmt.Printf("  }\n")
+	}
+}
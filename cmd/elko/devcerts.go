@@ -0,0 +1,33 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"github.com/tav/elko/pkg/devcert"
+	"github.com/tav/golly/log"
+)
+
+func cmdDevCerts(argv []string, usage string) {
+
+	opts := createOpts("dev-certs NODE_ID [NODE_ID ...] [OPTIONS]",
+		`Generate a self-signed CA and certificates for the given node IDs, so
+  that TLS between service managers can be tested locally.`)
+
+	dir := opts.Flags("-d", "--dir").Label("PATH").String(
+		"the directory to write the certificates to [.elko/certs]")
+
+	nodeIDs := opts.Parse(argv)
+	if len(nodeIDs) == 0 {
+		opts.PrintUsage()
+		return
+	}
+
+	err := devcert.Generate(*dir, nodeIDs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Generated certificates in %s", *dir)
+
+}
@@ -0,0 +1,193 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tav/elko/pkg/config"
+	"github.com/tav/elko/pkg/logstore"
+	"github.com/tav/elko/pkg/protocol"
+	"github.com/tav/golly/log"
+)
+
+func cmdLogs(argv []string, usage string) {
+
+	opts := createOpts("logs [SERVICE] [OPTIONS]",
+		`Show the logs collected by the log.persist service. If no service is
+  specified, logs from all services are shown.`)
+
+	admin := opts.Flags("--admin").Label("ADDR").String(
+		"query the admin API of the service manager at the given address (only covers the logs of that node)")
+
+	logContext := opts.Flags("--context").Label("ID").String(
+		"only show logs for the given context ID")
+
+	dir := opts.Flags("--dir").Label("PATH").String(
+		"the log directory to read from (defaults to .elko/logs in the project root)")
+
+	errorsOnly := opts.Flags("--errors").Bool(
+		"only show error logs")
+
+	follow := opts.Flags("-f", "--follow").Bool(
+		"keep running and show new logs as they are written")
+
+	since := opts.Flags("--since").Label("TIME").String(
+		"only show logs since the given RFC 3339 timestamp or duration ago, e.g. 10m")
+
+	traceID := opts.Flags("--trace").Label("ID").String(
+		"only show logs for the given trace ID or traceparent")
+
+	args := opts.Parse(argv)
+	if len(args) > 1 {
+		opts.PrintUsage()
+		return
+	}
+
+	q := &logstore.Query{
+		Context:   *logContext,
+		ErrorOnly: *errorsOnly,
+		TraceID:   *traceID,
+	}
+	if len(args) == 1 {
+		q.Service = args[0]
+	}
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			log.Fatal(err)
+		}
+		q.Since = t
+	}
+
+	if *admin != "" {
+		err := queryAdminLogs(*admin, q, *follow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	root := *dir
+	if root == "" {
+		project, err := config.GetRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		root = filepath.Join(project, ".elko", "logs")
+	}
+
+	offsets, err := logstore.Scan(root, q, printLogEntry)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	if *follow {
+		stop := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			close(stop)
+		}()
+		err = logstore.Follow(root, q, offsets, stop, printLogEntry)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+}
+
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().UTC().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return t, fmt.Errorf("invalid --since value: %q", v)
+	}
+	return t, nil
+}
+
+func printLogEntry(e *protocol.LogEntry) bool {
+	level := "INFO "
+	if e.Error {
+		level = "ERROR"
+	}
+	fmt.Printf("%s %s %s[%d] %s\n",
+		e.Timestamp.Local().Format("2006-01-02 15:04:05.000"), level, e.ServiceID, e.InstanceID, e.Message)
+	if e.File != "" {
+		fmt.Printf("    at %s:%d\n", e.File, e.Line)
+	}
+	if e.Context != "" {
+		fmt.Printf("    context: %q\n", e.Context)
+	}
+	if e.TraceID != "" {
+		fmt.Printf("    trace: %s\n", e.TraceID)
+	}
+	if e.Data != nil {
+		data, err := json.Marshal(e.Data)
+		if err == nil {
+			fmt.Printf("    data: %s\n", data)
+		}
+	}
+	if e.Stacktrace != "" {
+		for _, line := range strings.Split(strings.TrimRight(e.Stacktrace, "\n"), "\n") {
+			fmt.Printf("    | %s\n", line)
+		}
+	}
+	return true
+}
+
+func queryAdminLogs(addr string, q *logstore.Query, follow bool) error {
+	params := url.Values{}
+	if q.Context != "" {
+		params.Set("context", q.Context)
+	}
+	if q.ErrorOnly {
+		params.Set("errors", "1")
+	}
+	if follow {
+		params.Set("follow", "1")
+	}
+	if q.Service != "" {
+		params.Set("service", q.Service)
+	}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format(time.RFC3339Nano))
+	}
+	if q.TraceID != "" {
+		params.Set("trace", q.TraceID)
+	}
+	resp, err := http.Get("http://" + addr + "/logs?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got %d response code from the admin API", resp.StatusCode)
+	}
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			e := &protocol.LogEntry{}
+			if json.Unmarshal(line, e) == nil {
+				printLogEntry(e)
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
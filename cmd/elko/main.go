@@ -16,13 +16,23 @@ func createOpts(cmd string, usage string) *optparse.Parser {
 func main() {
 
 	commands := map[string]func([]string, string){
+		"call":            cmdCall,
+		"describe":        cmdDescribe,
+		"dev-certs":       cmdDevCerts,
+		"logs":            cmdLogs,
 		"run":             cmdRun,
 		"service-manager": cmdServiceManager,
+		"status":          cmdStatus,
 	}
 
 	usage := map[string]string{
+		"call":            "Call a service method and print the result",
+		"describe":        "Show the methods and types of a service",
+		"dev-certs":       "Generate a dev CA and node certificates for local TLS",
+		"logs":            "Query and tail the logs collected from services",
 		"run":             "Build and run the specified services in dev mode",
 		"service-manager": "Run just the service manager component",
+		"status":          "Show an overview of the cluster and its services",
 	}
 
 	description := `	┏━╸╻  ╻┏ ┏━┓
@@ -0,0 +1,367 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tav/elko/pkg/protocol"
+)
+
+// The runtimes that elko run knows how to build services for.
+const (
+	runtimeGo     = "go"
+	runtimeNodeJS = "nodejs"
+)
+
+const elkoPackage = "github.com/tav/elko/pkg/elko"
+
+// devPackage is a directory within the project which builds into an
+// executable for one or more services. Go packages can register multiple
+// services, and the one to run is then selected with SERVICE_ID. The built
+// field is the filecache index at which the package was last built, and dirs
+// and files are the directories and source files found in it at the time. For
+// Go packages, deps holds the directories of the other packages within the
+// project that it imports, whose files are tracked along with its own.
+type devPackage struct {
+	built    int
+	deps     []string
+	dir      string
+	dirs     []string
+	files    []string
+	main     string
+	output   string
+	rel      string
+	runtime  string
+	services []string
+	tsc      bool
+}
+
+// build compiles the package, and returns the output of the compiler if it
+// fails.
+func (p *devPackage) build() ([]byte, error) {
+	var cmd *exec.Cmd
+	switch p.runtime {
+	case runtimeGo:
+		err := os.MkdirAll(filepath.Dir(p.output), 0755)
+		if err != nil {
+			return nil, err
+		}
+		// The binary is built alongside the one that may still be running,
+		// and then moved into place.
+		cmd = exec.Command("build-go-service", "-o", p.output+".tmp", p.dir)
+	case runtimeNodeJS:
+		if !p.tsc {
+			return nil, nil
+		}
+		// As with the runtime's own build script, the local tsc is preferred
+		// over any on the PATH.
+		tsc := filepath.Join(p.dir, "node_modules", ".bin", "tsc")
+		if _, err := os.Stat(tsc); err != nil {
+			tsc = "tsc"
+		}
+		cmd = exec.Command(tsc, "-p", p.dir)
+	default:
+		return nil, fmt.Errorf("unknown runtime %q for %s", p.runtime, p.rel)
+	}
+	cmd.Dir = p.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, fmt.Errorf("couldn't run %s: %s", cmd.Args[0], err)
+		}
+		return out, fmt.Errorf("couldn't build %s", p.rel)
+	}
+	if p.runtime == runtimeGo {
+		return nil, os.Rename(p.output+".tmp", p.output)
+	}
+	return nil, nil
+}
+
+// command returns the command for running an instance of one of the package's
+// services.
+func (p *devPackage) command() *exec.Cmd {
+	var cmd *exec.Cmd
+	if p.runtime == runtimeGo {
+		cmd = exec.Command(p.output)
+	} else {
+		cmd = exec.Command("node", p.main)
+	}
+	cmd.Dir = p.dir
+	return cmd
+}
+
+// isSource returns whether the file at path is one that the package is built
+// from. The .d.ts files emitted by tsc are excluded, so that a build doesn't
+// trigger another.
+func (p *devPackage) isSource(path string) bool {
+	name := filepath.Base(path)
+	if p.runtime == runtimeGo {
+		return strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")
+	}
+	if name == "package.json" || name == "tsconfig.json" {
+		return true
+	}
+	if p.tsc {
+		return (strings.HasSuffix(name, ".ts") || strings.HasSuffix(name, ".tsx")) && !strings.HasSuffix(name, ".d.ts")
+	}
+	return strings.HasSuffix(name, ".js")
+}
+
+// goDeps returns the directories of the packages within the project that the Go
+// package imports, directly or indirectly, other than those within the package
+// directory itself. The previous ones are kept if go list fails.
+func (p *devPackage) goDeps(root string) []string {
+	cmd := exec.Command("go", "list", "-e", "-deps", "-f", "{{if not .Standard}}{{.Dir}}{{end}}", ".")
+	cmd.Dir = p.dir
+	out, err := cmd.Output()
+	if err != nil {
+		return p.deps
+	}
+	deps := []string{}
+	for _, dir := range strings.Split(string(out), "\n") {
+		if dir == "" || dir == p.dir || strings.HasPrefix(dir, p.dir+string(os.PathSeparator)) {
+			continue
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			continue
+		}
+		deps = append(deps, dir)
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// sources returns the directories within the package, and the source files in
+// them, relative to the project root. The dist directories that tsc is usually
+// set to output to are skipped, along with the directories skipped by
+// discoverPackages. The directories in deps are included, but not walked, as
+// each holds a package of its own.
+func (p *devPackage) sources(root string) ([]string, []string, error) {
+	dirs := []string{}
+	files := []string{}
+	err := filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != p.dir && (strings.HasPrefix(name, ".") || name == "dist" ||
+				name == "node_modules" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !p.isSource(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range p.deps {
+		listing, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		dirs = append(dirs, dir)
+		for _, info := range listing {
+			path := filepath.Join(dir, info.Name())
+			if info.IsDir() || !p.isSource(path) {
+				continue
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, rel)
+		}
+	}
+	return dirs, files, nil
+}
+
+// discoverPackages finds the services within the project. Go services are
+// found from the calls to elko.Register in main packages, and Node.js services
+// are packages which depend on the elko runtime, with their service ID taken
+// from the package name. Hidden directories, along with node_modules, testdata
+// and vendor directories, are skipped.
+func discoverPackages(root string) ([]*devPackage, error) {
+	pkgs := []*devPackage{}
+	seen := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if path != root && (strings.HasPrefix(name, ".") || name == "node_modules" ||
+			name == "testdata" || name == "vendor") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		pkg, err := findNodeService(path)
+		if err != nil {
+			return fmt.Errorf("couldn't read %s: %s", filepath.Join(rel, "package.json"), err)
+		}
+		if pkg == nil {
+			pkg, err = findGoServices(path)
+			if err != nil {
+				return fmt.Errorf("couldn't parse the Go files in %s: %s", rel, err)
+			}
+		}
+		if pkg == nil {
+			return nil
+		}
+		pkg.rel = rel
+		if pkg.runtime == runtimeGo {
+			bin := strings.Replace(rel, string(os.PathSeparator), "-", -1)
+			if rel == "." {
+				bin = "root"
+			}
+			pkg.output = filepath.Join(root, ".elko", "bin", bin)
+		}
+		for _, serviceID := range pkg.services {
+			if !protocol.IsValidServiceID(serviceID) {
+				return fmt.Errorf("invalid service ID %q in %s: IDs need to be dot-separated segments of a-z and 0-9", serviceID, rel)
+			}
+			if protocol.IsBuiltinServiceID(serviceID) {
+				return fmt.Errorf("service ID %s in %s is reserved for a builtin service", serviceID, rel)
+			}
+			if other, exists := seen[serviceID]; exists {
+				return fmt.Errorf("service %s is defined in both %s and %s", serviceID, other, rel)
+			}
+			seen[serviceID] = rel
+		}
+		pkgs = append(pkgs, pkg)
+		if pkg.runtime == runtimeNodeJS {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+// findGoServices returns a package for the services registered by the main
+// package in dir, if there are any.
+func findGoServices(dir string) (*devPackage, error) {
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	main, ok := parsed["main"]
+	if !ok {
+		return nil, nil
+	}
+	services := []string{}
+	for _, file := range main.Files {
+		local := ""
+		for _, spec := range file.Imports {
+			if path, _ := strconv.Unquote(spec.Path.Value); path == elkoPackage {
+				local = "elko"
+				if spec.Name != nil {
+					local = spec.Name.Name
+				}
+			}
+		}
+		if local == "" {
+			continue
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Register" {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); !ok || x.Name != local {
+				return true
+			}
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if serviceID, err := strconv.Unquote(lit.Value); err == nil {
+					services = append(services, serviceID)
+				}
+			}
+			return true
+		})
+	}
+	if len(services) == 0 {
+		return nil, nil
+	}
+	sort.Strings(services)
+	return &devPackage{
+		dir:      dir,
+		runtime:  runtimeGo,
+		services: services,
+	}, nil
+}
+
+// findNodeService returns a package for the Node.js service in dir, if it has a
+// package.json which depends on the elko runtime.
+func findNodeService(dir string) (*devPackage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	meta := struct {
+		Dependencies map[string]string `json:"dependencies"`
+		Main         string            `json:"main"`
+		Name         string            `json:"name"`
+	}{}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := meta.Dependencies["elko"]; !ok {
+		return nil, nil
+	}
+	if meta.Main == "" {
+		meta.Main = "index.js"
+	}
+	_, err = os.Stat(filepath.Join(dir, "tsconfig.json"))
+	return &devPackage{
+		dir:      dir,
+		main:     filepath.Join(dir, meta.Main),
+		runtime:  runtimeNodeJS,
+		services: []string{meta.Name},
+		tsc:      err == nil,
+	}, nil
+}
@@ -4,44 +4,531 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/tav/elko/pkg/config"
-	"gopkg.in/yaml.v2"
+	"github.com/tav/elko/pkg/freeport"
+	"github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
 )
 
+// Unix socket paths are limited to 104 bytes on some platforms.
+const maxSocketPath = 104
+
+// Service instances are given stopTimeout to shut down gracefully before they
+// are killed.
+const stopTimeout = 5 * time.Second
+
+// The instance IDs given to services start after devInstanceBase, so that they
+// don't clash with the IDs that the service manager allocates to connections
+// which don't have one, e.g. from elko call.
+const devInstanceBase = 1 << 20
+
+// Instances which have been superseded by a reload are given drainTimeout to
+// finish handling their requests, after which the service manager tells them
+// to shut down.
+const drainTimeout = 10 * time.Second
+
+// The ANSI colours that the output of services is prefixed with, in order.
+var outputColours = []int{36, 33, 32, 35, 34, 31}
+
+// instance is a running service process.
+type instance struct {
+	cmd       *exec.Cmd
+	done      chan struct{}
+	id        uint64
+	mu        sync.Mutex
+	serviceID string
+	stopping  bool
+}
+
+func (i *instance) isStopping() bool {
+	i.mu.Lock()
+	stopping := i.stopping
+	i.mu.Unlock()
+	return stopping
+}
+
+// stop asks the instance to shut down, and kills it if it hasn't done so
+// within the timeout.
+func (i *instance) stop(timeout time.Duration) {
+	i.mu.Lock()
+	i.stopping = true
+	i.mu.Unlock()
+	i.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-i.done:
+		return
+	case <-time.After(timeout):
+	}
+	i.cmd.Process.Kill()
+	<-i.done
+}
+
+// prefixWriter writes each line of a process's output with a prefix, once the
+// line is complete.
+type prefixWriter struct {
+	buf    []byte
+	prefix string
+	r      *runner
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx == -1 {
+			break
+		}
+		w.r.print(w.prefix, w.buf[:idx])
+		w.buf = append(w.buf[:0], w.buf[idx+1:]...)
+	}
+	return len(p), nil
+}
+
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.r.print(w.prefix, w.buf)
+		w.buf = nil
+	}
+}
+
+// runner builds and supervises the services run by elko run, and multiplexes
+// their output onto stdout.
+type runner struct {
+	colour    bool
+	colours   map[string]int
+	deployID  uint64
+	draining  map[*instance]bool
+	env       []string
+	instances map[string]*instance
+	lastID    uint64
+	mu        sync.Mutex
+	out       sync.Mutex
+	root      string
+	server    *servicemanager.Server
+	socket    string
+	width     int
+}
+
+// build builds the package, and prints the compiler output if it fails.
+func (r *runner) build(pkg *devPackage) bool {
+	start := time.Now()
+	out, err := pkg.build()
+	if err != nil {
+		if len(out) > 0 {
+			w := &prefixWriter{prefix: r.prefix("build"), r: r}
+			w.Write(out)
+			w.flush()
+		}
+		log.Error(err)
+		return false
+	}
+	log.Infof("Built %s in %s", pkg.rel, time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// drain waits for the service manager to shut down an instance which has been
+// superseded, and stops it if that takes too long.
+func (r *runner) drain(inst *instance) {
+	inst.mu.Lock()
+	inst.stopping = true
+	inst.mu.Unlock()
+	r.mu.Lock()
+	r.draining[inst] = true
+	r.mu.Unlock()
+	select {
+	case <-inst.done:
+	case <-time.After(drainTimeout + stopTimeout):
+		inst.stop(stopTimeout)
+	}
+	r.mu.Lock()
+	delete(r.draining, inst)
+	r.mu.Unlock()
+	r.print(r.prefix(inst.serviceID), []byte(fmt.Sprintf("Instance %d has been replaced", inst.id)))
+}
+
+func (r *runner) prefix(label string) string {
+	prefix := fmt.Sprintf("%-*s |", r.width, label)
+	if !r.colour {
+		return prefix + " "
+	}
+	colour, ok := r.colours[label]
+	if !ok {
+		colour = 37
+	}
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m ", colour, prefix)
+}
+
+func (r *runner) print(prefix string, line []byte) {
+	r.out.Lock()
+	os.Stdout.WriteString(prefix)
+	os.Stdout.Write(bytes.TrimRight(line, "\r"))
+	os.Stdout.WriteString("\n")
+	r.out.Unlock()
+}
+
+// reload builds the package, and replaces the instances of its services with
+// new ones from a new deploy. The service manager is sent a Reload once the new
+// instances have started, and drains the old ones once the new ones are up. If
+// the build fails, the old instances are left running.
+func (r *runner) reload(pkg *devPackage) {
+	if !r.build(pkg) {
+		return
+	}
+	r.mu.Lock()
+	r.deployID++
+	deployID := r.deployID
+	r.mu.Unlock()
+	for _, serviceID := range pkg.services {
+		r.mu.Lock()
+		old := r.instances[serviceID]
+		r.mu.Unlock()
+		_, err := r.start(pkg, serviceID, deployID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if old == nil {
+			continue
+		}
+		err = r.sendReload(serviceID, deployID)
+		if err != nil {
+			log.Errorf("Couldn't reload %s: %s", serviceID, err)
+			go old.stop(stopTimeout)
+			continue
+		}
+		go r.drain(old)
+	}
+}
+
+// sendReload tells the service manager that the given deploy of the service is
+// the current one.
+func (r *runner) sendReload(serviceID string, deployID uint64) error {
+	arg, err := protocol.Marshal(&protocol.Reload{
+		DeployID:  deployID,
+		ServiceID: serviceID,
+	})
+	if err != nil {
+		return err
+	}
+	param, err := protocol.Marshal([][]byte{arg})
+	if err != nil {
+		return err
+	}
+	resp, err := sendCall("", r.socket, &pb.ClientRequest{
+		ID:            1,
+		ServiceID:     "elko.deploy",
+		ServiceMethod: "reload",
+		ServiceParam:  param,
+	}, stopTimeout)
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode != pb.ErrorCode_NONE {
+		return fmt.Errorf("%s: %s", resp.ErrorCode, resp.ErrorMessage)
+	}
+	return nil
+}
+
+// start launches a new instance of the service, and returns once the process
+// has started. The process is registered with the service manager, so that it
+// can connect over the Unix socket as the service.
+func (r *runner) start(pkg *devPackage, serviceID string, deployID uint64) (*instance, error) {
+	r.mu.Lock()
+	r.lastID++
+	id := r.lastID
+	r.mu.Unlock()
+	cmd := pkg.command()
+	cmd.Env = append(append([]string{}, r.env...),
+		"DEPLOY_ID="+strconv.FormatUint(deployID, 10),
+		"ELKO_SOCKET="+r.socket,
+		"INSTANCE_ID="+strconv.FormatUint(id, 10),
+		"SERVICE_ID="+serviceID,
+	)
+	out := &prefixWriter{prefix: r.prefix(serviceID), r: r}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start %s: %s", serviceID, err)
+	}
+	pid := cmd.Process.Pid
+	r.server.ExpectProcess(pid, serviceID)
+	inst := &instance{
+		cmd:       cmd,
+		done:      make(chan struct{}),
+		id:        id,
+		serviceID: serviceID,
+	}
+	go func() {
+		err := cmd.Wait()
+		r.server.ForgetProcess(pid)
+		out.flush()
+		close(inst.done)
+		if inst.isStopping() {
+			return
+		}
+		if err != nil {
+			r.print(out.prefix, []byte(fmt.Sprintf("Instance %d exited: %s", id, err)))
+		} else {
+			r.print(out.prefix, []byte(fmt.Sprintf("Instance %d exited", id)))
+		}
+	}()
+	r.mu.Lock()
+	r.instances[serviceID] = inst
+	r.mu.Unlock()
+	return inst, nil
+}
+
+// update rebuilds and reloads the packages with files which have changed since
+// they were last built. All packages are built on the first update.
+func (r *runner) update(pkgs []*devPackage) {
+	changed, err := changedPackages(r.root, pkgs)
+	if err != nil {
+		log.Errorf("Couldn't check the project for changes: %s", err)
+		return
+	}
+	for _, pkg := range changed {
+		r.reload(pkg)
+	}
+}
+
+// stopAll stops all of the running instances in parallel, including those
+// which are being drained.
+func (r *runner) stopAll() {
+	r.mu.Lock()
+	instances := []*instance{}
+	for _, inst := range r.instances {
+		instances = append(instances, inst)
+	}
+	for inst := range r.draining {
+		instances = append(instances, inst)
+	}
+	r.instances = map[string]*instance{}
+	r.mu.Unlock()
+	wg := sync.WaitGroup{}
+	for _, inst := range instances {
+		wg.Add(1)
+		go func(inst *instance) {
+			inst.stop(stopTimeout)
+			wg.Done()
+		}(inst)
+	}
+	wg.Wait()
+}
+
 func cmdRun(argv []string, usage string) {
 
 	opts := createOpts("run [SERVICE ...] [OPTIONS]",
 		`Build and run the specified services in dev mode. If no services are
-  specified, it defaults to running all available services.`)
+  specified, it defaults to running all available services. Services are
+  rebuilt and reloaded when their files change.`)
+
+	adminAddr := opts.Flags("--admin-addr").Label("ADDR").String(
+		"the address for the admin API to listen on [127.0.0.1:9001]")
+
+	gatewayAddr := opts.Flags("--gateway-addr").Label("ADDR").String(
+		"the address for the HTTP gateway to listen on, if routes are configured [:8080]")
+
+	noWatch := opts.Flags("--no-watch").Bool(
+		"don't rebuild and reload services when their files change")
 
 	port := opts.Flags("-p", "--port").Label("PORT").Int("the port to listen on (defaults to any available)")
 
 	services := opts.Parse(argv)
 
-	_ = port
-	_ = services
-
 	root, err := config.GetRoot()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cfgFile, err := ioutil.ReadFile(filepath.Join(root, ".elko", "config.yaml"))
+	cfg, err := config.Load(filepath.Join(root, ".elko", "config.yaml"))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cfg := &config.Elko{}
-	err = yaml.UnmarshalStrict(cfgFile, cfg)
+	pkgs, err := discoverPackages(root)
 	if err != nil {
 		log.Fatal(err)
 	}
+	pkgs, err = selectServices(pkgs, services)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pkgs) == 0 {
+		log.Fatalf("No services found in %s", root)
+	}
 
-	fmt.Printf("%#v\n", cfg)
+	// The file cache tracks files by their path relative to the working
+	// directory.
+	err = os.Chdir(root)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	if *port == 0 {
+		*port, err = freeport.Get()
+		if err != nil {
+			log.Fatalf("Couldn't find a free port for the service manager: %s", err)
+		}
+	}
+
+	var gateway *config.Gateway
+	if len(cfg.Gateway.Routes) > 0 {
+		gateway = &cfg.Gateway
+	}
+
+	// Services connect over a Unix socket, and only the processes started by
+	// the runner are allowed to register.
+	socket := devSocket(root)
+	server, err := servicemanager.New(&servicemanager.Config{
+		ACL:             &cfg.ACL,
+		AdminAddr:       *adminAddr,
+		CallTimeout:     10 * time.Second,
+		Gateway:         gateway,
+		GatewayAddr:     *gatewayAddr,
+		Heartbeat:       10 * time.Second,
+		LogDir:          filepath.Join(root, ".elko", "logs"),
+		Port:            *port,
+		ShutdownTimeout: drainTimeout,
+		SocketPath:      socket,
+		SocketVerifyPID: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The service manager needs to be listening before the services are
+	// started, as services which can't connect to it either exit or back off
+	// before trying again.
+	err = server.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		err := server.Run()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	r := newRunner(pkgs, cfg, root, server, socket)
+	r.update(pkgs)
+	if !*noWatch {
+		go r.watch(pkgs)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Info("Stopping services")
+	r.stopAll()
+
+}
+
+// devSocket returns the path of the Unix socket for the service manager. It is
+// kept within the project, so that elko call can find it, unless the path is
+// too long for a socket.
+func devSocket(root string) string {
+	path := filepath.Join(root, ".elko", "elko.sock")
+	if len(path) < maxSocketPath {
+		return path
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("elko-%d.sock", os.Getpid()))
+}
+
+// devEnv returns the environment for service processes. Any settings which
+// would point services elsewhere are removed, and the dev env.set values from
+// the config are added.
+func devEnv(cfg *config.Elko) []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "DEPLOY_ID", "ELKO_PORT", "ELKO_SOCKET", "INSTANCE_ID", "SERVICE_ID":
+			continue
+		}
+		env = append(env, kv)
+	}
+	keys := make([]string, 0, len(cfg.Dev.EnvSet))
+	for key := range cfg.Dev.EnvSet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+cfg.Dev.EnvSet[key])
+	}
+	return env
+}
+
+func newRunner(pkgs []*devPackage, cfg *config.Elko, root string, server *servicemanager.Server, socket string) *runner {
+	r := &runner{
+		colour:    isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "",
+		colours:   map[string]int{},
+		draining:  map[*instance]bool{},
+		env:       devEnv(cfg),
+		instances: map[string]*instance{},
+		lastID:    devInstanceBase,
+		root:      root,
+		server:    server,
+		socket:    socket,
+		width:     len("build"),
+	}
+	for _, pkg := range pkgs {
+		for _, serviceID := range pkg.services {
+			r.colours[serviceID] = outputColours[len(r.colours)%len(outputColours)]
+			if len(serviceID) > r.width {
+				r.width = len(serviceID)
+			}
+		}
+	}
+	return r
+}
+
+// selectServices limits the packages to the given services, if any were
+// specified.
+func selectServices(pkgs []*devPackage, services []string) ([]*devPackage, error) {
+	if len(services) == 0 {
+		return pkgs, nil
+	}
+	want := map[string]bool{}
+	for _, serviceID := range services {
+		want[serviceID] = true
+	}
+	selected := []*devPackage{}
+	for _, pkg := range pkgs {
+		ids := []string{}
+		for _, serviceID := range pkg.services {
+			if want[serviceID] {
+				ids = append(ids, serviceID)
+				delete(want, serviceID)
+			}
+		}
+		if len(ids) > 0 {
+			pkg.services = ids
+			selected = append(selected, pkg)
+		}
+	}
+	if len(want) > 0 {
+		missing := []string{}
+		for serviceID := range want {
+			missing = append(missing, serviceID)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("couldn't find services in the project: %s", strings.Join(missing, ", "))
+	}
+	return selected, nil
 }
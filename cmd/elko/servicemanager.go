@@ -4,6 +4,10 @@
 package main
 
 import (
+	"strings"
+
+	"github.com/tav/elko/pkg/compress"
+	"github.com/tav/elko/pkg/config"
 	"github.com/tav/elko/pkg/servicemanager"
 	"github.com/tav/golly/log"
 )
@@ -12,6 +16,21 @@ func cmdServiceManager(argv []string, usage string) {
 
 	opts := createOpts("service-manager [OPTIONS]", usage)
 
+	aclFile := opts.Flags("--acl").Label("FILE").String(
+		"path to an Elko config file whose acl section should be enforced")
+
+	adminAddr := opts.Flags("--admin-addr").Label("ADDR").String(
+		"the address for the admin API to listen on [127.0.0.1:9001]")
+
+	auth := opts.Flags("--auth").Label("LIST").String(
+		"comma-delimited list of the auth token types to accept, i.e. hmac, jwt")
+
+	authKey := opts.Flags("--auth-key").Label("KEY").String(
+		"the shared key for hmac auth tokens (defaults to the --cluster-key)")
+
+	authRequired := opts.Flags("--auth-required").Bool(
+		"reject requests from clients which don't have an auth token [false]")
+
 	callTimeout := opts.Flags("--call-timeout").Label("DURATION").Duration(
 		"the default timeout duration for connections and service calls [10s]")
 
@@ -27,15 +46,81 @@ func cmdServiceManager(argv []string, usage string) {
 	clusterType := opts.Flags("--cluster-type").Label("TYPE").String(
 		"the type of the cluster metadata server(s), e.g. consul, etcd, gcd, etc.")
 
+	compression := opts.Flags("--compression").Label("LIST").String(
+		"comma-delimited list of compression codecs to negotiate, in order of preference [zstd,snappy,gzip]")
+
+	compressionThreshold := opts.Flags("--compression-threshold").Label("BYTES").Int(
+		"the minimum size of payloads which will be compressed [1024]")
+
+	gatewayFile := opts.Flags("--gateway").Label("FILE").String(
+		"path to an Elko config file whose gateway section defines the HTTP routes to services")
+
+	gatewayAddr := opts.Flags("--gateway-addr").Label("ADDR").String(
+		"the address for the HTTP gateway to listen on [:8080]")
+
+	gatewayCacheDir := opts.Flags("--gateway-cache-dir").Label("PATH").String(
+		"directory for spilling cached gateway responses to disk once the in-memory cache is full")
+
+	gatewayCacheDiskSize := opts.Flags("--gateway-cache-disk-size").Label("BYTES").Int(
+		"the maximum size of the on-disk gateway cache [1073741824]")
+
+	gatewayCacheSize := opts.Flags("--gateway-cache-size").Label("BYTES").Int(
+		"the maximum size of the in-memory gateway cache, 0 to disable caching [67108864]")
+
+	gatewayMaxBodySize := opts.Flags("--gateway-max-body-size").Label("BYTES").Int(
+		"the maximum size of request bodies accepted by the HTTP gateway [8388608]")
+
+	gatewayTLSCert := opts.Flags("--gateway-tls-cert").Label("FILE").String(
+		"path to the TLS certificate for the HTTP gateway")
+
+	gatewayTLSKey := opts.Flags("--gateway-tls-key").Label("FILE").String(
+		"path to the TLS private key for the HTTP gateway")
+
 	heartbeat := opts.Flags("--heartbeat").Label("DURATION").Duration(
 		"the default duration of service heartbeats [10s]")
 
 	hostMetadata := opts.Flags("--host-metadata").Label("TYPE").String(
 		"the type of the host metadata server, e.g. aws, azure, gcp, etc.")
 
+	jwksFile := opts.Flags("--jwks-file").Label("FILE").String(
+		"path to the JWKS file with the keys for validating JWTs")
+
+	jwtAudience := opts.Flags("--jwt-audience").Label("AUDIENCE").String(
+		"the audience that JWTs need to be intended for")
+
+	jwtIssuers := opts.Flags("--jwt-issuers").Label("LIST").String(
+		"comma-delimited list of the trusted JWT issuers")
+
 	leaseDuration := opts.Flags("--lease-duration").Label("DURATION").Duration(
 		"the duration of the node lease [7s]")
 
+	logDir := opts.Flags("--log-dir").Label("PATH").String(
+		"the directory for the logs collected by the log.persist service [.elko/logs]")
+
+	logForward := opts.Flags("--log-forward").Label("TARGET").String(
+		"forward logs to syslog, syslog+udp://HOST:PORT, syslog+tcp://HOST:PORT, or an http(s) URL")
+
+	logLevel := opts.Flags("--log-level").Label("LEVEL").String(
+		"the minimum level of service logs to keep, i.e. info or error [info]")
+
+	logMaxFileSize := opts.Flags("--log-max-file-size").Label("BYTES").Int(
+		"the size at which service log files are rotated [67108864]")
+
+	logMaxFiles := opts.Flags("--log-max-files").Label("N").Int(
+		"the number of rotated log files to keep per service [10]")
+
+	logSamplePercent := opts.Flags("--log-sample-percent").Label("PERCENT").Int(
+		"the percentage of non-error service logs to keep [100]")
+
+	maxBodySize := opts.Flags("--max-body-size").Label("BYTES").Int(
+		"the maximum size of a chunked message from a service [1073741824]")
+
+	maxFrameSize := opts.Flags("--max-frame-size").Label("BYTES").Int(
+		"the maximum size of a single frame from a service [16777216]")
+
+	nodeAddr := opts.Flags("--node-addr").Label("HOST:PORT").String(
+		"the address at which other nodes can connect to this node (defaults to the hostname and --port)")
+
 	port := opts.Flags("--port").Label("PORT").Int("the port to listen on [9000]")
 
 	productionMode := opts.Flags("--production-mode").Bool(
@@ -44,20 +129,110 @@ func cmdServiceManager(argv []string, usage string) {
 	shutdownTimeout := opts.Flags("--shutdown-timeout").Label("DURATION").Duration(
 		"the duration of the service shutdown timeout [30m]")
 
+	socket := opts.Flags("--socket").Label("PATH").String(
+		"path of the Unix socket for local service connections; if set, TCP is only used by nodes")
+
+	socketVerifyPID := opts.Flags("--socket-verify-pid").Bool(
+		"only accept socket connections from processes spawned by the supervisor [false]")
+
+	spillThreshold := opts.Flags("--spill-threshold").Label("BYTES").Int(
+		"the size beyond which chunked messages are spooled to a temp file [4194304]")
+
+	tlsCA := opts.Flags("--tls-ca").Label("FILE").String(
+		"path to the CA certificate used to authenticate other nodes")
+
+	tlsCert := opts.Flags("--tls-cert").Label("FILE").String(
+		"path to the node's TLS certificate")
+
+	tlsKey := opts.Flags("--tls-key").Label("FILE").String(
+		"path to the node's TLS private key")
+
+	tlsReloadInterval := opts.Flags("--tls-reload-interval").Label("DURATION").Duration(
+		"how often to check the TLS files for changes [1m]")
+
+	traceExport := opts.Flags("--trace-export").Label("TARGET").String(
+		"file path or OTLP collector URL to export trace spans to")
+
 	opts.Parse(argv)
 
+	codecs, err := compress.ParseList(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var acl *config.ACL
+	if *aclFile != "" {
+		cfg, err := config.Load(*aclFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acl = &cfg.ACL
+	}
+
+	var gateway *config.Gateway
+	if *gatewayFile != "" {
+		cfg, err := config.Load(*gatewayFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gateway = &cfg.Gateway
+	}
+
+	issuers := []string{}
+	for _, iss := range strings.Split(*jwtIssuers, ",") {
+		iss = strings.TrimSpace(iss)
+		if iss != "" {
+			issuers = append(issuers, iss)
+		}
+	}
+
 	server, err := servicemanager.New(&servicemanager.Config{
-		CallTimeout:      *callTimeout,
-		ClusterEndpoints: *clusterEndpoints,
-		ClusterID:        *clusterID,
-		ClusterKey:       *clusterKey,
-		ClusterType:      *clusterType,
-		Heartbeat:        *heartbeat,
-		HostMetadata:     *hostMetadata,
-		LeaseDuration:    *leaseDuration,
-		Port:             *port,
-		ProductionMode:   *productionMode,
-		ShutdownTimeout:  *shutdownTimeout,
+		ACL:                  acl,
+		AdminAddr:            *adminAddr,
+		Auth:                 *auth,
+		AuthKey:              *authKey,
+		AuthRequired:         *authRequired,
+		CallTimeout:          *callTimeout,
+		ClusterEndpoints:     *clusterEndpoints,
+		ClusterID:            *clusterID,
+		ClusterKey:           *clusterKey,
+		ClusterType:          *clusterType,
+		Compression:          codecs,
+		CompressionThreshold: *compressionThreshold,
+		Gateway:              gateway,
+		GatewayAddr:          *gatewayAddr,
+		GatewayCacheDir:      *gatewayCacheDir,
+		GatewayCacheDiskSize: int64(*gatewayCacheDiskSize),
+		GatewayCacheSize:     int64(*gatewayCacheSize),
+		GatewayMaxBodySize:   int64(*gatewayMaxBodySize),
+		GatewayTLSCert:       *gatewayTLSCert,
+		GatewayTLSKey:        *gatewayTLSKey,
+		Heartbeat:            *heartbeat,
+		HostMetadata:         *hostMetadata,
+		JWKSFile:             *jwksFile,
+		JWTAudience:          *jwtAudience,
+		JWTIssuers:           issuers,
+		LeaseDuration:        *leaseDuration,
+		LogDir:               *logDir,
+		LogForward:           *logForward,
+		LogLevel:             *logLevel,
+		LogMaxFileSize:       int64(*logMaxFileSize),
+		LogMaxFiles:          *logMaxFiles,
+		LogSamplePercent:     *logSamplePercent,
+		MaxBodySize:          int64(*maxBodySize),
+		MaxFrameSize:         *maxFrameSize,
+		NodeAddr:             *nodeAddr,
+		Port:                 *port,
+		ProductionMode:       *productionMode,
+		ShutdownTimeout:      *shutdownTimeout,
+		SocketPath:           *socket,
+		SocketVerifyPID:      *socketVerifyPID,
+		SpillThreshold:       int64(*spillThreshold),
+		TLSCA:                *tlsCA,
+		TLSCert:              *tlsCert,
+		TLSKey:               *tlsKey,
+		TLSReloadInterval:    *tlsReloadInterval,
+		TraceExport:          *traceExport,
 	})
 	if err != nil {
 		log.Fatal(err)
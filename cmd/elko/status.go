@@ -0,0 +1,200 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tav/elko/pkg/servicemanager"
+	"github.com/tav/golly/log"
+)
+
+func cmdStatus(argv []string, usage string) {
+
+	opts := createOpts("status [OPTIONS]",
+		`Show an overview of the cluster, as seen by a service manager: its nodes
+  and their leases, the services and instances on each node, queue depths,
+  heartbeat ages and recent capacity readings.`)
+
+	admin := opts.Flags("--admin").Label("ADDR").String(
+		"the address of the service manager's admin API [127.0.0.1:9001]")
+
+	interval := opts.Flags("--interval").Label("DURATION").Duration(
+		"how often to refresh the status with --watch [2s]")
+
+	asJSON := opts.Flags("--json").Bool(
+		"print the status as JSON")
+
+	watch := opts.Flags("--watch").Bool(
+		"keep running and refresh the status")
+
+	args := opts.Parse(argv)
+	if len(args) != 0 {
+		opts.PrintUsage()
+		os.Exit(1)
+	}
+
+	addr := *admin
+	if addr == "" {
+		addr = "127.0.0.1:9001"
+	}
+	if *interval <= 0 {
+		*interval = 2 * time.Second
+	}
+
+	for {
+		status, err := fetchStatus(addr)
+		if err != nil {
+			if !*watch {
+				log.Fatal(err)
+			}
+			log.Error(err)
+		} else if *asJSON {
+			out, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(out))
+		} else {
+			if *watch {
+				// Clear the terminal so that the status is redrawn in place.
+				fmt.Print("\x1b[H\x1b[2J")
+			}
+			printStatus(status)
+		}
+		if !*watch {
+			return
+		}
+		time.Sleep(*interval)
+	}
+
+}
+
+func fetchStatus(addr string) (*servicemanager.Status, error) {
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("got %d response code from the admin API: %s",
+			resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	status := &servicemanager.Status{}
+	err = json.NewDecoder(resp.Body).Decode(status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// formatAge formats the given duration to the nearest second, or as - if the
+// time it is relative to isn't known.
+func formatAge(d time.Duration, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
+
+func formatLoad(v float64) string {
+	return fmt.Sprintf("%.0f%%", v*100)
+}
+
+func printStatus(status *servicemanager.Status) {
+	clusterID := status.ClusterID
+	if clusterID == "" {
+		clusterID = "(solo)"
+	}
+	fmt.Printf("Cluster: %s\n", clusterID)
+	fmt.Printf("Node:    %s\n", status.NodeID)
+
+	now := time.Now()
+	fmt.Printf("\nNodes:\n\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  ID\tLEASE\tINSTANCES\tCPU\tMEM\tUPDATED")
+	for _, node := range status.Nodes {
+		id, lease := node.ID, node.Lease
+		if id == status.NodeID {
+			id += " (self)"
+		}
+		if lease == "" {
+			lease = "-"
+		}
+		cpu, mem := "-", "-"
+		if n := len(node.Capacity); n > 0 {
+			cpu = formatLoad(node.Capacity[n-1].CPU)
+			mem = formatLoad(node.Capacity[n-1].Mem)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%d\t%s\t%s\t%s ago\n", id, lease, len(node.Instances),
+			cpu, mem, formatAge(now.Sub(node.Updated), node.Updated))
+	}
+	w.Flush()
+
+	fmt.Printf("\nServices:\n\n")
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  SERVICE\tNODE\tINSTANCES\tQUEUED")
+	rows := 0
+	for _, node := range status.Nodes {
+		queued := map[string]int{}
+		for _, inst := range node.Instances {
+			queued[inst.Service] += inst.Queued
+		}
+		services := make([]string, 0, len(node.Services))
+		for serviceID := range node.Services {
+			services = append(services, serviceID)
+		}
+		sort.Strings(services)
+		for _, serviceID := range services {
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%d\n", serviceID, node.ID, node.Services[serviceID], queued[serviceID])
+			rows++
+		}
+	}
+	if rows == 0 {
+		fmt.Fprintln(w, "  (none)")
+	}
+	w.Flush()
+
+	fmt.Printf("\nInstances:\n\n")
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  SERVICE\tID\tNODE\tVERSION\tQUEUED\tHEARTBEAT")
+	rows = 0
+	for _, node := range status.Nodes {
+		for _, inst := range node.Instances {
+			version := inst.Version
+			if version == "" {
+				version = "-"
+			}
+			fmt.Fprintf(w, "  %s\t%d\t%s\t%s\t%d\t%s ago\n", inst.Service, inst.ID, node.ID, version,
+				inst.Queued, formatAge(inst.HeartbeatAge, inst.LastHeartbeat))
+			rows++
+		}
+	}
+	if rows == 0 {
+		fmt.Fprintln(w, "  (none)")
+	}
+	w.Flush()
+
+	fmt.Printf("\nCapacity (CPU/MEM, oldest first):\n\n")
+	for _, node := range status.Nodes {
+		if len(node.Capacity) == 0 {
+			fmt.Printf("  %s: no readings yet\n", node.ID)
+			continue
+		}
+		readings := make([]string, len(node.Capacity))
+		for i, r := range node.Capacity {
+			readings[i] = formatLoad(r.CPU) + "/" + formatLoad(r.Mem)
+		}
+		fmt.Printf("  %s: %s\n", node.ID, strings.Join(readings, " "))
+	}
+}
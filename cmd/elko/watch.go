@@ -0,0 +1,116 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"time"
+
+	"github.com/tav/elko/pkg/filecache"
+	"github.com/tav/golly/log"
+)
+
+// Editors tend to write files in several steps, so changes are only acted on
+// once there have been no file events for watchDelay. Where file events aren't
+// supported, the project is checked for changes every pollInterval.
+const (
+	pollInterval = 500 * time.Millisecond
+	watchDelay   = 100 * time.Millisecond
+)
+
+// changedPackages updates the file cache with the source files of the packages,
+// and returns the packages with files which have been added, changed or removed
+// since they were last built. Packages which haven't been built yet are always
+// returned.
+func changedPackages(root string, pkgs []*devPackage) ([]*devPackage, error) {
+	resized, err := updateSources(root, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	changed := []*devPackage{}
+	refreshed := false
+	for i, pkg := range pkgs {
+		if pkg.built == 0 || resized[i] || filecache.ChangedSince(pkg.built, pkg.files...) {
+			changed = append(changed, pkg)
+			// The imports of a Go package may have changed along with its
+			// files, so the packages it depends on are looked up again.
+			if pkg.runtime == runtimeGo {
+				pkg.deps = pkg.goDeps(root)
+				refreshed = true
+			}
+		}
+	}
+	if refreshed {
+		// The files of any newly imported packages are added to the cache
+		// now, so that they don't show up as changed on the next check.
+		_, err = updateSources(root, pkgs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pkg := range changed {
+		pkg.built = filecache.Index
+	}
+	return changed, nil
+}
+
+// updateSources updates the file cache with the source files of the packages,
+// and returns whether the number of files in each package has changed.
+func updateSources(root string, pkgs []*devPackage) ([]bool, error) {
+	all := []string{}
+	// Files which have been removed no longer show up in the file cache, so
+	// they are noticed from the number of files in the package changing.
+	resized := make([]bool, len(pkgs))
+	for i, pkg := range pkgs {
+		dirs, files, err := pkg.sources(root)
+		if err != nil {
+			return nil, err
+		}
+		resized[i] = len(files) != len(pkg.files)
+		pkg.dirs = dirs
+		pkg.files = files
+		all = append(all, files...)
+	}
+	err := filecache.Update(all...)
+	if err != nil && err != filecache.ErrNothingChanged {
+		return nil, err
+	}
+	return resized, nil
+}
+
+// watch rebuilds and reloads the packages whose files change. File events are
+// used to notice changes where they're supported, and the packages are polled
+// otherwise. It doesn't return.
+func (r *runner) watch(pkgs []*devPackage) {
+	w, err := newFileWatcher()
+	if err != nil {
+		log.Infof("Polling for file changes: %s", err)
+	}
+	for {
+		if w == nil {
+			time.Sleep(pollInterval)
+			r.update(pkgs)
+			continue
+		}
+		// The directories are watched afresh each time, so that new ones
+		// are picked up.
+		for _, pkg := range pkgs {
+			for _, dir := range pkg.dirs {
+				w.add(dir)
+			}
+		}
+		if _, ok := <-w.events; !ok {
+			log.Infof("Polling for file changes: %s", w.err)
+			w = nil
+			continue
+		}
+		for settled := false; !settled; {
+			select {
+			case <-w.events:
+			case <-time.After(watchDelay):
+				settled = true
+			}
+		}
+		r.update(pkgs)
+	}
+}
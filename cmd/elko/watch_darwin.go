@@ -0,0 +1,23 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"errors"
+)
+
+// fileWatcher isn't implemented on macOS yet, so elko run polls for changes
+// instead.
+type fileWatcher struct {
+	err    error
+	events chan struct{}
+}
+
+func (w *fileWatcher) add(dir string) error {
+	return nil
+}
+
+func newFileWatcher() (*fileWatcher, error) {
+	return nil, errors.New("file events aren't supported on macOS yet")
+}
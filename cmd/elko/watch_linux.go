@@ -0,0 +1,61 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package main
+
+import (
+	"syscall"
+)
+
+const watchMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// fileWatcher uses inotify to signal when something changes within the watched
+// directories. The events channel is closed, with err set, if the watcher
+// stops working.
+type fileWatcher struct {
+	err    error
+	events chan struct{}
+	fd     int
+}
+
+// add watches the directory. Adding a directory which is already being watched
+// has no effect.
+func (w *fileWatcher) add(dir string) error {
+	_, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	return err
+}
+
+func (w *fileWatcher) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.err = err
+			close(w.events)
+			return
+		}
+		if n > 0 {
+			select {
+			case w.events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func newFileWatcher() (*fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &fileWatcher{
+		events: make(chan struct{}, 1),
+		fd:     fd,
+	}
+	go w.run()
+	return w, nil
+}
@@ -0,0 +1,90 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+// Package authtoken implements the HMAC-signed tokens which are validated by
+// the service manager using the shared cluster key.
+//
+// Tokens are of the form:
+//
+//	elko1.<base64url(json-claims)>.<base64url(hmac-sha256)>
+package authtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const prefix = "elko1."
+
+var (
+	ErrExpired   = errors.New("authtoken: token has expired")
+	ErrMalformed = errors.New("authtoken: malformed token")
+	ErrSignature = errors.New("authtoken: invalid token signature")
+)
+
+// Claims represents the contents of a token.
+type Claims struct {
+	Expiry  int64  `json:"exp"`
+	Subject string `json:"sub"`
+}
+
+// Is returns whether the given token looks like an HMAC token.
+func Is(token string) bool {
+	return strings.HasPrefix(token, prefix)
+}
+
+// Sign creates a token for the given subject which expires at the given time.
+func Sign(key []byte, subject string, expiry time.Time) (string, error) {
+	claims, err := json.Marshal(&Claims{
+		Expiry:  expiry.Unix(),
+		Subject: subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := prefix + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(key, payload)), nil
+}
+
+// Verify validates the token's signature and expiry, and returns its claims.
+func Verify(key []byte, token string, now time.Time) (*Claims, error) {
+	if !Is(token) {
+		return nil, ErrMalformed
+	}
+	idx := strings.LastIndexByte(token, '.')
+	if idx < len(prefix) {
+		return nil, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[idx+1:])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	payload := token[:idx]
+	if !hmac.Equal(sig, sign(key, payload)) {
+		return nil, ErrSignature
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload[len(prefix):])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	claims := &Claims{}
+	err = json.Unmarshal(raw, claims)
+	if err != nil || claims.Subject == "" {
+		return nil, ErrMalformed
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,67 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package authtoken
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	key := []byte("cluster-key")
+	now := time.Unix(1500000000, 0)
+	valid, err := Sign(key, "user:42", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := Sign(key, "user:42", now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Sign([]byte("other-key"), "user:42", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSubject, err := Sign(key, "", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The claims of another valid token are swapped in, while keeping the
+	// original signature.
+	admin, err := Sign(key, "admin", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := admin[:strings.LastIndexByte(admin, '.')] + valid[strings.LastIndexByte(valid, '.'):]
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, ErrExpired},
+		{"expires now", valid, ErrExpired},
+		{"wrong key", other, ErrSignature},
+		{"tampered claims", tampered, ErrSignature},
+		{"missing subject", noSubject, ErrMalformed},
+		{"missing prefix", strings.TrimPrefix(valid, prefix), ErrMalformed},
+		{"missing signature", prefix + "e30", ErrMalformed},
+		{"invalid signature encoding", valid + "!", ErrMalformed},
+		{"empty", "", ErrMalformed},
+	} {
+		at := now
+		if tt.name == "expires now" {
+			at = now.Add(time.Hour)
+		}
+		claims, err := Verify(key, tt.token, at)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && (claims.Subject != "user:42" || claims.Expiry != now.Add(time.Hour).Unix()) {
+			t.Errorf("%s: got unexpected claims: %+v", tt.name, claims)
+		}
+	}
+}
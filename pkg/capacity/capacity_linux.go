@@ -19,7 +19,7 @@ var (
 	total       float64
 	pagesize    float64
 	prevFree    float64
-	prevPageout uint32
+	prevPageout uint64
 )
 
 func cpuinfo() (float64, error) {
@@ -33,7 +33,7 @@ func cpuinfo() (float64, error) {
 			"unexpected read from /proc/loadavg: %s",
 			string(out))
 	}
-	load, err := strconv.ParseFloat(split[0], 64)
+	load, err := strconv.ParseFloat(string(split[0]), 64)
 	if err != nil {
 		return 0, err
 	}
@@ -45,8 +45,8 @@ func meminfo() (float64, error) {
 	if !initialised {
 		out, err := exec.Command("getconf", "PAGESIZE").Output()
 		if err == nil {
-			out = bytes.TrimSpace(out)
-			pagesize, err = strconv.ParseFloat(string(out), 64) / 1024
+			pagesize, err = strconv.ParseFloat(string(bytes.TrimSpace(out)), 64)
+			pagesize /= 1024
 		}
 		if err != nil {
 			pagesize = 4
@@ -60,29 +60,33 @@ func meminfo() (float64, error) {
 	var split [][]byte
 	for _, line := range bytes.Split(out, []byte{'\n'}) {
 		split = bytes.Fields(line)
-		if len(split) != 3 {
+		if len(split) == 0 {
+			continue
+		}
+		// Most lines have a kB suffix, but the HugePages counts don't.
+		if len(split) < 2 {
 			return 0, fmt.Errorf(
 				"unexpected read from /proc/meminfo: %s",
 				string(line))
 		}
-		switch split[0] {
+		switch string(split[0]) {
 		case "MemTotal:":
-			total, err = strconv.ParseFloat(split[1], 64)
+			total, err = strconv.ParseFloat(string(split[1]), 64)
 			if err != nil {
 				return 0, err
 			}
 		case "MemFree:":
-			free, err = strconv.ParseFloat(split[1], 64)
+			free, err = strconv.ParseFloat(string(split[1]), 64)
 			if err != nil {
 				return 0, err
 			}
 		case "Buffers:":
-			buffers, err = strconv.ParseFloat(split[1], 64)
+			buffers, err = strconv.ParseFloat(string(split[1]), 64)
 			if err != nil {
 				return 0, err
 			}
 		case "Cached:":
-			cached, err = strconv.ParseFloat(split[1], 64)
+			cached, err = strconv.ParseFloat(string(split[1]), 64)
 			if err != nil {
 				return 0, err
 			}
@@ -93,17 +97,17 @@ func meminfo() (float64, error) {
 	if err != nil {
 		return 0, err
 	}
-	var pgpgout uint32
+	var pgpgout uint64
 	next := false
-	for i, elem := range bytes.Fields(out) {
+	for _, elem := range bytes.Fields(out) {
 		if next {
-			pgpgout, err = uint32(strconv.ParseUint(elem, 10, 32))
+			pgpgout, err = strconv.ParseUint(string(elem), 10, 64)
 			if err != nil {
 				return 0, err
 			}
 			break
 		}
-		if elem == "pgpgout" {
+		if string(elem) == "pgpgout" {
 			next = true
 		}
 	}
@@ -111,10 +115,13 @@ func meminfo() (float64, error) {
 		return 0, fmt.Errorf(
 			"could not find a value for pgpgout from reading /proc/vmstat")
 	}
-	if prevFree < 1 {
-		load += float64(pgpgout-prevPageout) / 1
-	} else {
-		load += float64(pgpgout-prevPageout) / prevFree
+	// The paging rate can only be derived once there's a previous reading.
+	if prevPageout > 0 {
+		if prevFree < 1 {
+			load += float64(pgpgout-prevPageout) / 1
+		} else {
+			load += float64(pgpgout-prevPageout) / prevFree
+		}
 	}
 	prevFree = free
 	prevPageout = pgpgout
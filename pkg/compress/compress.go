@@ -0,0 +1,195 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+// Package compress provides the payload compression codecs which can be
+// negotiated between services and the service manager.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrTooLarge = errors.New("compress: decompressed payload exceeds the max size")
+
+// DefaultThreshold is the payload size below which compression isn't worth the
+// overhead.
+const DefaultThreshold = 1024
+
+// Preference lists the supported codecs in the order that the service manager
+// prefers them.
+var Preference = []string{"zstd", "snappy", "gzip"}
+
+var codecs = map[string]Codec{
+	"gzip":   gzipCodec{},
+	"snappy": snappyCodec{},
+	"zstd":   &zstdCodec{},
+}
+
+// Codec compresses and decompresses payloads.
+type Codec interface {
+	Compress(src []byte) ([]byte, error)
+	// Decompress returns ErrTooLarge if the decompressed payload would be
+	// larger than max bytes.
+	Decompress(src []byte, max int) ([]byte, error)
+	Name() string
+}
+
+type gzipCodec struct{}
+
+func (c gzipCodec) Compress(src []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decompress(src []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+func (c gzipCodec) Name() string {
+	return "gzip"
+}
+
+type snappyCodec struct{}
+
+func (c snappyCodec) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (c snappyCodec) Decompress(src []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, ErrTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+func (c snappyCodec) Name() string {
+	return "snappy"
+}
+
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	err  error
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		c.enc, c.err = zstd.NewWriter(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) Compress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+// Decompress decodes src as a stream, with the decoder's memory bounded by max,
+// so that a small frame claiming a huge size or window can't make it allocate
+// more than that.
+func (c *zstdCodec) Decompress(src []byte, max int) ([]byte, error) {
+	// The decoder always needs room for the minimum window, so small limits
+	// are only enforced by the LimitReader below.
+	limit := uint64(max) + 1
+	if limit < zstd.MinWindowSize {
+		limit = zstd.MinWindowSize
+	}
+	r, err := zstd.NewReader(bytes.NewReader(src),
+		zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			return nil, ErrTooLarge
+		}
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+func (c *zstdCodec) Name() string {
+	return "zstd"
+}
+
+// Get returns the codec with the given name.
+func Get(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("compress: unknown codec: %q", name)
+	}
+	return c, nil
+}
+
+// Negotiate returns the first codec in the allowed list which has also been
+// offered by the peer. It returns nil if there is no codec in common.
+func Negotiate(allowed []string, offered []string) Codec {
+	for _, name := range allowed {
+		for _, peer := range offered {
+			if name == peer {
+				if c, ok := codecs[name]; ok {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ParseList parses a comma-delimited list of codec names.
+func ParseList(list string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := codecs[name]; !ok {
+			return nil, fmt.Errorf("compress: unknown codec: %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
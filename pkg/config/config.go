@@ -5,14 +5,63 @@ package config
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 var NotFound = errors.New("config: could not locate .elko/config.yaml in the current or parent directories")
 
+// ACL specifies which services and principals may call which service
+// methods. Requests are allowed if any rule matches them. If no rules are
+// specified, all requests are allowed.
+type ACL struct {
+	DryRun bool      `yaml:"dryrun"`
+	Rules  []ACLRule `yaml:"rules"`
+}
+
+// ACLRule allows the matching callers to make calls to the matching targets.
+// Patterns use path.Match syntax. Targets are of the form "service/method",
+// e.g. "billing/*". Callers match the calling service ID, and Principals match
+// the subject of the authenticated principal. An empty Principals list matches
+// any caller, including unauthenticated ones.
+type ACLRule struct {
+	Callers    []string `yaml:"callers"`
+	Principals []string `yaml:"principals"`
+	Targets    []string `yaml:"targets"`
+}
+
+// Gateway specifies how HTTP requests received by the service manager's
+// gateway are routed to service methods. Routes are tried in order, and the
+// first one to match is used. Vary lists the request headers, e.g.
+// Accept-Language, which cached responses are keyed on in addition to the
+// method, host, path and query.
+type Gateway struct {
+	Routes []Route  `yaml:"routes"`
+	Vary   []string `yaml:"vary"`
+}
+
+// Route maps matching HTTP requests to a service method. Host uses path.Match
+// syntax, with an empty host matching any host. Path segments of the form
+// {name} match any single segment, and a final {name...} segment matches the
+// rest of the path. The matched segments are passed to the method as the
+// PathArgs of the WebRequest, in order. Methods limits the route to the given
+// HTTP methods, and Target is of the form "service/method". If WebSocket is
+// set, requests are upgraded to WebSocket connections, whose events are
+// passed to the target method.
+type Route struct {
+	Host      string   `yaml:"host"`
+	Methods   []string `yaml:"methods"`
+	Path      string   `yaml:"path"`
+	Target    string   `yaml:"target"`
+	WebSocket bool     `yaml:"websocket"`
+}
+
 type Elko struct {
+	ACL      ACL `yaml:"acl"`
 	Clusters map[string]struct {
 		Env      []string `yaml:"env"`
 		Services []string `yaml:"services"`
@@ -22,6 +71,7 @@ type Elko struct {
 		Relay       []string          `yaml:"relay"`
 		EnvSet      map[string]string `yaml:"env.set"`
 	} `yaml:"dev"`
+	Gateway Gateway `yaml:"gateway"`
 }
 
 type Node struct {
@@ -34,6 +84,20 @@ type Node struct {
 
 type Service map[string]interface{}
 
+// Load reads the Elko config file at the given path.
+func Load(path string) (*Elko, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Elko{}
+	err = yaml.UnmarshalStrict(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 func GetRoot() (string, error) {
 	root, err := os.Getwd()
 	if err != nil {
@@ -0,0 +1,166 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+// Package devcert generates a self-signed CA and node certificates so that
+// TLS between service managers can be exercised locally.
+package devcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NodeURIPrefix is the prefix of the URI SAN which binds a certificate to a
+// node ID.
+const NodeURIPrefix = "elko://node/"
+
+const validity = 365 * 24 * time.Hour
+
+// Generate writes a CA to ca.pem and ca-key.pem within dir, and a certificate
+// and key for each of the given node IDs to <node-id>.pem and
+// <node-id>-key.pem. An existing CA in dir is reused.
+func Generate(dir string, nodeIDs ...string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	ca, caKey, err := loadCA(dir)
+	if os.IsNotExist(err) {
+		ca, caKey, err = createCA(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range nodeIDs {
+		if id == "" || filepath.Base(id) != id {
+			return fmt.Errorf("devcert: invalid node id: %q", id)
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		uri, err := url.Parse(NodeURIPrefix + id)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template(id)
+		if err != nil {
+			return err
+		}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.URIs = []*url.URL{uri}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		err = write(filepath.Join(dir, id+".pem"), filepath.Join(dir, id+"-key.pem"), der, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := template("Elko Dev CA")
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = write(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, errors.New("devcert: could not decode ca.pem")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("devcert: could not decode ca-key.pem")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func template(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &x509.Certificate{
+		NotAfter:     now.Add(validity),
+		NotBefore:    now.Add(-time.Hour),
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{"Elko Dev"},
+		},
+	}, nil
+}
+
+func write(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyDER,
+	}), 0600)
+}
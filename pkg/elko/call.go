@@ -0,0 +1,253 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+// DefaultTimeout is used for calls made from contexts without a deadline.
+const DefaultTimeout = 30 * time.Second
+
+// Errors for calls which failed before reaching the target service. They can
+// be checked for with errors.Is.
+var (
+	ErrMethodNotFound   = errors.New("elko: method not found")
+	ErrNotRunning       = errors.New("elko: calls can only be made after elko.Run has been called")
+	ErrPermissionDenied = errors.New("elko: permission denied")
+	ErrServiceNotFound  = errors.New("elko: service not found")
+	ErrTimeout          = errors.New("elko: call timed out")
+	ErrUnauthenticated  = errors.New("elko: unauthenticated")
+)
+
+var (
+	errorTypes   = map[string]func(msg string) error{}
+	errorTypesMu sync.RWMutex
+)
+
+// Call is a pending call to a service method. It is sent as soon as it has
+// been created, and its result can be retrieved with Result or Wait.
+type Call struct {
+	args     []interface{}
+	ctx      *Context
+	deadline time.Time
+	done     <-chan callResult
+	err      error
+	header   protocol.Header
+	id       uint64
+	ready    chan struct{}
+	result   []byte
+	svc      string
+}
+
+// Err returns the error for the call once it has completed.
+func (c *Call) Err() error {
+	select {
+	case <-c.ready:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Result waits for the call to complete and decodes its result into out, which
+// needs to be a pointer. It can be nil if the result isn't needed.
+func (c *Call) Result(out interface{}) error {
+	err := c.Wait(context.Background())
+	if err != nil {
+		return err
+	}
+	if out == nil || len(c.result) == 0 {
+		return nil
+	}
+	return protocol.Decode(c.result, out)
+}
+
+// Wait waits for the call to complete, or for ctx to be done, in which case
+// the call is abandoned. Calls are also abandoned with ErrTimeout once the
+// deadline of the calling Context has passed.
+func (c *Call) Wait(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return c.err
+	case <-ctx.Done():
+		if rt != nil {
+			rt.cancel(c.id, ctx.Err())
+		}
+		<-c.ready
+		return c.err
+	}
+}
+
+func (c *Call) await() {
+	timer := time.NewTimer(time.Until(c.deadline))
+	var res callResult
+	select {
+	case res = <-c.done:
+	case <-timer.C:
+		rt.cancel(c.id, ErrTimeout)
+		res = <-c.done
+	}
+	timer.Stop()
+	c.finish(res)
+}
+
+func (c *Call) finish(res callResult) {
+	switch {
+	case res.err != nil:
+		c.err = res.err
+	case res.resp.ErrorCode != pb.ErrorCode_NONE:
+		c.err = decodeError(res.resp)
+	default:
+		c.result = res.resp.Result
+	}
+	close(c.ready)
+}
+
+// CallAll waits for all of the calls to complete. It returns the error of the
+// first call to fail, if any. The results of the individual calls can then be
+// retrieved with Result.
+func CallAll(ctx context.Context, calls ...*Call) error {
+	var first error
+	for _, call := range calls {
+		err := call.Wait(ctx)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// CallAny returns the first of the calls to complete successfully. The others
+// are left to complete in the background. If all of the calls fail, the error
+// of the last one to fail is returned.
+func CallAny(ctx context.Context, calls ...*Call) (*Call, error) {
+	if len(calls) == 0 {
+		return nil, errors.New("elko: CallAny needs at least one call")
+	}
+	results := make(chan *Call, len(calls))
+	for _, call := range calls {
+		go func(call *Call) {
+			<-call.ready
+			results <- call
+		}(call)
+	}
+	var err error
+	for range calls {
+		select {
+		case call := <-results:
+			if call.err == nil {
+				return call, nil
+			}
+			err = call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// RegisterError registers a constructor for errors of the given type, so that
+// errors of that type returned by called services are decoded into the Go
+// error returned by fn. Errors of unregistered types are returned as
+// *protocol.Error values.
+func RegisterError(errorType string, fn func(msg string) error) {
+	errorTypesMu.Lock()
+	errorTypes[errorType] = fn
+	errorTypesMu.Unlock()
+}
+
+func decodeError(resp *pb.ServerResponse) error {
+	switch resp.ErrorCode {
+	case pb.ErrorCode_SERVICE_ERROR:
+		errorTypesMu.RLock()
+		fn, ok := errorTypes[resp.ErrorType]
+		errorTypesMu.RUnlock()
+		if ok {
+			return fn(resp.ErrorMessage)
+		}
+		return &protocol.Error{Msg: resp.ErrorMessage, Type: resp.ErrorType}
+	case pb.ErrorCode_METHOD_NOT_FOUND:
+		return fmt.Errorf("%w: %s", ErrMethodNotFound, resp.ErrorMessage)
+	case pb.ErrorCode_SERVICE_NOT_FOUND:
+		return fmt.Errorf("%w: %s", ErrServiceNotFound, resp.ErrorMessage)
+	case pb.ErrorCode_TIMEOUT:
+		return fmt.Errorf("%w: %s", ErrTimeout, resp.ErrorMessage)
+	case pb.ErrorCode_UNAUTHENTICATED:
+		return fmt.Errorf("%w: %s", ErrUnauthenticated, resp.ErrorMessage)
+	case pb.ErrorCode_PERMISSION_DENIED:
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, resp.ErrorMessage)
+	}
+	return &protocol.Error{Msg: resp.ErrorMessage, Type: resp.ErrorCode.String()}
+}
+
+func invokeCall(ctx *Context, target string, args []interface{}) *Call {
+	return ctx.call(target, args, false)
+}
+
+func invokeIdempotentCall(ctx *Context, target string, args []interface{}) *Call {
+	return ctx.call(target, args, true)
+}
+
+// encodeArgs encodes each arg separately, so that the target service can
+// decode them into the parameter types of its method.
+func encodeArgs(args []interface{}) ([]byte, error) {
+	encoded := make([][]byte, len(args))
+	for i, arg := range args {
+		data, err := protocol.Marshal(arg)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = data
+	}
+	return protocol.Marshal(encoded)
+}
+
+// newRequest builds the request for a call to target, which is of the form
+// "service/method". Targets without a method, e.g. "log.persist", address
+// services which don't have methods.
+func newRequest(header protocol.Header, deadline time.Time, target string, args []interface{}) (*pb.ClientRequest, error) {
+	param, err := encodeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	serviceID, method := target, ""
+	if idx := strings.IndexByte(target, '/'); idx >= 0 {
+		serviceID, method = target[:idx], target[idx+1:]
+	}
+	req := &pb.ClientRequest{
+		AuthToken:     header.Auth,
+		ServiceID:     serviceID,
+		ServiceMethod: method,
+		ServiceParam:  param,
+		TraceID:       header.TraceID,
+	}
+	if !deadline.IsZero() {
+		req.Deadline, err = ptypes.TimestampProto(deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (c *client) cancel(id uint64, err error) {
+	c.mu.Lock()
+	call, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if ok {
+		call.done <- callResult{err: err}
+	}
+}
@@ -0,0 +1,563 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/tav/elko/pkg/compress"
+	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Reconnection attempts back off exponentially from minBackoff up to
+// maxBackoff, with full jitter so that the services on a node don't all
+// reconnect at the same moment when the service manager restarts.
+const (
+	maxBackoff = 10 * time.Second
+	minBackoff = 100 * time.Millisecond
+)
+
+// ErrConnectionLost is returned for calls which were sent to the service
+// manager but weren't safe to replay when the connection was lost.
+var ErrConnectionLost = errors.New("elko: connection to the service manager was lost during the call")
+
+// ConnState describes the state of a service's connection to the service
+// manager.
+type ConnState int
+
+// Connection states.
+const (
+	Connecting ConnState = iota
+	Connected
+	Reconnecting
+	Closed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", s)
+}
+
+var (
+	stateHandlers []func(ConnState)
+	stateMu       sync.Mutex
+)
+
+// OnConnState registers a function to be called whenever the state of the
+// connection to the service manager changes. Calls which need to be made while
+// disconnected are held until the connection is re-established.
+func OnConnState(fn func(state ConnState)) {
+	stateMu.Lock()
+	stateHandlers = append(stateHandlers, fn)
+	stateMu.Unlock()
+}
+
+type callResult struct {
+	err  error
+	resp *pb.ServerResponse
+}
+
+// pendingCall tracks a request until it has been responded to. Requests which
+// are idempotent are replayed if the connection is lost before a response has
+// been received, while others are failed with ErrConnectionLost.
+type pendingCall struct {
+	async      bool
+	done       chan callResult
+	idempotent bool
+	msg        []byte
+	sent       bool
+}
+
+// client maintains the connection to the service manager across restarts.
+type client struct {
+	closing      bool
+	conn         *protocol.Conn
+	handler      func(req *pb.ServerRequest)
+	instanceID   uint64
+	lastID       uint64
+	maxFrameSize int
+	meta         *pb.ClientHello
+	mu           sync.Mutex
+	pending      map[uint64]*pendingCall
+	serviceID    string
+	state        ConnState
+	stop         chan struct{}
+	streams      map[caller]*WebStream
+}
+
+// Handle implements the protocol.Handler interface.
+func (c *client) Handle(opcode byte, msg []byte) error {
+	switch pb.OP(opcode) {
+	case pb.OP_SERVER_HELLO:
+		hello := &pb.ServerHello{}
+		err := proto.Unmarshal(msg, hello)
+		if err != nil {
+			return err
+		}
+		err = c.ready(hello)
+		if err != nil {
+			// Reconnecting won't help if the versions are incompatible.
+			log.Errorf("elko: %s", err)
+			c.close()
+		}
+	case pb.OP_SERVER_REQUEST:
+		req := &pb.ServerRequest{}
+		err := proto.Unmarshal(msg, req)
+		if err != nil {
+			return err
+		}
+		if c.handler != nil {
+			go c.handler(req)
+		}
+	case pb.OP_SERVER_RESPONSE:
+		resp := &pb.ServerResponse{}
+		err := proto.Unmarshal(msg, resp)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		call, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		if ok {
+			call.done <- callResult{resp: resp}
+		}
+	case pb.OP_SERVER_CANCEL:
+		cancel := &pb.ServerCancel{}
+		err := proto.Unmarshal(msg, cancel)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		stream := c.streams[caller{id: cancel.ID, instanceID: cancel.InstanceID, nodeID: cancel.NodeID}]
+		c.mu.Unlock()
+		if stream != nil {
+			stream.cancel()
+		}
+	case pb.OP_SERVER_SHUTDOWN:
+		c.close()
+	default:
+		return fmt.Errorf("elko: received unknown opcode %d from the service manager", opcode)
+	}
+	return nil
+}
+
+// HandleStream implements the protocol.StreamHandler interface. Messages which
+// were too large for a single frame are read into memory, and then handled
+// like any other.
+func (c *client) HandleStream(opcode byte, msg *protocol.Body) error {
+	defer msg.Close()
+	r, err := msg.Reader()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.Handle(opcode, data)
+}
+
+// call sends the request to the service manager. If the request isn't async,
+// the returned channel receives the response.
+func (c *client) call(req *pb.ClientRequest, idempotent bool) (<-chan callResult, error) {
+	c.mu.Lock()
+	c.lastID++
+	req.ID = c.lastID
+	msg, err := proto.Marshal(req)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	call := &pendingCall{
+		async:      req.Async,
+		done:       make(chan callResult, 1),
+		idempotent: idempotent,
+		msg:        msg,
+	}
+	if c.state == Closed {
+		c.mu.Unlock()
+		return nil, protocol.ErrConnectionClosed
+	}
+	if c.state == Connected {
+		call.sent = writeMessage(c.conn, c.maxFrameSize, pb.OP_CLIENT_REQUEST, msg) == nil
+	}
+	if !req.Async || !call.sent {
+		c.pending[req.ID] = call
+	}
+	c.mu.Unlock()
+	return call.done, nil
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	if c.state == Closed {
+		c.mu.Unlock()
+		return
+	}
+	c.state = Closed
+	close(c.stop)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	pending := c.pending
+	c.pending = map[uint64]*pendingCall{}
+	c.mu.Unlock()
+	for _, call := range pending {
+		call.done <- callResult{err: protocol.ErrConnectionClosed}
+	}
+	c.notify(Closed)
+}
+
+func (c *client) dial() (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if path := os.Getenv("ELKO_SOCKET"); path != "" {
+		conn, err = net.Dial("unix", path)
+	} else {
+		port := os.Getenv("ELKO_PORT")
+		if port == "" {
+			port = "9000"
+		}
+		conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{1})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// heartbeat lets the service manager know that the instance is alive, at the
+// interval it asked for in its hello, until the connection is closed.
+func (c *client) heartbeat(conn *protocol.Conn, interval time.Duration) {
+	msg, _ := proto.Marshal(&pb.ClientHeartbeat{})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if conn.Write(byte(pb.OP_CLIENT_HEARTBEAT), msg) != nil {
+				return
+			}
+		case <-conn.Done():
+			return
+		}
+	}
+}
+
+// lost updates the pending calls after the connection has been lost. Streamed
+// responses are cancelled, as chunks may have been lost along with the
+// connection.
+func (c *client) lost() {
+	failed := []*pendingCall{}
+	c.mu.Lock()
+	streams := c.streams
+	c.streams = map[caller]*WebStream{}
+	for id, call := range c.pending {
+		if !call.sent || call.idempotent {
+			call.sent = false
+			continue
+		}
+		delete(c.pending, id)
+		failed = append(failed, call)
+	}
+	c.mu.Unlock()
+	for _, call := range failed {
+		call.done <- callResult{err: ErrConnectionLost}
+	}
+	for _, stream := range streams {
+		stream.cancel()
+	}
+}
+
+// maintain keeps the connection to the service manager alive until the client
+// is closed.
+func (c *client) maintain() {
+	attempt := 0
+	for {
+		var pconn *protocol.Conn
+		conn, err := c.dial()
+		if err == nil {
+			pconn, err = c.start(conn)
+		}
+		if err != nil {
+			log.Errorf("elko: couldn't connect to the service manager: %s", err)
+		} else {
+			select {
+			case <-pconn.Done():
+				if err := pconn.Err(); err != nil {
+					log.Errorf("elko: lost connection to the service manager: %s", err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+		c.mu.Lock()
+		closing := c.closing
+		c.mu.Unlock()
+		if closing {
+			<-c.stop
+			return
+		}
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		// The backoff is only reset once a connection has been fully
+		// established, so that a service manager which accepts connections
+		// but fails the hello isn't hammered.
+		c.mu.Lock()
+		if c.state == Connected {
+			attempt = 0
+		}
+		c.mu.Unlock()
+		c.setState(Reconnecting)
+		c.lost()
+		backoff := maxBackoff
+		if attempt < 10 {
+			backoff = minBackoff << uint(attempt)
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		attempt++
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff)))):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// ready marks the connection as established once the service manager has
+// replied to the hello, and sends any calls that were held or need to be
+// replayed.
+func (c *client) ready(hello *pb.ServerHello) error {
+	if hello.ProtocolVersion > protocol.Version {
+		return fmt.Errorf("service manager selected unsupported protocol version %d", hello.ProtocolVersion)
+	}
+	c.mu.Lock()
+	conn := c.conn
+	if c.instanceID == 0 {
+		c.instanceID = hello.InstanceID
+		Instance = hello.InstanceID
+	}
+	c.maxFrameSize = int(hello.MaxFrameSize)
+	if hello.Compression != "" {
+		codec, err := compress.Get(hello.Compression)
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		conn.SetCompression(codec, int(hello.CompressionThreshold))
+	}
+	for id, call := range c.pending {
+		if call.sent {
+			continue
+		}
+		call.sent = writeMessage(conn, c.maxFrameSize, pb.OP_CLIENT_REQUEST, call.msg) == nil
+		if call.sent && call.async {
+			delete(c.pending, id)
+		}
+	}
+	c.state = Connected
+	c.mu.Unlock()
+	if hello.Heartbeat != nil {
+		interval, err := ptypes.Duration(hello.Heartbeat)
+		if err == nil && interval > 0 {
+			go c.heartbeat(conn, interval)
+		}
+	}
+	c.notify(Connected)
+	return nil
+}
+
+// respond sends a response to a request from another service. Responses are
+// dropped if the connection is down, as the calling service will then either
+// replay or fail its call.
+func (c *client) respond(resp *pb.ClientResponse) error {
+	msg, err := proto.Marshal(resp)
+	if err != nil {
+		log.Errorf("elko: couldn't encode response: %s", err)
+		return err
+	}
+	c.mu.Lock()
+	conn, max, state := c.conn, c.maxFrameSize, c.state
+	c.mu.Unlock()
+	if state != Connected {
+		err = ErrConnectionLost
+	} else {
+		err = writeMessage(conn, max, pb.OP_CLIENT_RESPONSE, msg)
+	}
+	if err != nil {
+		log.Errorf("elko: dropping response for instance %d as the service manager is unavailable", resp.InstanceID)
+	}
+	return err
+}
+
+// sendStream sends a chunk of a streamed response to the caller.
+func (c *client) sendStream(to caller, chunk *pb.ServerStream) error {
+	data, err := proto.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	msg, err := proto.Marshal(&pb.ClientStream{
+		InstanceID: to.instanceID,
+		Message:    data,
+		NodeID:     to.nodeID,
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	conn, state := c.conn, c.state
+	c.mu.Unlock()
+	if state != Connected {
+		return ErrConnectionLost
+	}
+	return conn.Write(byte(pb.OP_CLIENT_STREAM), msg)
+}
+
+func (c *client) setState(state ConnState) {
+	c.mu.Lock()
+	changed := c.state != state && c.state != Closed
+	if changed {
+		c.state = state
+	}
+	c.mu.Unlock()
+	if changed {
+		c.notify(state)
+	}
+}
+
+func (c *client) notify(state ConnState) {
+	stateMu.Lock()
+	handlers := stateHandlers
+	stateMu.Unlock()
+	for _, fn := range handlers {
+		fn(state)
+	}
+}
+
+// shutdown tells the service manager that the instance is going away and then
+// closes the client.
+func (c *client) shutdown() {
+	c.mu.Lock()
+	conn, state := c.conn, c.state
+	c.closing = true
+	c.mu.Unlock()
+	if state == Connected {
+		msg, _ := proto.Marshal(&pb.ClientShutdown{})
+		if conn.Write(byte(pb.OP_CLIENT_SHUTDOWN), msg) == nil {
+			// The service manager closes the connection once it has seen
+			// the shutdown.
+			select {
+			case <-conn.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	c.close()
+}
+
+// start sends the hello over a freshly dialed connection. The same instance ID
+// is used on every connection so that the service manager sees a reconnecting
+// service as the same instance. If no instance ID was set, the one allocated
+// by the service manager on the first connection is used from then on.
+func (c *client) start(conn net.Conn) (*protocol.Conn, error) {
+	c.mu.Lock()
+	instanceID := c.instanceID
+	c.mu.Unlock()
+	msg, err := proto.Marshal(&pb.ClientHello{
+		Compression:     compress.Preference,
+		DeployID:        DeployID,
+		InstanceID:      instanceID,
+		Methods:         c.meta.Methods,
+		ProtocolVersion: protocol.Version,
+		Runtime:         runtime.Version(),
+		Schema:          c.meta.Schema,
+		ServiceID:       c.serviceID,
+		Version:         c.meta.Version,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pconn := protocol.New(conn, c.serviceID)
+	pconn.SetLimits(Limits)
+	c.mu.Lock()
+	c.conn = pconn
+	c.mu.Unlock()
+	pconn.Run(c, 0)
+	err = pconn.Write(byte(pb.OP_CLIENT_HELLO), msg)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	return pconn, nil
+}
+
+// writeMessage sends the message over the connection, using chunked transfer if
+// it is larger than the max frame size that the service manager accepts.
+func writeMessage(conn *protocol.Conn, max int, opcode pb.OP, msg []byte) error {
+	if max > 0 && len(msg) > max {
+		return conn.WriteStream(byte(opcode), bytes.NewReader(msg))
+	}
+	return conn.Write(byte(opcode), msg)
+}
+
+// newClient returns a client for the given service instance. The metadata in
+// meta, i.e. the methods, schema and version of the service, is sent in every
+// hello. Requests from the service manager are passed to handler.
+func newClient(serviceID string, instanceID uint64, meta *pb.ClientHello, handler func(req *pb.ServerRequest)) *client {
+	return &client{
+		handler:    handler,
+		instanceID: instanceID,
+		meta:       meta,
+		pending:    map[uint64]*pendingCall{},
+		serviceID:  serviceID,
+		state:      Connecting,
+		stop:       make(chan struct{}),
+		streams:    map[caller]*WebStream{},
+	}
+}
+
+// connect starts maintaining the connection to the service manager. Handlers
+// read rt from other goroutines, so it needs to be called once the client has
+// been assigned to rt.
+func (c *client) connect() {
+	c.notify(Connecting)
+	go c.maintain()
+}
@@ -6,33 +6,139 @@ package elko
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
 )
 
+// Principal identifies the authenticated client on whose behalf a request is
+// being made.
+type Principal = pb.Principal
+
 type Context struct {
 	ID     string
 	Header *protocol.Header
+	// Principal is the authenticated client for the request being handled, if
+	// any. It is carried over to the calls made from the context, unless they
+	// set an auth token of their own in the Header.
+	Principal *Principal
+	deadline  time.Time
+	parent    caller
+}
+
+// Call calls a method on another service, where target is of the form
+// "service/method". The call inherits the header of the context, so that auth
+// and the W3C traceparent in TraceID propagate to the callee, which the service
+// manager records as a child span.
+//
+// Calls which were in flight when the connection to the service manager was
+// lost fail with ErrConnectionLost, as they may or may not have been executed.
+// Use CallIdempotent for calls which are safe to replay instead.
+//
+// Calls pass through the interceptors added with UseCall before being sent.
+func (c *Context) Call(target string, args ...interface{}) *Call {
+	return chainCallInterceptors(invokeCall)(c, target, args)
+}
+
+// CallIdempotent is like Call, except that the call is replayed if the
+// connection to the service manager is lost before a response is received.
+func (c *Context) CallIdempotent(target string, args ...interface{}) *Call {
+	return chainCallInterceptors(invokeIdempotentCall)(c, target, args)
+}
+
+func (c *Context) call(target string, args []interface{}, idempotent bool) *Call {
+	deadline := c.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	call := &Call{
+		args:     args,
+		ctx:      c,
+		deadline: deadline,
+		header:   c.header(),
+		ready:    make(chan struct{}),
+		svc:      target,
+	}
+	if rt == nil {
+		call.err = ErrNotRunning
+		close(call.ready)
+		return call
+	}
+	req, err := newRequest(call.header, deadline, target, args)
+	if err == nil {
+		c.setParent(req)
+		call.done, err = rt.call(req, idempotent)
+	}
+	if err != nil {
+		call.err = err
+		close(call.ready)
+		return call
+	}
+	call.id = req.ID
+	go call.await()
+	return call
+}
+
+// Deadline returns the deadline by which calls made from the context need to
+// complete, if one has been set.
+func (c *Context) Deadline() (time.Time, bool) {
+	return c.deadline, !c.deadline.IsZero()
 }
 
-func (c *Context) Call(svc string, args ...interface{}) *Call {
-	return &Call{
-		args: args,
-		ctx:  c,
-		svc:  svc,
+// WithTimeout returns a copy of the context whose calls need to complete
+// within the given duration. The existing deadline is kept if it is earlier.
+func (c *Context) WithTimeout(d time.Duration) *Context {
+	ctx := *c
+	deadline := time.Now().Add(d)
+	if ctx.deadline.IsZero() || deadline.Before(ctx.deadline) {
+		ctx.deadline = deadline
 	}
+	return &ctx
 }
 
-func (c *Context) Fire(svc string, args ...interface{}) error {
-	err := WriteReq(c, 0, svc, args)
+// TraceParent returns the W3C traceparent of the request being handled, if
+// any.
+func (c *Context) TraceParent() string {
+	if c.Header == nil {
+		return ""
+	}
+	return c.Header.TraceID
+}
+
+// setParent marks the request as being made while handling the context's
+// request, so that the service manager carries its principal over.
+func (c *Context) setParent(req *pb.ClientRequest) {
+	req.ParentID = c.parent.id
+	req.ParentInstanceID = c.parent.instanceID
+}
+
+func (c *Context) header() protocol.Header {
+	if c.Header == nil {
+		return protocol.Header{}
+	}
+	return *c.Header
+}
+
+// Fire makes an asynchronous call to target, without waiting for a response.
+func (c *Context) Fire(target string, args ...interface{}) error {
+	if rt == nil {
+		return ErrNotRunning
+	}
+	req, err := newRequest(c.header(), c.deadline, target, args)
 	if err != nil {
-		c.ErrorData(fmt.Sprintf("Failed to encode request to service '%s'. Error: '%s'", svc, err.Error()), args)
-		return toError(err)
+		if target != "log.persist" {
+			c.ErrorData(fmt.Sprintf("Failed to encode request to service '%s'. Error: '%s'", target, err.Error()), args)
+		}
+		return err
 	}
-	return nil
+	req.Async = true
+	c.setParent(req)
+	_, err = rt.call(req, false)
+	return err
 }
 
 func (c *Context) Log(args ...interface{}) {
@@ -41,6 +147,7 @@ func (c *Context) Log(args ...interface{}) {
 		InstanceID: Instance,
 		ServiceID:  Service,
 		Context:    c.ID,
+		TraceID:    c.TraceParent(),
 		Message:    fmt.Sprint(args...),
 		Timestamp:  time.Now().UTC(),
 	})
@@ -52,6 +159,7 @@ func (c *Context) Logf(format string, args ...interface{}) {
 		InstanceID: Instance,
 		ServiceID:  Service,
 		Context:    c.ID,
+		TraceID:    c.TraceParent(),
 		Message:    fmt.Sprintf(format, args...),
 		Timestamp:  time.Now().UTC(),
 	})
@@ -63,6 +171,7 @@ func (c *Context) LogData(message string, data interface{}) {
 		InstanceID: Instance,
 		ServiceID:  Service,
 		Context:    c.ID,
+		TraceID:    c.TraceParent(),
 		Data:       data,
 		Message:    message,
 		Timestamp:  time.Now().UTC(),
@@ -75,6 +184,7 @@ func (c *Context) Error(args ...interface{}) {
 	e.InstanceID = Instance
 	e.ServiceID = Service
 	e.Context = c.ID
+	e.TraceID = c.TraceParent()
 	e.Error = true
 	e.Message = fmt.Sprint(args...)
 	e.Timestamp = time.Now().UTC()
@@ -87,6 +197,7 @@ func (c *Context) Errorf(format string, args ...interface{}) {
 	e.InstanceID = Instance
 	e.ServiceID = Service
 	e.Context = c.ID
+	e.TraceID = c.TraceParent()
 	e.Error = true
 	e.Message = fmt.Sprintf(format, args...)
 	e.Timestamp = time.Now().UTC()
@@ -99,6 +210,7 @@ func (c *Context) ErrorData(message string, data interface{}) {
 	e.InstanceID = Instance
 	e.ServiceID = Service
 	e.Context = c.ID
+	e.TraceID = c.TraceParent()
 	e.Data = data
 	e.Error = true
 	e.Message = message
@@ -123,29 +235,30 @@ func NewContext() *Context {
 	}
 }
 
-type WebResponse struct {
-	Status int               `codec:"status"`
-	Header map[string]string `codec:"header"`
-	Body   []byte            `codec:"body"`
-}
-
-type WebRequest struct {
-	Header    map[string]string   `codec:"header"`
-	Host      string              `codec:"host"`
-	Path      string              `codec:"path"`
-	Method    string              `codec:"method"`
-	PathArgs  []string            `codec:"pathArgs"`
-	QueryArgs map[string]string   `codec:"queryArgs"`
-	Cookies   map[string][]string `codec:"cookies"`
-	Scheme    string              `codec:"scheme"`
-}
+// WebRequest and WebResponse are the types exchanged with the HTTP gateway in
+// the service manager.
+type (
+	WebRequest  = protocol.WebRequest
+	WebResponse = protocol.WebResponse
+)
 
+// WebContext is passed to service methods which handle HTTP requests routed
+// to them by the gateway. Such methods have the signature:
+//
+//	func (h *Handler) Method(ctx *elko.WebContext) (Result, error)
+//
+// If the result is a []byte or string, it is used as the response body as is.
+// Other results are encoded as JSON. Methods may also just return an error,
+// in which case the response has no body. Large or long-lived responses can be
+// written with Stream instead.
 type WebContext struct {
 	*Context
 	Request *WebRequest
 	status  int
 	header  map[string]string
-	cookies map[string][]string
+	cookies []string
+	caller  caller
+	stream  *WebStream
 }
 
 func (c *WebContext) CacheResponse(d time.Duration) {
@@ -172,6 +285,29 @@ func (c *WebContext) Redirect(url string, permanent bool) {
 	c.SetHeader("location", url)
 }
 
-func toError() {
-
+// response builds the WebResponse for the result of a web method.
+func (c *WebContext) response(result interface{}) (*WebResponse, error) {
+	resp := &WebResponse{
+		Cookies: c.cookies,
+		Header:  c.header,
+		Status:  c.status,
+	}
+	switch body := result.(type) {
+	case nil:
+	case []byte:
+		resp.Body = body
+	case string:
+		resp.Body = []byte(body)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = data
+		if _, ok := c.header["content-type"]; !ok {
+			c.SetHeader("content-type", "application/json")
+			resp.Header = c.header
+		}
+	}
+	return resp, nil
 }
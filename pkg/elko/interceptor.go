@@ -0,0 +1,240 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/stats"
+)
+
+var (
+	callInterceptors []CallInterceptor
+	interceptors     []Interceptor
+	interceptorsMu   sync.RWMutex
+)
+
+// CallInfo describes a call to a method of the service that is being handled.
+type CallInfo struct {
+	// Args are the decoded args of the call. Interceptors can replace them
+	// with values of the same types before calling the next Handler.
+	Args []interface{}
+	// Method is the full name of the method, e.g. "users/GetUser".
+	Method string
+	// Web is set for methods which handle HTTP requests from the gateway.
+	Web *WebContext
+}
+
+// Handler handles a call to a method, and returns its result.
+type Handler func(ctx *Context, info *CallInfo) (interface{}, error)
+
+// Interceptor wraps the dispatch of calls to a service's methods. It can
+// inspect or modify the call before passing it on to next, return early
+// without calling next, e.g. to reject unauthorised calls, or act on the
+// result.
+type Interceptor func(ctx *Context, info *CallInfo, next Handler) (interface{}, error)
+
+// Invoker makes a call to target, which is of the form "service/method".
+type Invoker func(ctx *Context, target string, args []interface{}) *Call
+
+// CallInterceptor wraps the calls that a service makes to other services with
+// Context.Call and Context.CallIdempotent. It can, for example, set the auth
+// header on the context it passes to next, or use FailedCall to fail a call
+// without sending it. Calls made with Context.Fire aren't intercepted.
+type CallInterceptor func(ctx *Context, target string, args []interface{}, next Invoker) *Call
+
+// MethodMetrics summarises the calls to a method since the Metrics were
+// created.
+type MethodMetrics struct {
+	Calls  uint64
+	Errors uint64
+	Mean   time.Duration
+	P50    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+}
+
+// Metrics records the latency of calls. Its Interceptor records calls to the
+// service's methods, and its CallInterceptor records calls that the service
+// makes to other services.
+type Metrics struct {
+	methods map[string]*methodMetrics
+	mu      sync.Mutex
+}
+
+// CallInterceptor returns a CallInterceptor which records the latency of
+// calls, keyed on the target.
+func (m *Metrics) CallInterceptor() CallInterceptor {
+	return func(ctx *Context, target string, args []interface{}, next Invoker) *Call {
+		start := time.Now()
+		call := next(ctx, target, args)
+		go func() {
+			<-call.ready
+			m.record(target, time.Since(start), call.err)
+		}()
+		return call
+	}
+}
+
+// Interceptor returns an Interceptor which records the latency of calls to the
+// service's methods, keyed on the method name.
+func (m *Metrics) Interceptor() Interceptor {
+	return func(ctx *Context, info *CallInfo, next Handler) (interface{}, error) {
+		start := time.Now()
+		result, err := next(ctx, info)
+		m.record(info.Method, time.Since(start), err)
+		return result, err
+	}
+}
+
+// Snapshot returns the metrics recorded so far.
+func (m *Metrics) Snapshot() map[string]MethodMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := make(map[string]MethodMetrics, len(m.methods))
+	for name, mm := range m.methods {
+		snapshot[name] = MethodMetrics{
+			Calls:  mm.calls,
+			Errors: mm.errors,
+			Mean:   time.Duration(mm.latency.Mean()),
+			P50:    time.Duration(mm.latency.Percentile(0.5)),
+			P95:    time.Duration(mm.latency.Percentile(0.95)),
+			P99:    time.Duration(mm.latency.Percentile(0.99)),
+		}
+	}
+	return snapshot
+}
+
+func (m *Metrics) record(name string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm, ok := m.methods[name]
+	if !ok {
+		mm = &methodMetrics{latency: stats.New(1028, 0.015, time.Hour)}
+		m.methods[name] = mm
+	}
+	mm.calls++
+	if err != nil {
+		mm.errors++
+	}
+	mm.latency.Update(time.Now(), int64(latency))
+}
+
+type methodMetrics struct {
+	calls   uint64
+	errors  uint64
+	latency *stats.Histogram
+}
+
+// FailedCall returns a Call that has already failed with err. It is useful for
+// CallInterceptors which need to fail a call without sending it.
+func FailedCall(err error) *Call {
+	call := &Call{
+		err:   err,
+		ready: make(chan struct{}),
+	}
+	close(call.ready)
+	return call
+}
+
+// Logger returns an Interceptor which logs every call to the service's
+// methods, along with how long it took, and logs failed calls as errors.
+func Logger() Interceptor {
+	return func(ctx *Context, info *CallInfo, next Handler) (interface{}, error) {
+		start := time.Now()
+		result, err := next(ctx, info)
+		if err != nil {
+			ctx.ErrorData(fmt.Sprintf("Call to %s failed after %s: %s", info.Method, time.Since(start), err), info.Args)
+		} else {
+			ctx.Logf("Called %s in %s", info.Method, time.Since(start))
+		}
+		return result, err
+	}
+}
+
+// NewMetrics returns Metrics with nothing recorded yet.
+func NewMetrics() *Metrics {
+	return &Metrics{methods: map[string]*methodMetrics{}}
+}
+
+// Recover returns an Interceptor which turns panics in the interceptors after
+// it, or in the method itself, into an elko.Panic error for the caller. The
+// panic is logged as an error LogEntry with the stacktrace of the panic. It is
+// best used as the first interceptor.
+func Recover() Interceptor {
+	return func(ctx *Context, info *CallInfo, next Handler) (result interface{}, err error) {
+		defer func() {
+			e := recover()
+			if e == nil {
+				return
+			}
+			entry := &protocol.LogEntry{
+				Context:    ctx.ID,
+				DeployID:   DeployID,
+				Error:      true,
+				InstanceID: Instance,
+				Message:    fmt.Sprintf("Panic in %s: %v", info.Method, e),
+				ServiceID:  Service,
+				Stacktrace: string(debug.Stack()),
+				Timestamp:  time.Now().UTC(),
+				TraceID:    ctx.TraceParent(),
+			}
+			ctx.Fire("log.persist", entry)
+			result = nil
+			err = &protocol.Error{Type: ErrorTypePanic, Msg: fmt.Sprint(e)}
+		}()
+		return next(ctx, info)
+	}
+}
+
+// Use adds interceptors to the chain which wraps the dispatch of calls to the
+// service's methods. Interceptors are run in the order they are added, so the
+// first one added is the outermost. Use is best called before Run, e.g.
+//
+//	metrics := elko.NewMetrics()
+//	elko.Use(elko.Recover(), elko.Logger(), metrics.Interceptor())
+func Use(fns ...Interceptor) {
+	interceptorsMu.Lock()
+	interceptors = append(interceptors, fns...)
+	interceptorsMu.Unlock()
+}
+
+// UseCall adds interceptors to the chain which wraps the calls that the
+// service makes to other services. As with Use, the first one added is the
+// outermost.
+func UseCall(fns ...CallInterceptor) {
+	interceptorsMu.Lock()
+	callInterceptors = append(callInterceptors, fns...)
+	interceptorsMu.Unlock()
+}
+
+func chainCallInterceptors(invoke Invoker) Invoker {
+	interceptorsMu.RLock()
+	fns := callInterceptors
+	interceptorsMu.RUnlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		fn, next := fns[i], invoke
+		invoke = func(ctx *Context, target string, args []interface{}) *Call {
+			return fn(ctx, target, args, next)
+		}
+	}
+	return invoke
+}
+
+func chainInterceptors(handler Handler) Handler {
+	interceptorsMu.RLock()
+	fns := interceptors
+	interceptorsMu.RUnlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		fn, next := fns[i], handler
+		handler = func(ctx *Context, info *CallInfo) (interface{}, error) {
+			return fn(ctx, info, next)
+		}
+	}
+	return handler
+}
@@ -0,0 +1,118 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"crypto/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Details of the running service instance. These are set by Run, except for
+// Instance, which is set once the service manager has allocated an instance ID
+// if INSTANCE_ID wasn't set.
+var (
+	DeployID uint64
+	Instance uint64
+	Service  string
+	Version  string
+)
+
+// Limits bounds the size of the messages that the service accepts from the
+// service manager. Chunked messages larger than its spill threshold are held
+// in a temp file until they have been received in full. It needs to be set
+// before Run is called.
+var Limits = protocol.DefaultLimits()
+
+var (
+	lastCtxID  uint64
+	muCtx      sync.Mutex
+	rt         *client
+	serviceCtx = make([]byte, 8)
+)
+
+func init() {
+	// Context IDs are prefixed with random bytes so that they are unique
+	// across instances.
+	rand.Read(serviceCtx)
+}
+
+// Run connects to the service manager and serves requests for the registered
+// service until the service manager shuts it down or the process is
+// signalled to stop. The service is selected by the SERVICE_ID environment
+// variable, which can be omitted if only one service has been registered.
+//
+// The instance ID is taken from INSTANCE_ID, the deploy ID from DEPLOY_ID, and
+// the version of the service, which is reported to the service manager, from
+// SERVICE_VERSION.
+// The service manager is reached over the Unix socket at ELKO_SOCKET if it is
+// set, and on localhost at ELKO_PORT otherwise.
+func Run() {
+	id := os.Getenv("SERVICE_ID")
+	registryMu.Lock()
+	if id == "" && len(registry) == 1 {
+		for sid := range registry {
+			id = sid
+		}
+	}
+	svc, ok := registry[id]
+	ids := make([]string, 0, len(registry))
+	for sid := range registry {
+		ids = append(ids, sid)
+	}
+	registryMu.Unlock()
+	if !ok {
+		sort.Strings(ids)
+		if id == "" {
+			log.Fatalf("elko: SERVICE_ID needs to be set to one of: %s", strings.Join(ids, ", "))
+		}
+		log.Fatalf("elko: no service has been registered for %q (registered: %s)", id, strings.Join(ids, ", "))
+	}
+	Service = id
+	Instance = envUint("INSTANCE_ID")
+	DeployID = envUint("DEPLOY_ID")
+	Version = os.Getenv("SERVICE_VERSION")
+	schema, err := svc.schema()
+	if err != nil {
+		log.Fatal(err)
+	}
+	hello := &pb.ClientHello{
+		Methods: svc.methodNames(),
+		Version: Version,
+	}
+	hello.Schema, err = protocol.Marshal(schema)
+	if err != nil {
+		log.Fatalf("elko: couldn't encode the schema for %s: %s", Service, err)
+	}
+	rt = newClient(Service, Instance, hello, svc.handle)
+	rt.connect()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sig:
+		rt.shutdown()
+	case <-rt.stop:
+	}
+}
+
+func envUint(name string) uint64 {
+	val := os.Getenv(name)
+	if val == "" {
+		return 0
+	}
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		log.Fatalf("elko: invalid %s value %q: %s", name, val, err)
+	}
+	return n
+}
@@ -0,0 +1,395 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Error types set on responses for failures within the runtime itself, as
+// opposed to errors returned by service methods.
+const (
+	ErrorTypeInvalidArgs    = "elko.InvalidArgs"
+	ErrorTypeMethodNotFound = "elko.MethodNotFound"
+	ErrorTypePanic          = "elko.Panic"
+)
+
+var (
+	contextType    = reflect.TypeOf((*Context)(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	webContextType = reflect.TypeOf((*WebContext)(nil))
+)
+
+var (
+	registry   = map[string]*service{}
+	registryMu sync.Mutex
+)
+
+// errStreamed is returned by method.call when the response has already been
+// sent as a stream.
+var errStreamed = errors.New("elko: response has been streamed")
+
+// TypedError can be implemented by errors returned from service methods to
+// set the error type on the response. Callers get the type back on the
+// protocol.Error they receive.
+type TypedError interface {
+	error
+	ErrorType() string
+}
+
+// caller identifies a request by the calling instance and the ID that the
+// caller gave it, which is where responses need to be routed.
+type caller struct {
+	id         uint64
+	instanceID uint64
+	nodeID     string
+}
+
+type method struct {
+	args   []reflect.Type
+	fn     reflect.Value
+	name   string
+	result bool
+	web    bool
+}
+
+type service struct {
+	id      string
+	methods map[string]*method
+}
+
+// call decodes the encoded args, calls the method and returns its encoded
+// result. Web methods are passed a WebContext for the WebRequest sent by the
+// gateway, and their result is encoded as a WebResponse, unless the response
+// was streamed.
+func (m *method) call(ctx *Context, from caller, param []byte) (result []byte, err error) {
+	var encoded [][]byte
+	if len(param) > 0 {
+		err = protocol.Decode(param, &encoded)
+		if err != nil {
+			return nil, &protocol.Error{Type: ErrorTypeInvalidArgs, Msg: err.Error()}
+		}
+	}
+	var wctx *WebContext
+	if m.web {
+		if len(encoded) != 1 {
+			return nil, &protocol.Error{
+				Type: ErrorTypeInvalidArgs,
+				Msg:  fmt.Sprintf("%s takes a single WebRequest, got %d args", m.name, len(encoded)),
+			}
+		}
+		wctx = &WebContext{Context: ctx, Request: &WebRequest{}, caller: from}
+		err = protocol.Decode(encoded[0], wctx.Request)
+		if err != nil {
+			return nil, &protocol.Error{
+				Type: ErrorTypeInvalidArgs,
+				Msg:  fmt.Sprintf("couldn't decode the WebRequest for %s: %s", m.name, err),
+			}
+		}
+		encoded = nil
+		// This runs after any panic has been recovered, so that streams are
+		// always ended.
+		defer func() {
+			if wctx.stream != nil {
+				wctx.stream.end(err)
+				result, err = nil, errStreamed
+			}
+		}()
+	}
+	if len(encoded) > len(m.args) {
+		return nil, &protocol.Error{
+			Type: ErrorTypeInvalidArgs,
+			Msg:  fmt.Sprintf("%s takes %d args, got %d", m.name, len(m.args), len(encoded)),
+		}
+	}
+	info := &CallInfo{
+		Args:   make([]interface{}, len(m.args)),
+		Method: m.name,
+		Web:    wctx,
+	}
+	for i, typ := range m.args {
+		arg := reflect.New(typ)
+		if i < len(encoded) {
+			err = protocol.Decode(encoded[i], arg.Interface())
+			if err != nil {
+				return nil, &protocol.Error{
+					Type: ErrorTypeInvalidArgs,
+					Msg:  fmt.Sprintf("couldn't decode arg %d of %s: %s", i+1, m.name, err),
+				}
+			}
+		}
+		info.Args[i] = arg.Elem().Interface()
+	}
+	// Panics which aren't handled by the Recover interceptor are still caught
+	// here, so that a single request can't take down the instance.
+	defer func() {
+		if e := recover(); e != nil {
+			buf := make([]byte, 4096)
+			log.Errorf("elko: panic in %s: %v\n%s", m.name, e, buf[:runtime.Stack(buf, false)])
+			result = nil
+			err = &protocol.Error{Type: ErrorTypePanic, Msg: fmt.Sprint(e)}
+		}
+	}()
+	res, err := chainInterceptors(m.dispatch)(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	if wctx != nil {
+		resp, err := wctx.response(res)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.Marshal(resp)
+	}
+	if !m.result {
+		return nil, nil
+	}
+	return protocol.Marshal(res)
+}
+
+// dispatch is the innermost Handler of the interceptor chain, which calls the
+// method itself with the args in info.
+func (m *method) dispatch(ctx *Context, info *CallInfo) (interface{}, error) {
+	in := make([]reflect.Value, len(m.args)+1)
+	if info.Web != nil {
+		in[0] = reflect.ValueOf(info.Web)
+	} else {
+		in[0] = reflect.ValueOf(ctx)
+	}
+	if len(info.Args) != len(m.args) {
+		return nil, &protocol.Error{
+			Type: ErrorTypeInvalidArgs,
+			Msg:  fmt.Sprintf("%s takes %d args, got %d", m.name, len(m.args), len(info.Args)),
+		}
+	}
+	for i, arg := range info.Args {
+		if arg == nil {
+			in[i+1] = reflect.Zero(m.args[i])
+			continue
+		}
+		v := reflect.ValueOf(arg)
+		if !v.Type().AssignableTo(m.args[i]) {
+			return nil, &protocol.Error{
+				Type: ErrorTypeInvalidArgs,
+				Msg:  fmt.Sprintf("arg %d of %s needs to be a %s, got %T", i+1, m.name, m.args[i], arg),
+			}
+		}
+		in[i+1] = v
+	}
+	out := m.fn.Call(in)
+	if errv := out[len(out)-1]; !errv.IsNil() {
+		return nil, errv.Interface().(error)
+	}
+	if m.result {
+		return out[0].Interface(), nil
+	}
+	return nil, nil
+}
+
+// handle serves a request routed to the service by the service manager.
+func (s *service) handle(req *pb.ServerRequest) {
+	creq := &pb.ClientRequest{}
+	err := proto.Unmarshal(req.Message, creq)
+	if err != nil {
+		log.Errorf("elko: couldn't decode request from the service manager: %s", err)
+		return
+	}
+	from := caller{id: creq.ID, instanceID: req.InstanceID, nodeID: req.NodeID}
+	ctx := NewContext()
+	ctx.Header.TraceID = creq.TraceID
+	ctx.Principal = req.Principal
+	ctx.parent = from
+	if creq.Deadline != nil {
+		ctx.deadline, _ = ptypes.Timestamp(creq.Deadline)
+	}
+	resp := &pb.ServerResponse{ID: creq.ID}
+	m, ok := s.methods[methodKey(creq.ServiceMethod)]
+	if ok {
+		resp.Result, err = m.call(ctx, from, creq.ServiceParam)
+		if err == errStreamed {
+			return
+		}
+	} else {
+		err = &protocol.Error{
+			Type: ErrorTypeMethodNotFound,
+			Msg:  fmt.Sprintf("%s has no method %q", s.id, creq.ServiceMethod),
+		}
+	}
+	if err != nil {
+		resp.ErrorCode = pb.ErrorCode_SERVICE_ERROR
+		if !ok {
+			resp.ErrorCode = pb.ErrorCode_METHOD_NOT_FOUND
+		}
+		resp.ErrorType, resp.ErrorMessage = errorInfo(err)
+	}
+	if creq.Async {
+		if err != nil {
+			ctx.Errorf("Async call to %s/%s failed: %s", s.id, creq.ServiceMethod, err)
+		}
+		return
+	}
+	msg, err := proto.Marshal(resp)
+	if err != nil {
+		log.Errorf("elko: couldn't encode response to %s: %s", creq.ServiceMethod, err)
+		return
+	}
+	rt.respond(&pb.ClientResponse{
+		InstanceID: req.InstanceID,
+		Message:    msg,
+		NodeID:     req.NodeID,
+	})
+}
+
+// methodNames returns the names of the service's methods, as reported to the
+// service manager in the hello.
+func (s *service) methodNames() []string {
+	names := make([]string, 0, len(s.methods))
+	for _, m := range s.methods {
+		names = append(names, m.name[len(s.id)+1:])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schema describes the service's methods for the service manager's schema
+// registry.
+func (s *service) schema() (*protocol.ServiceSchema, error) {
+	schema := &protocol.ServiceSchema{
+		ServiceID: s.id,
+		Version:   Version,
+	}
+	for _, m := range s.methods {
+		ms := &protocol.MethodSchema{
+			Name: m.name[len(s.id)+1:],
+			Web:  m.web,
+		}
+		args := m.args
+		if m.web {
+			args = []reflect.Type{reflect.TypeOf(WebRequest{})}
+		}
+		for _, arg := range args {
+			as, err := protocol.SchemaOf(arg)
+			if err != nil {
+				return nil, fmt.Errorf("elko: couldn't describe the args of %s: %s", m.name, err)
+			}
+			ms.Args = append(ms.Args, as)
+		}
+		if m.web {
+			ms.Result, _ = protocol.SchemaOf(reflect.TypeOf(WebResponse{}))
+		} else if m.result {
+			rs, err := protocol.SchemaOf(m.fn.Type().Out(0))
+			if err != nil {
+				return nil, fmt.Errorf("elko: couldn't describe the result of %s: %s", m.name, err)
+			}
+			ms.Result = rs
+		}
+		schema.Methods = append(schema.Methods, ms)
+	}
+	sort.Slice(schema.Methods, func(i, j int) bool {
+		return schema.Methods[i].Name < schema.Methods[j].Name
+	})
+	return schema, nil
+}
+
+// errorInfo maps an error returned by a service method onto the error type and
+// message of a response.
+func errorInfo(err error) (string, string) {
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return perr.Type, perr.Msg
+	}
+	var verr protocol.Error
+	if errors.As(err, &verr) {
+		return verr.Type, verr.Msg
+	}
+	var terr TypedError
+	if errors.As(err, &terr) {
+		return terr.ErrorType(), terr.Error()
+	}
+	return "", err.Error()
+}
+
+// methodKey normalises method names so that both Go-style and JS-style names,
+// e.g. GetUser and getUser, resolve to the same method.
+func methodKey(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[size:]
+}
+
+// Register registers a handler for the given service ID. Exported methods on
+// the handler with the signature:
+//
+//	func (h *Handler) Method(ctx *elko.Context, args Args) (Result, error)
+//
+// are callable by other services. Methods may take any number of args after
+// the context, including none, and may return just an error if they have no
+// result. Methods which handle HTTP requests from the gateway take a
+// *elko.WebContext instead, and no other args. Other exported methods are
+// ignored. Register panics if the handler has no callable methods, or if the
+// service ID is invalid, reserved for a builtin service, or has already been
+// registered, so it is best called from an init function.
+func Register(serviceID string, handler interface{}) {
+	s := &service{
+		id:      serviceID,
+		methods: map[string]*method{},
+	}
+	v := reflect.ValueOf(handler)
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		fn := v.Method(i)
+		ft := fn.Type()
+		if ft.NumIn() < 1 || ft.IsVariadic() {
+			continue
+		}
+		web := ft.In(0) == webContextType
+		if ft.In(0) != contextType && !(web && ft.NumIn() == 1) {
+			continue
+		}
+		nout := ft.NumOut()
+		if nout < 1 || nout > 2 || ft.Out(nout-1) != errorType {
+			continue
+		}
+		args := make([]reflect.Type, ft.NumIn()-1)
+		for j := range args {
+			args[j] = ft.In(j + 1)
+		}
+		s.methods[methodKey(m.Name)] = &method{
+			args:   args,
+			fn:     fn,
+			name:   serviceID + "/" + m.Name,
+			result: nout == 2,
+			web:    web,
+		}
+	}
+	if len(s.methods) == 0 {
+		panic(fmt.Sprintf("elko: %T has no methods that can be registered for %s", handler, serviceID))
+	}
+	if !protocol.IsValidServiceID(serviceID) {
+		panic(fmt.Sprintf("elko: invalid service ID: %q", serviceID))
+	}
+	if protocol.IsBuiltinServiceID(serviceID) {
+		panic(fmt.Sprintf("elko: service ID %s is reserved for a builtin service", serviceID))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[serviceID]; exists {
+		panic(fmt.Sprintf("elko: service %s has already been registered", serviceID))
+	}
+	registry[serviceID] = s
+}
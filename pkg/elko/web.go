@@ -0,0 +1,249 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/tav/elko/pkg/protocol"
+	pb "github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Streamed data is buffered up to streamBufferSize bytes before being sent to
+// the gateway, unless it is explicitly flushed.
+const streamBufferSize = 32 * 1024
+
+// ErrStreamClosed is returned when writing to a streamed response after the
+// HTTP client has gone away, or after the connection to the service manager
+// was lost.
+var ErrStreamClosed = errors.New("elko: streamed response has been closed")
+
+var (
+	errNotForm          = errors.New("elko: request body is not a URL-encoded form")
+	errNotMultipartForm = errors.New("elko: request body is not a multipart form")
+)
+
+// WebStream writes the body of a streamed response to the HTTP client. It
+// implements io.Writer, so it can be used with io.Copy for large downloads.
+type WebStream struct {
+	buf    []byte
+	closed bool
+	done   chan struct{}
+	from   caller
+	mu     sync.Mutex
+}
+
+// Done returns a channel that is closed once the stream has been closed, e.g.
+// because the HTTP client has gone away. This is mainly useful for long-lived
+// streams, like server-sent events, which are otherwise idle.
+func (s *WebStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Flush sends any buffered data to the HTTP client.
+func (s *WebStream) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(false, nil)
+}
+
+// Write buffers the data for sending to the HTTP client.
+func (s *WebStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	s.buf = append(s.buf, p...)
+	if len(s.buf) >= streamBufferSize {
+		err := s.flush(false, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteEvent sends a server-sent event with the given event type and data. The
+// event type can be empty, in which case clients see it as a message event.
+func (s *WebStream) WriteEvent(event string, data string) error {
+	buf := &bytes.Buffer{}
+	if event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event)
+		buf.WriteByte('\n')
+	}
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: ")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.buf = append(s.buf, buf.Bytes()...)
+	return s.flush(false, nil)
+}
+
+func (s *WebStream) cancel() {
+	s.mu.Lock()
+	s.close()
+	s.mu.Unlock()
+}
+
+// close needs to be called with the lock held.
+func (s *WebStream) close() {
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// end sends any remaining data and ends the stream once the method has
+// returned. If the method failed, the stream is ended with the error, so that
+// the HTTP client sees the response being cut short.
+func (s *WebStream) end(err error) {
+	s.mu.Lock()
+	if !s.closed {
+		s.flush(true, err)
+		s.close()
+	}
+	s.mu.Unlock()
+	rt.mu.Lock()
+	delete(rt.streams, s.from)
+	rt.mu.Unlock()
+	if err != nil {
+		log.Errorf("elko: streamed response failed: %s", err)
+	}
+}
+
+// flush needs to be called with the lock held. The failure is only sent when
+// ending the stream.
+func (s *WebStream) flush(end bool, failure error) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if len(s.buf) == 0 && !end {
+		return nil
+	}
+	chunk := &pb.ServerStream{
+		Data: s.buf,
+		End:  end,
+		ID:   s.from.id,
+	}
+	if failure != nil {
+		chunk.Error = failure.Error()
+	}
+	err := rt.sendStream(s.from, chunk)
+	s.buf = nil
+	if err != nil {
+		s.close()
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// EventStream starts a streamed response for server-sent events. The gateway
+// abandons streams which go quiet for longer than the call timeout of the
+// service manager, so long-lived streams need to send events at least that
+// often, even if they are just keep-alives.
+func (c *WebContext) EventStream() (*WebStream, error) {
+	c.SetHeader("cache-control", "no-cache")
+	c.SetHeader("content-type", "text/event-stream")
+	return c.Stream()
+}
+
+// Form parses the request body as a URL-encoded form.
+func (c *WebContext) Form() (url.Values, error) {
+	typ, _, _ := mime.ParseMediaType(c.Request.Header["content-type"])
+	if typ != "application/x-www-form-urlencoded" {
+		return nil, errNotForm
+	}
+	return url.ParseQuery(string(c.Request.Body))
+}
+
+// MultipartForm parses the request body as a multipart form. File parts which
+// don't fit within maxMemory bytes are stored in temporary files, which need to
+// be removed with RemoveAll on the form once they are no longer needed.
+func (c *WebContext) MultipartForm(maxMemory int64) (*multipart.Form, error) {
+	typ, params, err := mime.ParseMediaType(c.Request.Header["content-type"])
+	if err != nil || typ != "multipart/form-data" || params["boundary"] == "" {
+		return nil, errNotMultipartForm
+	}
+	r := multipart.NewReader(bytes.NewReader(c.Request.Body), params["boundary"])
+	return r.ReadForm(maxMemory)
+}
+
+// SetCookie adds a Set-Cookie header for the cookie to the response. All of the
+// attributes supported by http.Cookie can be set, i.e. Path, Domain, Expires,
+// MaxAge, Secure, HttpOnly and SameSite. Cookies with invalid names are
+// dropped.
+func (c *WebContext) SetCookie(cookie *http.Cookie) {
+	if v := cookie.String(); v != "" {
+		c.cookies = append(c.cookies, v)
+	}
+}
+
+// Stream starts a streamed response with the status, headers and cookies that
+// have been set so far, and returns the stream for writing the body. The
+// stream is ended when the method returns, and the method's result is then
+// ignored. Calling Stream again returns the same stream.
+func (c *WebContext) Stream() (*WebStream, error) {
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	if rt == nil {
+		return nil, ErrNotRunning
+	}
+	result, err := protocol.Marshal(&WebResponse{
+		Cookies: c.cookies,
+		Header:  c.header,
+		Status:  c.status,
+		Stream:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := proto.Marshal(&pb.ServerResponse{
+		ID:     c.caller.id,
+		Result: result,
+		Stream: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream := &WebStream{
+		done: make(chan struct{}),
+		from: c.caller,
+	}
+	rt.mu.Lock()
+	rt.streams[c.caller] = stream
+	rt.mu.Unlock()
+	err = rt.respond(&pb.ClientResponse{
+		InstanceID: c.caller.instanceID,
+		Message:    msg,
+		NodeID:     c.caller.nodeID,
+	})
+	if err != nil {
+		rt.mu.Lock()
+		delete(rt.streams, c.caller)
+		rt.mu.Unlock()
+		return nil, err
+	}
+	c.stream = stream
+	return stream, nil
+}
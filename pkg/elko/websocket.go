@@ -0,0 +1,53 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package elko
+
+import (
+	"github.com/tav/elko/pkg/protocol"
+)
+
+// WebSocketEvent is passed to service methods which WebSocket routes map to.
+// Such methods have the signature:
+//
+//	func (h *Handler) Method(ctx *elko.Context, event *elko.WebSocketEvent) (Reply, error)
+//
+// The connection is refused if the method fails the connect event. Replies
+// which are a []byte or string are sent back over the connection as binary or
+// text messages respectively. Other replies are ignored, as are the results
+// for close events, which are sent once the connection has gone away.
+type WebSocketEvent = protocol.WebSocketEvent
+
+// Event types of a WebSocketEvent.
+const (
+	WebSocketClose   = protocol.WebSocketClose
+	WebSocketConnect = protocol.WebSocketConnect
+	WebSocketMessage = protocol.WebSocketMessage
+)
+
+// CloseWebSocket closes the WebSocket connection with the given ID.
+func (c *Context) CloseWebSocket(connID string) error {
+	return c.Call("elko.websocket/close", &protocol.WebSocketSend{
+		ConnID: connID,
+	}).Result(nil)
+}
+
+// SendWebSocket sends a binary message over the WebSocket connection with the
+// given ID. This can be called from any instance of any service, as the call is
+// routed to the gateway holding the connection.
+func (c *Context) SendWebSocket(connID string, data []byte) error {
+	return c.Call("elko.websocket/send", &protocol.WebSocketSend{
+		ConnID: connID,
+		Data:   data,
+	}).Result(nil)
+}
+
+// SendWebSocketText sends a text message over the WebSocket connection with
+// the given ID.
+func (c *Context) SendWebSocketText(connID string, text string) error {
+	return c.Call("elko.websocket/send", &protocol.WebSocketSend{
+		ConnID: connID,
+		Data:   []byte(text),
+		Text:   true,
+	}).Result(nil)
+}
@@ -0,0 +1,276 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+// Package logstore implements the storage behind the built-in log.persist
+// service. Entries are batched and written as JSON lines to rotated files in a
+// directory per service, and can optionally be forwarded to a syslog or HTTP
+// sink.
+package logstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tav/elko/pkg/protocol"
+	"github.com/tav/golly/log"
+)
+
+// CurrentFile is the name of the file that is actively written to within a
+// service's log directory. Rotated files are named after the time of their
+// rotation using TimeFormat.
+const (
+	CurrentFile = "current.jsonl"
+	TimeFormat  = "20060102T150405.000000000"
+)
+
+// Config specifies how log entries are stored.
+type Config struct {
+	// BatchSize is the number of entries after which a batch is written out.
+	BatchSize int
+	// Dir is the root directory for the log files.
+	Dir string
+	// FlushInterval is the maximum time that entries are held in memory.
+	FlushInterval time.Duration
+	// Forward is an optional sink to forward entries to, e.g. "syslog",
+	// "syslog+udp://host:514", or an http(s) URL.
+	Forward string
+	// Level is the minimum level of entries which are kept, i.e. "info" or
+	// "error".
+	Level string
+	// MaxFileSize is the size in bytes beyond which a log file is rotated.
+	MaxFileSize int64
+	// MaxFiles is the number of rotated files which are kept per service.
+	MaxFiles int
+	// SamplePercent is the percentage of non-error entries which are kept.
+	SamplePercent int
+}
+
+// Store receives log entries and persists them.
+type Store struct {
+	cfg     Config
+	files   map[string]*logFile
+	forward sink
+	in      chan *protocol.LogEntry
+}
+
+type logFile struct {
+	dir  string
+	f    *os.File
+	size int64
+}
+
+type sink interface {
+	Write(batch []*protocol.LogEntry) error
+}
+
+// Add queues an entry for persistence. Entries are dropped if they're below
+// the configured level, are excluded by sampling, or if the queue is full.
+func (s *Store) Add(e *protocol.LogEntry) {
+	if !e.Error {
+		if s.cfg.Level == "error" {
+			return
+		}
+		if s.cfg.SamplePercent < 100 && rand.Intn(100) >= s.cfg.SamplePercent {
+			return
+		}
+	}
+	select {
+	case s.in <- e:
+	default:
+		log.Errorf("logstore: dropping log entry from %s as the queue is full", e.ServiceID)
+	}
+}
+
+func (s *Store) file(service string) (*logFile, error) {
+	if lf, ok := s.files[service]; ok {
+		return lf, nil
+	}
+	dir := filepath.Join(s.cfg.Dir, service)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, CurrentFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	lf := &logFile{
+		dir:  dir,
+		f:    f,
+		size: info.Size(),
+	}
+	s.files[service] = lf
+	return lf, nil
+}
+
+func (s *Store) flush(batch []*protocol.LogEntry) {
+	groups := map[string]*bytes.Buffer{}
+	for _, e := range batch {
+		service := e.ServiceID
+		if service == "" {
+			service = "unknown"
+		}
+		buf, ok := groups[service]
+		if !ok {
+			buf = &bytes.Buffer{}
+			groups[service] = buf
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			log.Errorf("logstore: couldn't encode log entry from %s: %s", service, err)
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	for service, buf := range groups {
+		err := s.write(service, buf.Bytes())
+		if err != nil {
+			log.Errorf("logstore: couldn't write logs for %s: %s", service, err)
+		}
+	}
+	if s.forward != nil {
+		err := s.forward.Write(batch)
+		if err != nil {
+			log.Errorf("logstore: couldn't forward logs: %s", err)
+		}
+	}
+}
+
+func (s *Store) rotate(service string, lf *logFile) error {
+	err := lf.f.Close()
+	delete(s.files, service)
+	if err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format(TimeFormat) + ".jsonl"
+	err = os.Rename(filepath.Join(lf.dir, CurrentFile), filepath.Join(lf.dir, name))
+	if err != nil {
+		return err
+	}
+	rotated, err := Rotated(lf.dir)
+	if err != nil {
+		return err
+	}
+	for len(rotated) > s.cfg.MaxFiles {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func (s *Store) run() {
+	batch := []*protocol.LogEntry{}
+	timer := time.NewTimer(s.cfg.FlushInterval)
+	for {
+		select {
+		case e := <-s.in:
+			batch = append(batch, e)
+			if len(batch) < s.cfg.BatchSize {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(s.cfg.FlushInterval)
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.flush(batch)
+		batch = []*protocol.LogEntry{}
+	}
+}
+
+func (s *Store) write(service string, data []byte) error {
+	lf, err := s.file(service)
+	if err != nil {
+		return err
+	}
+	n, err := lf.f.Write(data)
+	lf.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if lf.size >= s.cfg.MaxFileSize {
+		return s.rotate(service, lf)
+	}
+	return nil
+}
+
+// New creates a store with the given config and starts its batching loop.
+func New(cfg Config) (*Store, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("logstore: missing log directory")
+	}
+	switch cfg.Level {
+	case "":
+		cfg.Level = "info"
+	case "info", "error":
+	default:
+		return nil, fmt.Errorf("logstore: unknown log level: %q", cfg.Level)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = 64 << 20
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = 10
+	}
+	if cfg.SamplePercent <= 0 || cfg.SamplePercent > 100 {
+		cfg.SamplePercent = 100
+	}
+	err := os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		cfg:   cfg,
+		files: map[string]*logFile{},
+		in:    make(chan *protocol.LogEntry, 10*cfg.BatchSize),
+	}
+	if cfg.Forward != "" {
+		s.forward, err = newSink(cfg.Forward)
+		if err != nil {
+			return nil, err
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// Rotated returns the paths of the rotated log files in a service's log
+// directory, from oldest to newest.
+func Rotated(dir string) ([]string, error) {
+	listing, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, path := range listing {
+		if !strings.HasSuffix(path, string(os.PathSeparator)+CurrentFile) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
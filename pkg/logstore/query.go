@@ -0,0 +1,303 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package logstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/trace"
+)
+
+// Query filters the entries returned by Scan and Follow. Zero values match
+// everything.
+type Query struct {
+	Context   string
+	ErrorOnly bool
+	Service   string
+	Since     time.Time
+	TraceID   string
+}
+
+// Match returns whether the entry satisfies the query.
+func (q *Query) Match(e *protocol.LogEntry) bool {
+	if q.ErrorOnly && !e.Error {
+		return false
+	}
+	if q.Service != "" && e.ServiceID != q.Service {
+		return false
+	}
+	if q.Context != "" && e.Context != q.Context {
+		return false
+	}
+	if q.TraceID != "" && traceID(e.TraceID) != traceID(q.TraceID) {
+		return false
+	}
+	if !q.Since.IsZero() && e.Timestamp.Before(q.Since) {
+		return false
+	}
+	return true
+}
+
+// Services returns the IDs of the services with logs in the given directory.
+func Services(root string) ([]string, error) {
+	listing, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	services := []string{}
+	for _, info := range listing {
+		if info.IsDir() {
+			services = append(services, info.Name())
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// Offsets records how far Scan read into the current log file of each service,
+// so that Follow can carry on from there without missing any entries.
+type Offsets map[string]fileOffset
+
+type fileOffset struct {
+	info   os.FileInfo
+	offset int64
+}
+
+// Scan calls fn for each entry matching the query within the log directory,
+// in the order that they were written for each service. It stops early if fn
+// returns false. The returned offsets can be passed to Follow.
+func Scan(root string, q *Query, fn func(*protocol.LogEntry) bool) (Offsets, error) {
+	offsets := Offsets{}
+	services := []string{q.Service}
+	if q.Service == "" {
+		var err error
+		services, err = Services(root)
+		if err != nil {
+			return offsets, err
+		}
+	}
+	for _, service := range services {
+		dir := filepath.Join(root, service)
+		paths, err := Rotated(dir)
+		if err != nil {
+			return offsets, err
+		}
+		if !q.Since.IsZero() {
+			paths = skipBefore(paths, q.Since)
+		}
+		current := filepath.Join(dir, CurrentFile)
+		paths = append(paths, current)
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return offsets, err
+			}
+			n, cont, err := scanFile(f, q, fn)
+			if err == nil && path == current {
+				var info os.FileInfo
+				info, err = f.Stat()
+				if err == nil {
+					offsets[service] = fileOffset{info: info, offset: n}
+				}
+			}
+			f.Close()
+			if err != nil {
+				return offsets, err
+			}
+			if !cont {
+				return offsets, nil
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// Follow calls fn for new entries matching the query as they are appended to
+// the current log files, until fn returns false or stop is closed. Files are
+// read from the given offsets, as returned by Scan, and from the start for
+// any services without one.
+func Follow(root string, q *Query, from Offsets, stop <-chan struct{}, fn func(*protocol.LogEntry) bool) error {
+	type tail struct {
+		f      *os.File
+		info   os.FileInfo
+		offset int64
+	}
+	tails := map[string]*tail{}
+	defer func() {
+		for _, t := range tails {
+			t.f.Close()
+		}
+	}()
+	resume := Offsets{}
+	for service, o := range from {
+		resume[service] = o
+	}
+	for {
+		services := []string{q.Service}
+		if q.Service == "" {
+			var err error
+			services, err = Services(root)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		for _, service := range services {
+			path := filepath.Join(root, service, CurrentFile)
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			t, ok := tails[service]
+			if ok && !os.SameFile(info, t.info) {
+				// The file has been rotated, so finish reading the old one
+				// before switching over.
+				_, cont, err := scanFile(t.f, q, fn)
+				t.f.Close()
+				delete(tails, service)
+				if err != nil {
+					return err
+				}
+				if !cont {
+					return nil
+				}
+				ok = false
+			}
+			if !ok {
+				f, err := os.Open(path)
+				if err != nil {
+					continue
+				}
+				info, err = f.Stat()
+				if err != nil {
+					f.Close()
+					continue
+				}
+				t = &tail{f: f, info: info}
+				tails[service] = t
+				if o, found := resume[service]; found {
+					delete(resume, service)
+					if os.SameFile(o.info, info) {
+						t.offset, err = f.Seek(o.offset, io.SeekStart)
+					} else {
+						// The file that Scan read has been rotated since,
+						// so the rest of it is read first.
+						var cont bool
+						cont, err = scanRotated(filepath.Join(root, service), o, q, fn)
+						if err == nil && !cont {
+							return nil
+						}
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}
+			n, cont, err := scanFile(t.f, q, fn)
+			t.offset += n
+			if err != nil {
+				return err
+			}
+			if !cont {
+				return nil
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// scanRotated reads the rest of a file that has been rotated since the given
+// offset into it was recorded.
+func scanRotated(dir string, o fileOffset, q *Query, fn func(*protocol.LogEntry) bool) (bool, error) {
+	paths, err := Rotated(dir)
+	if err != nil {
+		return true, err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || !os.SameFile(o.info, info) {
+			f.Close()
+			continue
+		}
+		_, err = f.Seek(o.offset, io.SeekStart)
+		cont := true
+		if err == nil {
+			_, cont, err = scanFile(f, q, fn)
+		}
+		f.Close()
+		return cont, err
+	}
+	return true, nil
+}
+
+// scanFile reads complete lines from the current position of f. Any trailing
+// partial line is left unread so that it can be picked up once it has been
+// fully written.
+func scanFile(f *os.File, q *Query, fn func(*protocol.LogEntry) bool) (int64, bool, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, true, err
+	}
+	r := bufio.NewReader(f)
+	read := int64(0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			_, serr := f.Seek(start+read, io.SeekStart)
+			return read, true, serr
+		}
+		if err != nil {
+			return read, true, err
+		}
+		read += int64(len(line))
+		e := &protocol.LogEntry{}
+		if json.Unmarshal(line, e) != nil {
+			continue
+		}
+		if q.Match(e) && !fn(e) {
+			return read, false, nil
+		}
+	}
+}
+
+// traceID extracts the trace ID from a traceparent value. Values which aren't
+// traceparents are assumed to be trace IDs already.
+func traceID(v string) string {
+	if p, err := trace.ParseParent(v); err == nil {
+		return p.TraceID.String()
+	}
+	return strings.ToLower(v)
+}
+
+// skipBefore drops the rotated files which were rotated before the given
+// time, as they can't contain any newer entries.
+func skipBefore(paths []string, since time.Time) []string {
+	for i, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		rotated, err := time.Parse(TimeFormat, name)
+		if err != nil || !rotated.Before(since) {
+			return paths[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package logstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tav/elko/pkg/protocol"
+)
+
+type httpSink struct {
+	client *http.Client
+	url    string
+}
+
+func (h *httpSink) Write(batch []*protocol.LogEntry) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, e := range batch {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := h.client.Post(h.url, "application/x-ndjson", buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("logstore: got %d response code from %s", resp.StatusCode, h.url)
+	}
+	return nil
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) Write(batch []*protocol.LogEntry) error {
+	for _, e := range batch {
+		line := fmt.Sprintf("%s[%d] %s", e.ServiceID, e.InstanceID, e.Message)
+		var err error
+		if e.Error {
+			err = s.w.Err(line)
+		} else {
+			err = s.w.Info(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSink(target string) (sink, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &httpSink{
+			client: &http.Client{Timeout: 10 * time.Second},
+			url:    target,
+		}, nil
+	}
+	network, addr := "", ""
+	if target != "syslog" {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "syslog+tcp":
+			network = "tcp"
+		case "syslog+udp":
+			network = "udp"
+		default:
+			return nil, fmt.Errorf("logstore: unknown forwarding target: %q", target)
+		}
+		addr = u.Host
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "elko")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
@@ -0,0 +1,91 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Body holds a payload body read off a connection. Small bodies are kept in
+// memory, while chunked bodies that grow beyond the connection's spill
+// threshold are backed by a temporary file.
+type Body struct {
+	buf     bytes.Buffer
+	chunked bool
+	file    *os.File
+	size    int64
+}
+
+// Bytes returns the in-memory contents of the body. It returns nil if the body
+// has been spilled to disk, in which case Reader needs to be used instead.
+func (b *Body) Bytes() []byte {
+	if b == nil || b.file != nil {
+		return nil
+	}
+	return b.buf.Bytes()
+}
+
+// Close releases the body and removes any backing file.
+func (b *Body) Close() error {
+	if b == nil || b.file == nil {
+		return nil
+	}
+	f := b.file
+	b.file = nil
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Len returns the total size of the body.
+func (b *Body) Len() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.size
+}
+
+// ReadAt implements the io.ReaderAt interface, so that parts of a spilled body
+// can be read without reading all of it.
+func (b *Body) ReadAt(p []byte, off int64) (int, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.buf.Bytes()).ReadAt(p, off)
+	}
+	return io.NewSectionReader(b.file, 0, b.size).ReadAt(p, off)
+}
+
+// Reader returns a reader positioned at the start of the body.
+func (b *Body) Reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.buf.Bytes()), nil
+	}
+	_, err := b.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(b.file, b.size), nil
+}
+
+// Spilled returns whether the body is backed by a temporary file.
+func (b *Body) Spilled() bool {
+	return b != nil && b.file != nil
+}
+
+func (b *Body) spill(dir string) error {
+	f, err := ioutil.TempFile(dir, "elko-body-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b.buf.Bytes())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	b.buf = bytes.Buffer{}
+	b.file = f
+	return nil
+}
@@ -0,0 +1,896 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The binary encoding is self-describing, with every value prefixed by a type
+// byte. Struct fields are keyed by name and sorted, and map entries are sorted
+// by their encoded keys, so that the same value always encodes to the same
+// bytes.
+//
+// Schema evolution follows these rules:
+//
+//   - Fields are matched by the name in their `protobuf` tag (or `codec` tag,
+//     or the Go field name), so fields can be reordered freely.
+//   - Unknown fields are skipped when decoding.
+//   - Missing fields are set to the value given by a `default=` tag option, or
+//     left untouched otherwise.
+//   - Integer values can be widened, and signed and unsigned values are
+//     interchangeable as long as they fit the destination.
+//
+// Payloads starting with anything other than the format byte are treated as
+// JSON, which makes it possible to hand-craft payloads while debugging.
+const formatBinary byte = 0xe1
+
+const (
+	typeNil byte = iota
+	typeFalse
+	typeTrue
+	typeInt
+	typeUint
+	typeFloat
+	typeString
+	typeBytes
+	typeList
+	typeMap
+	typeTime
+)
+
+const maxDepth = 64
+
+var (
+	errDepth     = errors.New("elko.protocol: payload is nested too deeply")
+	errTruncated = errors.New("elko.protocol: payload is truncated")
+	errVarint    = errors.New("elko.protocol: invalid varint in payload")
+)
+
+var (
+	anySize  = reflect.TypeOf([]interface{}{}).Elem().Size()
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+var structCache sync.Map
+
+// DecodeError describes a value in a payload which couldn't be decoded into
+// its destination.
+type DecodeError struct {
+	Field string
+	Msg   string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Field == "" {
+		return "elko.protocol: " + e.Msg
+	}
+	return fmt.Sprintf("elko.protocol: %s: %s", e.Field, e.Msg)
+}
+
+// Encoder writes binary encoded values to an underlying writer.
+type Encoder struct {
+	buf  []byte
+	json bool
+	w    io.Writer
+}
+
+// Encode writes the encoding of v.
+func (e *Encoder) Encode(v interface{}) error {
+	if e.json {
+		return json.NewEncoder(e.w).Encode(v)
+	}
+	var err error
+	e.buf = append(e.buf[:0], formatBinary)
+	e.buf, err = appendValue(e.buf, reflect.ValueOf(v), 0)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+// SetJSON makes the encoder use the JSON fallback encoding, which is useful
+// for debugging.
+func (e *Encoder) SetJSON(enabled bool) {
+	e.json = enabled
+}
+
+type field struct {
+	def       *reflect.Value
+	index     []int
+	name      string
+	omitEmpty bool
+}
+
+type structInfo struct {
+	byName map[string]*field
+	fields []*field
+}
+
+// Decode decodes the payload into v, which needs to be a non-nil pointer.
+func Decode(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &DecodeError{Msg: fmt.Sprintf("cannot decode into non-pointer %T", v)}
+	}
+	if len(data) == 0 {
+		return errTruncated
+	}
+	if data[0] != formatBinary {
+		return json.Unmarshal(data, v)
+	}
+	d := &decoder{data: data[1:]}
+	err := d.decode(rv.Elem(), 0, "")
+	if err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return &DecodeError{Msg: fmt.Sprintf("%d trailing bytes after payload", len(d.data))}
+	}
+	return nil
+}
+
+// Encode writes the binary encoding of v to w.
+func Encode(w io.Writer, v interface{}) error {
+	return NewEncoder(w).Encode(v)
+}
+
+// Marshal returns the binary encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	buf, err := appendValue([]byte{formatBinary}, reflect.ValueOf(v), 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// NewEncoder returns an encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// ToJSON converts an encoded payload into indented JSON for inspection.
+func ToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := Decode(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(jsonSafe(v), "", "  ")
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendValue(buf []byte, v reflect.Value, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, errDepth
+	}
+	if !v.IsValid() {
+		return append(buf, typeNil), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, typeTrue), nil
+		}
+		return append(buf, typeFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := v.Int()
+		buf = append(buf, typeInt)
+		return appendUvarint(buf, uint64(i<<1)^uint64(i>>63)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf = append(buf, typeUint)
+		return appendUvarint(buf, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		buf = append(buf, typeFloat)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.Float()))
+		return append(buf, b[:]...), nil
+	case reflect.String:
+		s := v.String()
+		buf = append(buf, typeString)
+		buf = appendUvarint(buf, uint64(len(s)))
+		return append(buf, s...), nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return append(buf, typeNil), nil
+		}
+		return appendValue(buf, v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.IsNil() {
+				return append(buf, typeNil), nil
+			}
+			buf = append(buf, typeBytes)
+			buf = appendUvarint(buf, uint64(v.Len()))
+			return append(buf, v.Bytes()...), nil
+		}
+		if v.IsNil() {
+			return append(buf, typeNil), nil
+		}
+		return appendList(buf, v, depth)
+	case reflect.Array:
+		return appendList(buf, v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, typeNil), nil
+		}
+		return appendMap(buf, v, depth)
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			buf = append(buf, typeTime)
+			secs := t.Unix()
+			buf = appendUvarint(buf, uint64(secs<<1)^uint64(secs>>63))
+			return appendUvarint(buf, uint64(t.Nanosecond())), nil
+		}
+		return appendStruct(buf, v, depth)
+	}
+	return nil, fmt.Errorf("elko.protocol: unsupported type: %s", v.Type())
+}
+
+func appendList(buf []byte, v reflect.Value, depth int) ([]byte, error) {
+	var err error
+	n := v.Len()
+	buf = append(buf, typeList)
+	buf = appendUvarint(buf, uint64(n))
+	for i := 0; i < n; i++ {
+		buf, err = appendValue(buf, v.Index(i), depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendMap(buf []byte, v reflect.Value, depth int) ([]byte, error) {
+	type entry struct {
+		key   []byte
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := appendValue(nil, iter.Key(), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	var err error
+	buf = append(buf, typeMap)
+	buf = appendUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf = append(buf, e.key...)
+		buf, err = appendValue(buf, e.value, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendStruct(buf []byte, v reflect.Value, depth int) ([]byte, error) {
+	info, err := getStructInfo(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]*field, 0, len(info.fields))
+	for _, f := range info.fields {
+		if f.omitEmpty && isEmpty(v.FieldByIndex(f.index)) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	buf = append(buf, typeMap)
+	buf = appendUvarint(buf, uint64(len(fields)))
+	for _, f := range fields {
+		buf = append(buf, typeString)
+		buf = appendUvarint(buf, uint64(len(f.name)))
+		buf = append(buf, f.name...)
+		buf, err = appendValue(buf, v.FieldByIndex(f.index), depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func getStructInfo(t reflect.Type) (*structInfo, error) {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo), nil
+	}
+	info := &structInfo{
+		byName: map[string]*field{},
+	}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("protobuf")
+		if !ok {
+			tag = sf.Tag.Get("codec")
+		}
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := &field{
+			index: sf.Index,
+			name:  opts[0],
+		}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		for _, opt := range opts[1:] {
+			switch {
+			case opt == "omitempty":
+				f.omitEmpty = true
+			case strings.HasPrefix(opt, "default="):
+				def, err := parseDefault(sf.Type, opt[len("default="):])
+				if err != nil {
+					return nil, fmt.Errorf("elko.protocol: invalid default for %s.%s: %s", t, sf.Name, err)
+				}
+				f.def = &def
+			}
+		}
+		if _, exists := info.byName[f.name]; exists {
+			return nil, fmt.Errorf("elko.protocol: duplicate field name %q in %s", f.name, t)
+		}
+		info.byName[f.name] = f
+		info.fields = append(info.fields, f)
+	}
+	sort.Slice(info.fields, func(i, j int) bool {
+		return info.fields[i].name < info.fields[j].name
+	})
+	structCache.Store(t, info)
+	return info, nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).IsZero()
+		}
+	}
+	return false
+}
+
+// jsonSafe converts maps with non-string keys, as produced when decoding into
+// an interface{}, into ones that can be marshalled to JSON.
+func jsonSafe(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = jsonSafe(elem)
+		}
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for key, elem := range v {
+			out[fmt.Sprint(key)] = jsonSafe(elem)
+		}
+		return out
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = jsonSafe(elem)
+		}
+	}
+	return v
+}
+
+func parseDefault(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		v.SetString(s)
+	default:
+		return v, fmt.Errorf("defaults are not supported for %s values", t)
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) decode(v reflect.Value, depth int, path string) error {
+	if depth > maxDepth {
+		return errDepth
+	}
+	if len(d.data) == 0 {
+		return errTruncated
+	}
+	typ := d.data[0]
+	d.data = d.data[1:]
+	return d.decodeValue(typ, v, depth, path)
+}
+
+func (d *decoder) decodeValue(typ byte, v reflect.Value, depth int, path string) error {
+	if typ == typeNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(typ, v.Elem(), depth+1, path)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch(path, typ, v.Type())
+		}
+		elem, err := d.decodeAny(typ, depth)
+		if err != nil {
+			return err
+		}
+		if elem == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(elem))
+		}
+		return nil
+	}
+	switch typ {
+	case typeFalse, typeTrue:
+		if v.Kind() != reflect.Bool {
+			return mismatch(path, typ, v.Type())
+		}
+		v.SetBool(typ == typeTrue)
+	case typeInt, typeUint:
+		raw, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		return setInteger(v, typ, raw, path)
+	case typeFloat:
+		if len(d.data) < 8 {
+			return errTruncated
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+		d.data = d.data[8:]
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			if v.OverflowFloat(f) {
+				return overflow(path, v.Type())
+			}
+			v.SetFloat(f)
+		default:
+			return mismatch(path, typ, v.Type())
+		}
+	case typeString, typeBytes:
+		raw, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(raw))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte{}, raw...))
+		default:
+			return mismatch(path, typ, v.Type())
+		}
+	case typeList:
+		return d.decodeList(v, depth, path)
+	case typeMap:
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(v, depth, path)
+		case reflect.Struct:
+			if v.Type() != timeType {
+				return d.decodeStruct(v, depth, path)
+			}
+		}
+		return mismatch(path, typ, v.Type())
+	case typeTime:
+		t, err := d.time()
+		if err != nil {
+			return err
+		}
+		if v.Type() != timeType {
+			return mismatch(path, typ, v.Type())
+		}
+		v.Set(reflect.ValueOf(t))
+	default:
+		return &DecodeError{Field: path, Msg: fmt.Sprintf("unknown type byte: %d", typ)}
+	}
+	return nil
+}
+
+func (d *decoder) decodeAny(typ byte, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errDepth
+	}
+	switch typ {
+	case typeNil:
+		return nil, nil
+	case typeFalse:
+		return false, nil
+	case typeTrue:
+		return true, nil
+	case typeInt:
+		raw, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		return int64(raw>>1) ^ -int64(raw&1), nil
+	case typeUint:
+		return d.uvarint()
+	case typeFloat:
+		if len(d.data) < 8 {
+			return nil, errTruncated
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+		d.data = d.data[8:]
+		return f, nil
+	case typeString:
+		raw, err := d.bytes()
+		return string(raw), err
+	case typeBytes:
+		raw, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, raw...), nil
+	case typeList:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		out := make([]interface{}, 0, d.capacity(n, anySize))
+		for i := 0; i < n; i++ {
+			elem, err := d.next(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, elem)
+		}
+		return out, nil
+	case typeMap:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		// Keys and values are interleaved in a single slice.
+		items := make([]interface{}, 0, d.capacity(2*n, anySize))
+		stringKeys := true
+		for i := 0; i < n; i++ {
+			key, err := d.next(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := key.(string); !ok {
+				stringKeys = false
+			}
+			value, err := d.next(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, key, value)
+		}
+		if stringKeys {
+			out := make(map[string]interface{}, n)
+			for i := 0; i < len(items); i += 2 {
+				out[items[i].(string)] = items[i+1]
+			}
+			return out, nil
+		}
+		out := make(map[interface{}]interface{}, n)
+		for i := 0; i < len(items); i += 2 {
+			key := items[i]
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				return nil, &DecodeError{Msg: fmt.Sprintf("unhashable map key of type %T", key)}
+			}
+			out[key] = items[i+1]
+		}
+		return out, nil
+	case typeTime:
+		return d.time()
+	}
+	return nil, &DecodeError{Msg: fmt.Sprintf("unknown type byte: %d", typ)}
+}
+
+func (d *decoder) decodeList(v reflect.Value, depth int, path string) error {
+	n, err := d.length()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		t := v.Type().Elem()
+		out := reflect.MakeSlice(v.Type(), 0, d.capacity(n, t.Size()))
+		zero := reflect.Zero(t)
+		for i := 0; i < n; i++ {
+			out = reflect.Append(out, zero)
+			err = d.decode(out.Index(i), depth+1, path+"["+strconv.Itoa(i)+"]")
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(out)
+	case reflect.Array:
+		if n != v.Len() {
+			return &DecodeError{Field: path, Msg: fmt.Sprintf("cannot decode list of %d items into %s", n, v.Type())}
+		}
+		for i := 0; i < n; i++ {
+			err = d.decode(v.Index(i), depth+1, path+"["+strconv.Itoa(i)+"]")
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch(path, typeList, v.Type())
+	}
+	return nil
+}
+
+func (d *decoder) decodeMap(v reflect.Value, depth int, path string) error {
+	n, err := d.length()
+	if err != nil {
+		return err
+	}
+	t := v.Type()
+	out := reflect.MakeMapWithSize(t, d.capacity(n, t.Key().Size()+t.Elem().Size()))
+	for i := 0; i < n; i++ {
+		key := reflect.New(t.Key()).Elem()
+		err = d.decode(key, depth+1, path)
+		if err != nil {
+			return err
+		}
+		if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+			return &DecodeError{Field: path, Msg: fmt.Sprintf("unhashable map key of type %s", key.Elem().Type())}
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		err = d.decode(elem, depth+1, path)
+		if err != nil {
+			return err
+		}
+		out.SetMapIndex(key, elem)
+	}
+	v.Set(out)
+	return nil
+}
+
+func (d *decoder) decodeStruct(v reflect.Value, depth int, path string) error {
+	info, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+	n, err := d.length()
+	if err != nil {
+		return err
+	}
+	seen := make(map[*field]bool, len(info.fields))
+	for i := 0; i < n; i++ {
+		if len(d.data) == 0 {
+			return errTruncated
+		}
+		if d.data[0] != typeString {
+			return &DecodeError{Field: path, Msg: "struct field names need to be strings"}
+		}
+		d.data = d.data[1:]
+		name, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		f, ok := info.byName[string(name)]
+		if !ok {
+			err = d.skip(depth + 1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fpath := f.name
+		if path != "" {
+			fpath = path + "." + f.name
+		}
+		err = d.decode(v.FieldByIndex(f.index), depth+1, fpath)
+		if err != nil {
+			return err
+		}
+		seen[f] = true
+	}
+	for _, f := range info.fields {
+		if f.def != nil && !seen[f] {
+			v.FieldByIndex(f.index).Set(*f.def)
+		}
+	}
+	return nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	raw := d.data[:n]
+	d.data = d.data[n:]
+	return raw, nil
+}
+
+// capacity returns how many of n items of the given size to allocate upfront.
+// It is bounded by the size of the remaining data, so that a list or map which
+// claims far more items than it holds can't allocate more memory than the
+// payload takes up. Anything beyond that is grown as the items are decoded.
+func (d *decoder) capacity(n int, size uintptr) int {
+	if size == 0 {
+		return n
+	}
+	if max := len(d.data) / int(size); n > max {
+		return max
+	}
+	return n
+}
+
+// length reads a length prefix. As every item takes up at least one byte, any
+// length greater than the remaining data is invalid. This is only enough to
+// bound the allocation of strings and bytes, so lists and maps use capacity on
+// top of it.
+func (d *decoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+func (d *decoder) next(depth int) (interface{}, error) {
+	if len(d.data) == 0 {
+		return nil, errTruncated
+	}
+	typ := d.data[0]
+	d.data = d.data[1:]
+	return d.decodeAny(typ, depth)
+}
+
+// skip consumes the next value without decoding it into anything.
+func (d *decoder) skip(depth int) error {
+	_, err := d.next(depth)
+	return err
+}
+
+func (d *decoder) time() (time.Time, error) {
+	raw, err := d.uvarint()
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := d.uvarint()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if nanos >= 1e9 {
+		return time.Time{}, &DecodeError{Msg: "invalid nanoseconds in timestamp"}
+	}
+	return time.Unix(int64(raw>>1)^-int64(raw&1), int64(nanos)).UTC(), nil
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data)
+	if n == 0 {
+		return 0, errTruncated
+	}
+	if n < 0 {
+		return 0, errVarint
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+func mismatch(path string, typ byte, t reflect.Type) error {
+	names := []string{"nil", "bool", "bool", "int", "uint", "float", "string", "bytes", "list", "map", "time"}
+	if int(typ) >= len(names) {
+		return &DecodeError{Field: path, Msg: fmt.Sprintf("unknown type byte: %d", typ)}
+	}
+	return &DecodeError{Field: path, Msg: fmt.Sprintf("cannot decode %s into %s", names[typ], t)}
+}
+
+func overflow(path string, t reflect.Type) error {
+	return &DecodeError{Field: path, Msg: fmt.Sprintf("value overflows %s", t)}
+}
+
+func setInteger(v reflect.Value, typ byte, raw uint64, path string) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if typ == typeInt {
+			i = int64(raw>>1) ^ -int64(raw&1)
+		} else {
+			if raw > math.MaxInt64 {
+				return overflow(path, v.Type())
+			}
+			i = int64(raw)
+		}
+		if v.OverflowInt(i) {
+			return overflow(path, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := raw
+		if typ == typeInt {
+			i := int64(raw>>1) ^ -int64(raw&1)
+			if i < 0 {
+				return overflow(path, v.Type())
+			}
+			u = uint64(i)
+		}
+		if v.OverflowUint(u) {
+			return overflow(path, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if typ == typeInt {
+			v.SetFloat(float64(int64(raw>>1) ^ -int64(raw&1)))
+		} else {
+			v.SetFloat(float64(raw))
+		}
+	default:
+		return mismatch(path, typ, v.Type())
+	}
+	return nil
+}
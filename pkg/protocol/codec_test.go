@@ -0,0 +1,234 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type testInner struct {
+	Label string
+	Tags  []string
+}
+
+type testRecord struct {
+	Blob    []byte
+	Count   int32
+	Flag    bool
+	Inner   *testInner
+	Items   []testInner
+	Lookup  map[string]int
+	Name    string `protobuf:"name"`
+	Ratio   float64
+	Skipped string `codec:"-"`
+	Stamp   time.Time
+	Total   uint64
+	Values  [3]int8
+}
+
+type testRecordV1 struct {
+	Count int64
+	Name  string `codec:"name"`
+	Extra string
+}
+
+type testRecordV2 struct {
+	Count int64
+	Name  string `codec:"name"`
+	Port  int    `codec:"Port,default=8080"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := &testRecord{
+		Blob:  []byte{0, 1, 2, 255},
+		Count: -42,
+		Flag:  true,
+		Inner: &testInner{Label: "inner", Tags: []string{"a", "b"}},
+		Items: []testInner{{Label: "x"}, {Label: "y", Tags: []string{}}},
+		Lookup: map[string]int{
+			"one": 1,
+			"two": 2,
+		},
+		Name:    "elko",
+		Ratio:   math.Pi,
+		Skipped: "ignored",
+		Stamp:   time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC),
+		Total:   math.MaxUint64,
+		Values:  [3]int8{-128, 0, 127},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	out := &testRecord{}
+	if err := Decode(data, out); err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	in.Skipped = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch:\n got: %#v\nwant: %#v", out, in)
+	}
+	again, err := Marshal(out)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Fatalf("encoding isn't deterministic")
+	}
+}
+
+func TestRoundTripAny(t *testing.T) {
+	in := map[string]interface{}{
+		"bytes":  []byte("raw"),
+		"float":  1.5,
+		"int":    int64(-7),
+		"list":   []interface{}{nil, true, "s"},
+		"nested": map[string]interface{}{"uint": uint64(7)},
+		"time":   time.Unix(1500000000, 0).UTC(),
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	var out interface{}
+	if err := Decode(data, &out); err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch:\n got: %#v\nwant: %#v", out, in)
+	}
+}
+
+func TestSchemaEvolution(t *testing.T) {
+	data, err := Marshal(&testRecordV1{Count: 3, Extra: "unknown", Name: "svc"})
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	out := &testRecordV2{}
+	if err := Decode(data, out); err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	want := &testRecordV2{Count: 3, Name: "svc", Port: 8080}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("got %#v, want %#v", out, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var small struct{ Count int8 }
+	data, _ := Marshal(map[string]int{"Count": 300})
+	if err := Decode(data, &small); err == nil {
+		t.Errorf("expected overflow error")
+	}
+	data, _ = Marshal(map[string]string{"Count": "x"})
+	if err := Decode(data, &small); err == nil {
+		t.Errorf("expected type mismatch error")
+	}
+	data, _ = Marshal([]string{"a", "b"})
+	for i := 1; i < len(data); i++ {
+		var out []string
+		if err := Decode(data[:i], &out); err == nil {
+			t.Errorf("expected error decoding payload truncated to %d bytes", i)
+		}
+	}
+	var out []string
+	if err := Decode(append(data, 0), &out); err == nil {
+		t.Errorf("expected error for trailing bytes")
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	out := &testRecordV2{}
+	if err := Decode([]byte(`{"Count": 5, "name": "json"}`), out); err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	if out.Count != 5 || out.Name != "json" {
+		t.Fatalf("got %#v", out)
+	}
+}
+
+// invalidPayload returns a payload of the given size for a list or map which
+// claims as many items as there are bytes left, but whose first item is
+// invalid.
+func invalidPayload(typ byte, size int) []byte {
+	// The varint for the length takes up 3 bytes for the sizes used here.
+	data := appendUvarint([]byte{formatBinary, typ}, uint64(size-5))
+	data = append(data, 0xff)
+	return append(data, make([]byte, size-len(data))...)
+}
+
+// TestDecodeAllocation checks that lists and maps don't allocate memory in
+// proportion to the length they claim, as the size of their items in memory
+// can be far greater than their encoded size.
+func TestDecodeAllocation(t *testing.T) {
+	const size = 1 << 20
+	list := invalidPayload(typeList, size)
+	dict := invalidPayload(typeMap, size)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		dst  func() interface{}
+	}{
+		{"any list", list, func() interface{} { return new(interface{}) }},
+		{"any map", dict, func() interface{} { return new(interface{}) }},
+		{"int64 slice", list, func() interface{} { return new([]int64) }},
+		{"string slice", list, func() interface{} { return new([]string) }},
+		{"typed map", dict, func() interface{} { return new(map[string]string) }},
+	} {
+		dst := tc.dst()
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		if err := Decode(tc.data, dst); err == nil {
+			t.Errorf("%s: expected error decoding invalid payload", tc.name)
+		}
+		runtime.ReadMemStats(&after)
+		// Some leeway is needed for the overhead of map buckets.
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4*size {
+			t.Errorf("%s: allocated %d bytes for a %d byte payload", tc.name, alloc, size)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	seeds := []interface{}{
+		nil,
+		true,
+		int64(-1),
+		"text",
+		[]interface{}{uint64(1), 2.5, []byte{1}},
+		map[string]interface{}{"k": []interface{}{}},
+		map[int64]string{1: "a"},
+		&testRecord{Name: "seed", Items: []testInner{{Label: "x"}}},
+	}
+	for _, seed := range seeds {
+		data, err := Marshal(seed)
+		if err != nil {
+			f.Fatalf("Marshal failed: %s", err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(`{"name": "json"}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		record := &testRecord{}
+		Decode(data, record)
+		var v interface{}
+		if Decode(data, &v) != nil {
+			return
+		}
+		enc, err := Marshal(v)
+		if err != nil {
+			return
+		}
+		var again interface{}
+		if err := Decode(enc, &again); err != nil {
+			t.Fatalf("couldn't decode re-encoded payload: %s", err)
+		}
+	})
+}
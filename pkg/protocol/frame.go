@@ -0,0 +1,380 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/minio/highwayhash"
+
+	"github.com/tav/elko/pkg/compress"
+)
+
+// Services, nodes and the service manager all exchange frames of the form:
+//
+//	<opcode:1><length:4><message:length><hash:8>
+//
+// The length is a big-endian uint32 whose top two bits are flags:
+//
+//   - flagCompressed (bit 30) is set when the message has been compressed with
+//     the codec negotiated in the hello exchange.
+//   - flagChunked (bit 31) is set when the message follows as a sequence of
+//     <length:4><chunk> pairs terminated by a zero length. The remaining bits
+//     of the frame length are zero in that case.
+//
+// The hash is the little-endian 64-bit HighwayHash of all the preceding bytes
+// of the frame, keyed by the SHA-256 of the service ID for service connections,
+// and of the dialing node's ID for node connections.
+//
+// Opcodes and message types are defined in proto/protocol.proto. Clients send
+// the highest version they support in their hello, and the service manager
+// replies with the version that will be used for the rest of the connection.
+const (
+	MinVersion = 1
+	Version    = 1
+)
+
+const (
+	hashSize   = 8
+	headerSize = 5
+)
+
+var (
+	ErrHashMismatch = errors.New("elko.protocol: frame hash mismatch")
+	ErrNoKey        = errors.New("elko.protocol: frame received before the hash key was set")
+)
+
+// AppendFrame appends a frame for the already encoded message to buf. The
+// flags are set on the frame length as is, and should be the ones returned by
+// CompressFrame for msg.
+func AppendFrame(buf []byte, key []byte, opcode byte, msg []byte, flags uint32) []byte {
+	start := len(buf)
+	buf = append(buf, opcode, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[start+1:], uint32(len(msg))|flags)
+	buf = append(buf, msg...)
+	var sum [hashSize]byte
+	binary.LittleEndian.PutUint64(sum[:], highwayhash.Sum64(buf[start:], key))
+	return append(buf, sum[:]...)
+}
+
+// Key returns the hash key for frames on a connection identified by id.
+func Key(id string) []byte {
+	sum := sha256.Sum256([]byte(id))
+	return sum[:]
+}
+
+// NegotiateVersion returns the version to use with a peer that supports up to
+// the given version. Peers which predate versioning send a zero version, which
+// is treated as version 1.
+func NegotiateVersion(peer uint32) (uint32, error) {
+	if peer == 0 {
+		peer = 1
+	}
+	if peer < MinVersion {
+		return 0, fmt.Errorf("elko.protocol: unsupported protocol version %d", peer)
+	}
+	if peer > Version {
+		return Version, nil
+	}
+	return peer, nil
+}
+
+// FrameReader reads frames from an underlying reader, verifying their hashes
+// and decompressing their messages.
+//
+// If the hash key isn't known up front, e.g. because it depends on the
+// contents of the hello, a single unchunked frame can be read before calling
+// SetKey, which then verifies that frame.
+type FrameReader struct {
+	codec    compress.Codec
+	deadline func()
+	hash     hash.Hash64
+	lenBuf   []byte
+	limits   Limits
+	pending  []byte
+	r        *bufio.Reader
+}
+
+// Read reads the next frame. Chunked messages are accepted up to the max
+// frame size, unless streaming is set, in which case they may grow up to the
+// max body size and are spilled to disk beyond the spill threshold. The
+// caller needs to Close the returned body.
+func (f *FrameReader) Read(streaming bool) (byte, *Body, error) {
+	if f.pending != nil {
+		return 0, nil, ErrNoKey
+	}
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(f.r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0]
+	size := binary.BigEndian.Uint32(header[1:])
+	if size&flagChunked != 0 {
+		if f.hash == nil {
+			return 0, nil, ErrNoKey
+		}
+		if size != flagChunked {
+			return 0, nil, fmt.Errorf("elko.protocol: unexpected length in chunked frame: %#x", size)
+		}
+		f.hash.Reset()
+		f.hash.Write(header)
+		body, err := f.readChunks(streaming)
+		if err != nil {
+			return 0, nil, err
+		}
+		err = f.verify()
+		if err != nil {
+			body.Close()
+			return 0, nil, err
+		}
+		return opcode, body, nil
+	}
+	body := &Body{}
+	err = readFrame(f.r, &body.buf, size, f.limits.MaxFrameSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	if f.hash == nil {
+		f.pending = append(header, body.buf.Bytes()...)
+		_, err = io.ReadFull(f.r, f.lenBuf[:hashSize])
+		if err != nil {
+			return 0, nil, err
+		}
+		f.pending = append(f.pending, f.lenBuf[:hashSize]...)
+	} else {
+		f.hash.Reset()
+		f.hash.Write(header)
+		f.hash.Write(body.buf.Bytes())
+		err = f.verify()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if size&flagCompressed != 0 {
+		if f.codec == nil {
+			return 0, nil, errors.New("elko.protocol: received compressed frame before compression was negotiated")
+		}
+		out, err := f.codec.Decompress(body.buf.Bytes(), int(f.limits.MaxFrameSize))
+		if err != nil {
+			return 0, nil, err
+		}
+		body.buf.Reset()
+		body.buf.Write(out)
+	}
+	body.size = int64(body.buf.Len())
+	return opcode, body, nil
+}
+
+// SetCodec sets the codec used to decompress messages.
+func (f *FrameReader) SetCodec(codec compress.Codec) {
+	f.codec = codec
+}
+
+// SetDeadlineFunc sets a func to be called before each chunk of a chunked
+// message is read, so that callers can extend read deadlines while a large
+// message is being received, as with FrameWriter.WriteStream.
+func (f *FrameReader) SetDeadlineFunc(deadline func()) {
+	f.deadline = deadline
+}
+
+// SetKey sets the key used to verify frame hashes. If a frame was read before
+// the key was set, its hash is verified against the new key.
+func (f *FrameReader) SetKey(key []byte) error {
+	h, err := highwayhash.New64(key)
+	if err != nil {
+		return err
+	}
+	f.hash = h
+	if f.pending == nil {
+		return nil
+	}
+	idx := len(f.pending) - hashSize
+	h.Write(f.pending[:idx])
+	expected := binary.LittleEndian.Uint64(f.pending[idx:])
+	f.pending = nil
+	if h.Sum64() != expected {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+func (f *FrameReader) readChunks(streaming bool) (*Body, error) {
+	body := &Body{chunked: true}
+	max := f.limits.MaxBodySize
+	if !streaming {
+		max = int64(f.limits.MaxFrameSize)
+	}
+	dst := io.Writer(&body.buf)
+	for {
+		if f.deadline != nil {
+			f.deadline()
+		}
+		size, err := readLength(f.r, f.lenBuf)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		f.hash.Write(f.lenBuf[:4])
+		if size == 0 {
+			return body, nil
+		}
+		if size > chunkSize || body.size+int64(size) > max {
+			body.Close()
+			return nil, ErrBodyTooLarge
+		}
+		if streaming && body.file == nil && body.size+int64(size) > f.limits.SpillThreshold {
+			err = body.spill(f.limits.TempDir)
+			if err != nil {
+				body.Close()
+				return nil, err
+			}
+			dst = body.file
+		}
+		_, err = io.CopyN(io.MultiWriter(dst, f.hash), f.r, int64(size))
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		body.size += int64(size)
+	}
+}
+
+func (f *FrameReader) verify() error {
+	_, err := io.ReadFull(f.r, f.lenBuf[:hashSize])
+	if err != nil {
+		return err
+	}
+	if f.hash.Sum64() != binary.LittleEndian.Uint64(f.lenBuf[:hashSize]) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// FrameWriter writes frames to an underlying writer. Writes are buffered until
+// Flush is called.
+type FrameWriter struct {
+	codec     compress.Codec
+	hash      hash.Hash64
+	key       []byte
+	lenBuf    []byte
+	threshold int
+	w         *bufio.Writer
+}
+
+// Flush writes any buffered frames to the underlying writer.
+func (f *FrameWriter) Flush() error {
+	return f.w.Flush()
+}
+
+// SetCompression sets the codec negotiated during the hello exchange. Messages
+// of at least threshold bytes will be compressed from then on. Passing a nil
+// codec disables compression.
+func (f *FrameWriter) SetCompression(codec compress.Codec, threshold int) {
+	f.codec = codec
+	f.threshold = threshold
+}
+
+// SetKey sets the key used to hash frames.
+func (f *FrameWriter) SetKey(key []byte) error {
+	h, err := highwayhash.New64(key)
+	if err != nil {
+		return err
+	}
+	f.hash = h
+	f.key = key
+	return nil
+}
+
+// Write writes a frame for the given message.
+func (f *FrameWriter) Write(opcode byte, msg []byte) error {
+	if f.key == nil {
+		return errors.New("elko.protocol: frame written before the hash key was set")
+	}
+	frame, flags, err := CompressFrame(f.codec, f.threshold, msg)
+	if err != nil {
+		return err
+	}
+	_, err = f.w.Write(AppendFrame(nil, f.key, opcode, frame, flags))
+	return err
+}
+
+// WriteStream writes a chunked frame whose message is read from r until EOF.
+// The deadline func, if not nil, is called before each chunk is written so
+// that callers can extend write deadlines.
+func (f *FrameWriter) WriteStream(opcode byte, r io.Reader, deadline func()) error {
+	if f.hash == nil {
+		return errors.New("elko.protocol: frame written before the hash key was set")
+	}
+	f.hash.Reset()
+	w := io.MultiWriter(f.w, f.hash)
+	f.lenBuf[0] = opcode
+	binary.BigEndian.PutUint32(f.lenBuf[1:], flagChunked)
+	_, err := w.Write(f.lenBuf[:headerSize])
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, chunk)
+		if n > 0 {
+			if deadline != nil {
+				deadline()
+			}
+			binary.BigEndian.PutUint32(f.lenBuf, uint32(n))
+			_, err = w.Write(f.lenBuf[:4])
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(chunk[:n])
+			if err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	binary.BigEndian.PutUint32(f.lenBuf, 0)
+	_, err = w.Write(f.lenBuf[:4])
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(f.lenBuf, f.hash.Sum64())
+	_, err = f.w.Write(f.lenBuf[:hashSize])
+	return err
+}
+
+// NewFrameReader returns a reader for frames from r. Messages larger than the
+// limits are rejected.
+func NewFrameReader(r io.Reader, limits Limits) *FrameReader {
+	if limits.MaxFrameSize == 0 || limits.MaxFrameSize > lengthMask {
+		limits.MaxFrameSize = lengthMask
+	}
+	if limits.MaxBodySize == 0 {
+		limits.MaxBodySize = DefaultMaxBodySize
+	}
+	return &FrameReader{
+		lenBuf: make([]byte, hashSize),
+		limits: limits,
+		r:      bufio.NewReader(r),
+	}
+}
+
+// NewFrameWriter returns a writer for frames to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{
+		lenBuf: make([]byte, hashSize),
+		w:      bufio.NewWriter(w),
+	}
+}
@@ -4,7 +4,6 @@
 package protocol
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
@@ -13,15 +12,12 @@ import (
 	"io"
 	"net"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
-)
-
-func Decode(data []byte, v interface{}) error {
-}
 
-func Encode(w io.Writer, v interface{}) error {
-}
+	"github.com/tav/elko/pkg/compress"
+)
 
 // Data Structures
 type LogEntry struct {
@@ -36,6 +32,7 @@ type LogEntry struct {
 	ServiceID  string      `protobuf:"service_id,omitempty"   json:"service_id,omitempty"`
 	Stacktrace string      `protobuf:"stacktrace,omitempty"  json:"stacktrace,omitempty"`
 	Timestamp  time.Time   `protobuf:"timestamp"             json:"timestamp"`
+	TraceID    string      `protobuf:"trace_id,omitempty"    json:"trace_id,omitempty"`
 }
 
 func NewLogEntry(depth int) *LogEntry {
@@ -47,11 +44,18 @@ func NewLogEntry(depth int) *LogEntry {
 }
 
 type ServiceHello struct {
-	InstanceID uint64 `protobuf:"instanceID"`
+	InstanceID  uint64   `protobuf:"instanceID"`
+	Compression []string `protobuf:"compression"`
+}
+
+type ServerHello struct {
+	Compression          string `protobuf:"compression"`
+	CompressionThreshold int    `protobuf:"compressionThreshold"`
 }
 
 type Reload struct {
-	DeployID uint64 `protobuf:"deployID"`
+	DeployID  uint64 `protobuf:"deployID"`
+	ServiceID string `protobuf:"serviceID"`
 }
 
 type NodeHello struct {
@@ -90,14 +94,14 @@ type ResponseBody struct {
 	NodeID     string `protobuf:"nodeID"`
 	InstanceID uint64 `protobuf:"instanceID"`
 	ID         uint64 `protobuf:"id"`
-	Result     []byte `protobuf:result`
-	Error      *Error `protobuf:error`
+	Result     []byte `protobuf:"result"`
+	Error      *Error `protobuf:"error"`
 }
 
 type Error struct {
-	Type string        `protobuf:type`
-	Args []interface{} `protobuf:args`
-	Msg  string        `protobuf:message`
+	Type string        `protobuf:"type"`
+	Args []interface{} `protobuf:"args"`
+	Msg  string        `protobuf:"message"`
 }
 
 func (e Error) Error() string {
@@ -123,57 +127,218 @@ type Log struct {
 	Data    interface{} `protobuf:"data"`
 }
 
-var ErrConnectionClosed = errors.New("elko.protocol: connection closed")
+// WebRequest is the HTTP request passed by the gateway to the service method
+// that a route maps to. Header names are lower-cased, with repeated headers
+// joined by commas. Cookies are held separately from the headers, and only
+// the first value of each query arg is kept.
+type WebRequest struct {
+	Body      []byte              `codec:"body"`
+	Header    map[string]string   `codec:"header"`
+	Host      string              `codec:"host"`
+	Path      string              `codec:"path"`
+	Method    string              `codec:"method"`
+	PathArgs  []string            `codec:"pathArgs"`
+	QueryArgs map[string]string   `codec:"queryArgs"`
+	Cookies   map[string][]string `codec:"cookies"`
+	Scheme    string              `codec:"scheme"`
+}
+
+// WebResponse is the result of a service method handling a WebRequest. A zero
+// Status is treated as 200. Cookies holds the values of Set-Cookie headers.
+// If Stream is set, the body follows as a sequence of ServerStream messages.
+type WebResponse struct {
+	Status  int               `codec:"status"`
+	Header  map[string]string `codec:"header"`
+	Body    []byte            `codec:"body"`
+	Cookies []string          `codec:"cookies"`
+	Stream  bool              `codec:"stream"`
+}
+
+// Events delivered for WebSocket connections.
+const (
+	WebSocketClose   = "close"
+	WebSocketConnect = "connect"
+	WebSocketMessage = "message"
+)
+
+// WebSocketEvent is passed by the gateway to the service method that a
+// WebSocket route maps to. The connect event is sent before the connection is
+// upgraded, and the connection is refused if it fails. Each event carries the
+// request that opened the connection, so that any instance can handle it.
+type WebSocketEvent struct {
+	ConnID  string      `codec:"connID"`
+	Data    []byte      `codec:"data"`
+	Event   string      `codec:"event"`
+	Request *WebRequest `codec:"request"`
+	Text    bool        `codec:"text"`
+}
+
+// WebSocketSend is the arg for calls to the elko.websocket service, which
+// sends messages to and closes WebSocket connections on the gateway.
+type WebSocketSend struct {
+	ConnID string `codec:"connID"`
+	Data   []byte `codec:"data"`
+	Text   bool   `codec:"text"`
+}
+
+var (
+	ErrConnectionClosed = errors.New("elko.protocol: connection closed")
+	ErrFrameTooLarge    = errors.New("elko.protocol: frame exceeds the max frame size")
+	ErrBodyTooLarge     = errors.New("elko.protocol: chunked body exceeds the max body size")
+)
+
+// Frame lengths are 32-bit big-endian values, with the top bits reserved for
+// flags. See frame.go for the full framing.
+const (
+	flagChunked    uint32 = 1 << 31
+	flagCompressed uint32 = 1 << 30
+	lengthMask     uint32 = 1<<30 - 1
+)
+
+const chunkSize = 64 * 1024
+
+// Default limits used by connections that haven't been given explicit ones.
+const (
+	DefaultMaxBodySize    = 1 << 30
+	DefaultMaxFrameSize   = 16 << 20
+	DefaultSpillThreshold = 4 << 20
+)
+
+// Limits bounds the memory that a Conn will commit to reading frames from a
+// peer.
+type Limits struct {
+	// MaxBodySize is the maximum total size of a chunked message.
+	MaxBodySize int64
+	// MaxFrameSize is the maximum size of an unchunked message.
+	MaxFrameSize uint32
+	// SpillThreshold is the size beyond which a chunked message is written to
+	// a temporary file instead of being held in memory.
+	SpillThreshold int64
+	// TempDir is the directory for spilled bodies. It defaults to os.TempDir.
+	TempDir string
+}
+
+// DefaultLimits returns the limits used by connections created with New.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBodySize:    DefaultMaxBodySize,
+		MaxFrameSize:   DefaultMaxFrameSize,
+		SpillThreshold: DefaultSpillThreshold,
+	}
+}
 
 var payloadPool = &sync.Pool{}
 
 type Payload struct {
+	Msg    []byte
 	Opcode byte
-	Data   interface{}
-	Body   []byte
+	Stream io.Reader
 }
 
 type Conn struct {
-	closed bool
-	conn   net.Conn
-	in     chan *Payload
-	mu     sync.Mutex
-	queue  chan *Payload
+	closed    bool
+	codec     compress.Codec
+	conn      net.Conn
+	done      chan struct{}
+	err       error
+	in        chan *Payload
+	limits    Limits
+	mu        sync.Mutex
+	queue     chan *Payload
+	threshold int
+	writer    *FrameWriter
+}
+
+// Done returns a channel that is closed once the connection has been closed,
+// either explicitly or because reading or writing failed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
 }
 
-func (c *Conn) Write(opcode byte, data interface{}, body []byte) error {
+// Err returns the error which caused the connection to be closed. It returns
+// nil if the connection is still open or was closed explicitly.
+func (c *Conn) Err() error {
 	c.mu.Lock()
-	if c.closed {
-		c.mu.Unlock()
-		return ErrConnectionClosed
-	}
+	err := c.err
+	c.mu.Unlock()
+	return err
+}
+
+// SetCompression sets the codec negotiated during the hello exchange. Messages
+// of at least threshold bytes will be compressed from then on. Passing a nil
+// codec disables compression.
+func (c *Conn) SetCompression(codec compress.Codec, threshold int) {
+	c.mu.Lock()
+	c.codec = codec
+	c.threshold = threshold
 	c.mu.Unlock()
-	item := payloadPool.Get()
+}
+
+func (c *Conn) compression() (compress.Codec, int) {
 	c.mu.Lock()
-	if c.in == nil {
-		c.in = make(chan *Payload, 100)
-		c.queue = make(chan *Payload)
-	}
+	codec, threshold := c.codec, c.threshold
+	c.mu.Unlock()
+	return codec, threshold
+}
+
+// SetLimits overrides the default limits for the connection. It needs to be
+// called before the read loop is started.
+func (c *Conn) SetLimits(l Limits) {
+	c.mu.Lock()
+	c.limits = l
 	c.mu.Unlock()
-	if item == nil {
-		c.in <- &Payload{opcode, data, body}
+}
+
+// Write queues a frame for the given encoded message. Messages larger than the
+// max frame size of the peer need to be sent with WriteStream instead.
+func (c *Conn) Write(opcode byte, msg []byte) error {
+	return c.enqueue(opcode, msg, nil)
+}
+
+// WriteStream queues a frame whose message is streamed from r using chunked
+// transfer. The reader is consumed by the write loop, so it must not be used
+// by the caller after WriteStream returns.
+func (c *Conn) WriteStream(opcode byte, r io.Reader) error {
+	return c.enqueue(opcode, nil, r)
+}
+
+func (c *Conn) enqueue(opcode byte, msg []byte, stream io.Reader) error {
+	var p *Payload
+	if item := payloadPool.Get(); item == nil {
+		p = &Payload{msg, opcode, stream}
 	} else {
-		p := item.(*Payload)
+		p = item.(*Payload)
+		p.Msg = msg
 		p.Opcode = opcode
-		p.Data = data
-		p.Body = body
-		c.in <- p
+		p.Stream = stream
+	}
+	select {
+	case c.in <- p:
+		return nil
+	case <-c.done:
+		return ErrConnectionClosed
 	}
-	return nil
 }
 
 func (c *Conn) Close() {
 	c.mu.Lock()
-	//close(c.in)
-	//close(c.queue)
-	c.closed = true
-	c.conn.Close()
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+		close(c.done)
+	}
+	c.mu.Unlock()
+}
+
+// fail closes the connection, recording err as the cause unless the connection
+// had already been closed.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if !c.closed {
+		c.err = err
+	}
 	c.mu.Unlock()
+	c.Close()
 }
 
 func (c *Conn) Run(h Handler, timeout time.Duration) {
@@ -182,174 +347,117 @@ func (c *Conn) Run(h Handler, timeout time.Duration) {
 }
 
 func (c *Conn) StartReadLoop(h Handler, timeout time.Duration) {
-	var opcode byte
-	dataBuf := make([]byte, 4096)
-	var dataLen uint32
-	lenBuf := make([]byte, 4)
-	var err error
-	data := new(bytes.Buffer)
-	var n int
-	var readBytes uint32
+	c.mu.Lock()
+	limits := c.limits
+	c.mu.Unlock()
+	sh, streaming := h.(StreamHandler)
 	conn := c.conn
-	r := bufio.NewReader(conn)
-	body := &bytes.Buffer{}
+	r := NewFrameReader(conn, limits)
+	r.SetKey(c.writer.key)
+	if timeout != time.Duration(0) {
+		r.SetDeadlineFunc(func() {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		})
+	}
 	for {
 		if timeout != time.Duration(0) {
 			conn.SetReadDeadline(time.Now().Add(timeout))
 		}
-		opcode, err = r.ReadByte()
+		codec, _ := c.compression()
+		r.SetCodec(codec)
+		opcode, msg, err := r.Read(streaming)
 		if err != nil {
-			// reconnect?
-			fmt.Printf("error: %v", err)
-			conn.Close()
-			break
-			//c.cleanUp() -> tell the server to kill this connection -> runtime should try and reconnect
-			// log if not eof client closes connection
-		}
-		if opcode >= 64 {
-			readBytes = 0
-			for readBytes < 4 {
-				n, err = r.Read(lenBuf[readBytes:])
-				if err != nil {
-					fmt.Printf("error: %v", err)
-					break
-					//c.cleanUp()
-					// log if not eof client closes connection
-					return
-				}
-				readBytes += uint32(n)
-			}
-			dataLen = binary.BigEndian.Uint32(lenBuf)
-			for dataLen > 0 {
-				if dataLen < 4096 {
-					n, err = r.Read(dataBuf[:dataLen])
-				} else {
-					n, err = r.Read(dataBuf)
-				}
-				if err != nil {
-					fmt.Printf("error: %v", err)
-					break
-					//c.cleanUp()
-					// log if not eof client closes connection
-				}
-				data.Write(dataBuf[:n])
-				dataLen -= uint32(n)
-			}
+			// Callers watching Done are responsible for reconnecting.
+			c.fail(err)
+			return
 		}
-		if opcode >= 128 {
-			readBytes = 0
-			for readBytes < 4 {
-				n, err = r.Read(lenBuf[readBytes:])
-				if err != nil {
-					fmt.Printf("error: %v", err)
-					break
-					//c.cleanUp()
-					// log if not eof client closes connection
-				}
-				readBytes += uint32(n)
-			}
-			body = &bytes.Buffer{}
-			dataLen = binary.BigEndian.Uint32(lenBuf)
-			for dataLen > 0 {
-				if dataLen < 4096 {
-					n, err = r.Read(dataBuf[:dataLen])
-				} else {
-					n, err = r.Read(dataBuf)
-				}
-				if err != nil {
-					fmt.Printf("error: %v", err)
-					break
-					//c.cleanUp()
-					// log if not eof client closes connection
-				}
-				body.Write(dataBuf[:n])
-				dataLen -= uint32(n)
-			}
+		if streaming && msg.chunked {
+			err = sh.HandleStream(opcode, msg)
+		} else {
+			err = h.Handle(opcode, msg.Bytes())
+			msg.Close()
 		}
-		err = h.Handle(opcode, data.Bytes(), body.Bytes())
 		if err != nil {
-			// do something?
-			continue
-		}
-		if len(data.Bytes()) != 0 {
-			data.Reset()
-		}
-		if len(body.Bytes()) != 0 {
-			body.Reset()
+			// Messages which can't be handled, e.g. as they couldn't be
+			// decoded, fail the connection, so that the error is surfaced via
+			// Err and the peers start afresh.
+			c.fail(fmt.Errorf("elko.protocol: couldn't handle message with opcode %d: %s", opcode, err))
+			return
 		}
 	}
 }
 
+func readFrame(r io.Reader, buf *bytes.Buffer, size uint32, max uint32) error {
+	if size&^(lengthMask|flagCompressed) != 0 {
+		return fmt.Errorf("elko.protocol: unexpected flags in frame length: %#x", size&^lengthMask)
+	}
+	size &= lengthMask
+	if size > max {
+		return ErrFrameTooLarge
+	}
+	buf.Grow(int(size))
+	_, err := io.CopyN(buf, r, int64(size))
+	return err
+}
+
+// CompressFrame compresses src with the codec if it is at least threshold bytes
+// long. It returns the message to write along with the flags that need to be
+// passed to AppendFrame.
+func CompressFrame(codec compress.Codec, threshold int, src []byte) ([]byte, uint32, error) {
+	if codec == nil || len(src) < threshold {
+		return src, 0, nil
+	}
+	out, err := codec.Compress(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, flagCompressed, nil
+}
+
+func readLength(r io.Reader, buf []byte) (uint32, error) {
+	_, err := io.ReadFull(r, buf[:4])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
 // StartWriteLoop needs to be run before any Write calls are made.
 func (c *Conn) StartWriteLoop(timeout time.Duration) {
 	var p *Payload
-	c.mu.Lock()
-	if c.in == nil {
-		c.in = make(chan *Payload, 100)
-		c.queue = make(chan *Payload)
-	}
-	c.mu.Unlock()
 	go c.proxyQueue()
-	respLenBuf := make([]byte, 4)
-	respDataBuf := new(bytes.Buffer)
-	w := bufio.NewWriter(c.conn)
-	encoder := NewEncoder(respDataBuf)
+	w := c.writer
+	deadline := func() {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if timeout == time.Duration(0) {
+		deadline = nil
+	}
 	var err error
-	for p = range c.queue {
-		if timeout != time.Duration(0) {
-			c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	for {
+		select {
+		case p = <-c.queue:
+		case <-c.done:
+			return
 		}
-		err = w.WriteByte(uint8(p.Opcode))
-		if err != nil {
-			//log failed to write response + err
-			//kill connection
-			break
+		w.SetCompression(c.compression())
+		if deadline != nil {
+			deadline()
 		}
-		if p.Data != nil {
-			err = encoder.Encode(p.Data)
-			if err != nil {
-				//log failed to encode response data + err
-				break
-			}
-			binary.BigEndian.PutUint32(respLenBuf, uint32(respDataBuf.Len()))
-			_, err = w.Write(respLenBuf)
-			if err != nil {
-				//log failed to write response + err
-				//kill connection
-				break
-			}
-			_, err = w.Write(respDataBuf.Bytes())
-			if err != nil {
-				//log failed to write response + err
-				//kill connection
-				break
-			}
-			respDataBuf.Reset()
+		if p.Stream != nil {
+			err = w.WriteStream(p.Opcode, p.Stream, deadline)
+		} else {
+			err = w.Write(p.Opcode, p.Msg)
 		}
-		if p.Body != nil {
-			binary.BigEndian.PutUint32(respLenBuf, uint32(len(p.Body)))
-			_, err = w.Write(respLenBuf)
-			if err != nil {
-				//log failed to write response + err
-				//kill connection
-				break
-			}
-			_, err = w.Write(p.Body)
-			if err != nil {
-				//log failed to write response + err
-				//kill connection
-				break
-			}
-
+		if err == nil {
+			err = w.Flush()
 		}
-		err = w.Flush()
 		if err != nil {
-			break
-			//log failed to write response + err
-			//kill connection
+			c.fail(err)
+			return
 		}
-		// if err on write:
-		//    c.Close()
+		p.Msg = nil
+		p.Stream = nil
 		payloadPool.Put(p)
 	}
 }
@@ -361,32 +469,72 @@ func (c *Conn) proxyQueue() {
 	q := c.queue
 	for {
 		if len(buf) == 0 {
-			p = <-in
-			if p == nil {
-				break
+			select {
+			case p = <-in:
+				buf = append(buf, p)
+			case <-c.done:
+				return
 			}
-			buf = append(buf, p)
 		} else {
 			select {
 			case q <- buf[0]:
 				buf = buf[1:]
 			case p = <-in:
-				if p == nil {
-					break
-				}
 				buf = append(buf, p)
+			case <-c.done:
+				return
 			}
 		}
 	}
 }
 
-// Handler cannot store 'data' it receives as it will change when new requests come in.
+// Handler cannot store the 'msg' it receives as it will change when new
+// requests come in.
 type Handler interface {
-	Handle(opcode byte, data []byte, body []byte) error
+	Handle(opcode byte, msg []byte) error
 }
 
-func New(c net.Conn) *Conn {
+// StreamHandler is implemented by handlers that are able to consume chunked
+// messages, which may have been spilled to disk. Chunked messages are passed
+// to HandleStream, which takes ownership of the body and must Close it.
+type StreamHandler interface {
+	Handler
+	HandleStream(opcode byte, msg *Body) error
+}
+
+// New returns a connection for the service with the given ID, whose frames are
+// hashed with the key derived from the ID.
+func New(c net.Conn, serviceID string) *Conn {
+	w := NewFrameWriter(c)
+	w.SetKey(Key(serviceID))
 	return &Conn{
-		conn: c,
+		conn:   c,
+		done:   make(chan struct{}),
+		in:     make(chan *Payload, 100),
+		limits: DefaultLimits(),
+		queue:  make(chan *Payload),
+		writer: w,
+	}
+}
+
+// IsBuiltinServiceID returns whether the service ID is reserved for services
+// which are implemented by the service manager itself, and so can't be used by
+// other services.
+func IsBuiltinServiceID(id string) bool {
+	return id == "log.persist" || (strings.HasPrefix(id, "elko.") && id != "elko.cli")
+}
+
+// IsValidServiceID checks that the ID is made up of non-empty, dot-separated
+// segments of a-z and 0-9, so that it is also safe to use as a path segment.
+func IsValidServiceID(id string) bool {
+	if id == "" || id[0] == '.' || id[len(id)-1] == '.' || strings.Contains(id, "..") {
+		return false
+	}
+	for _, char := range id {
+		if (char >= 'a' && char <= 'z') || char == '.' || (char >= '0' && char <= '9') {
+			continue
+		}
+		return false
 	}
+	return true
 }
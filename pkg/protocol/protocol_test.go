@@ -0,0 +1,92 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testHandler struct {
+	handled chan byte
+}
+
+func (h *testHandler) Handle(opcode byte, msg []byte) error {
+	if string(msg) == "bad" {
+		return errors.New("couldn't decode message")
+	}
+	h.handled <- opcode
+	return nil
+}
+
+func TestReadLoopHandlerError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := New(server, "test")
+	h := &testHandler{handled: make(chan byte, 1)}
+	go c.StartReadLoop(h, 0)
+	w := NewFrameWriter(client)
+	w.SetKey(Key("test"))
+	write := func(opcode byte, msg string) {
+		err := w.Write(opcode, []byte(msg))
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(3, "good")
+	select {
+	case opcode := <-h.handled:
+		if opcode != 3 {
+			t.Errorf("got opcode %d, want 3", opcode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message to be handled")
+	}
+	write(4, "bad")
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't closed after the handler failed")
+	}
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), "opcode 4") {
+		t.Errorf("got error %v, want the failed opcode to be reported", err)
+	}
+}
+
+func TestServiceIDs(t *testing.T) {
+	for _, tt := range []struct {
+		id      string
+		valid   bool
+		builtin bool
+	}{
+		{"users", true, false},
+		{"billing.v2", true, false},
+		{"elko.cli", true, false},
+		{"elko.deploy", true, true},
+		{"elko.foo", true, true},
+		{"log.persist", true, true},
+		{"log.other", true, false},
+		{"elkofoo", true, false},
+		{"", false, false},
+		{"a..b", false, false},
+		{".x", false, false},
+		{"x.", false, false},
+		{"Users", false, false},
+		{"users/admin", false, false},
+		{"user-profiles", false, false},
+	} {
+		if valid := IsValidServiceID(tt.id); valid != tt.valid {
+			t.Errorf("IsValidServiceID(%q) = %v, want %v", tt.id, valid, tt.valid)
+		}
+		if builtin := IsBuiltinServiceID(tt.id); builtin != tt.builtin {
+			t.Errorf("IsBuiltinServiceID(%q) = %v, want %v", tt.id, builtin, tt.builtin)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kinds of values in a TypeSchema. These follow the data model of the codec
+// rather than the Go type system, so that schemas can be shared with other
+// runtimes.
+const (
+	KindAny    = "any"
+	KindBool   = "bool"
+	KindBytes  = "bytes"
+	KindFloat  = "float"
+	KindInt    = "int"
+	KindList   = "list"
+	KindMap    = "map"
+	KindString = "string"
+	KindStruct = "struct"
+	KindTime   = "time"
+	KindUint   = "uint"
+)
+
+// FieldSchema describes a field of a struct, by the name it is encoded with.
+type FieldSchema struct {
+	Name string      `protobuf:"name" json:"name"`
+	Type *TypeSchema `protobuf:"type" json:"type"`
+}
+
+// MethodSchema describes the args and result of a service method. Result is
+// nil for methods which only return an error. Web methods take a WebRequest
+// and respond with a WebResponse.
+type MethodSchema struct {
+	Args   []*TypeSchema `protobuf:"args"             json:"args"`
+	Name   string        `protobuf:"name"             json:"name"`
+	Result *TypeSchema   `protobuf:"result,omitempty" json:"result,omitempty"`
+	Web    bool          `protobuf:"web,omitempty"    json:"web,omitempty"`
+}
+
+// ServiceSchema describes the methods of a service, as published by its
+// instances in their hello.
+type ServiceSchema struct {
+	Methods   []*MethodSchema `protobuf:"methods"           json:"methods"`
+	ServiceID string          `protobuf:"service_id"        json:"service_id"`
+	Version   string          `protobuf:"version,omitempty" json:"version,omitempty"`
+}
+
+// Method returns the schema for the named method, matching names the same way
+// as the runtimes do, i.e. ignoring the case of the first letter.
+func (s *ServiceSchema) Method(name string) *MethodSchema {
+	key := methodKey(name)
+	for _, m := range s.Methods {
+		if methodKey(m.Name) == key {
+			return m
+		}
+	}
+	return nil
+}
+
+// TypeSchema describes a type. Elem is set for lists and maps, Key for maps,
+// and Fields for structs. Name is the name of the type in the runtime that
+// published it, if it has one. Structs which refer back to themselves are
+// described by name only after their first occurrence.
+type TypeSchema struct {
+	Elem   *TypeSchema    `protobuf:"elem,omitempty"   json:"elem,omitempty"`
+	Fields []*FieldSchema `protobuf:"fields,omitempty" json:"fields,omitempty"`
+	Key    *TypeSchema    `protobuf:"key,omitempty"    json:"key,omitempty"`
+	Kind   string         `protobuf:"kind"             json:"kind"`
+	Name   string         `protobuf:"name,omitempty"   json:"name,omitempty"`
+}
+
+// String returns a compact description of the type, e.g. "list<string>".
+func (t *TypeSchema) String() string {
+	if t == nil {
+		return KindAny
+	}
+	switch t.Kind {
+	case KindList:
+		return "list<" + t.Elem.String() + ">"
+	case KindMap:
+		return "map<" + t.Key.String() + ", " + t.Elem.String() + ">"
+	case KindStruct:
+		if t.Name != "" {
+			return t.Name
+		}
+	}
+	return t.Kind
+}
+
+// SchemaOf returns the schema for values of type t, as encoded by the codec.
+func SchemaOf(t reflect.Type) (*TypeSchema, error) {
+	return schemaOf(t, map[reflect.Type]bool{})
+}
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) (*TypeSchema, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &TypeSchema{Kind: KindBool}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &TypeSchema{Kind: KindInt}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &TypeSchema{Kind: KindUint}, nil
+	case reflect.Float32, reflect.Float64:
+		return &TypeSchema{Kind: KindFloat}, nil
+	case reflect.String:
+		return &TypeSchema{Kind: KindString}, nil
+	case reflect.Interface:
+		return &TypeSchema{Kind: KindAny}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return &TypeSchema{Kind: KindBytes}, nil
+		}
+		elem, err := schemaOf(t.Elem(), seen)
+		if err != nil {
+			return nil, err
+		}
+		return &TypeSchema{Elem: elem, Kind: KindList}, nil
+	case reflect.Map:
+		key, err := schemaOf(t.Key(), seen)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := schemaOf(t.Elem(), seen)
+		if err != nil {
+			return nil, err
+		}
+		return &TypeSchema{Elem: elem, Key: key, Kind: KindMap}, nil
+	case reflect.Struct:
+		if t == timeType {
+			return &TypeSchema{Kind: KindTime}, nil
+		}
+		schema := &TypeSchema{Kind: KindStruct}
+		if t.Name() != "" {
+			schema.Name = t.String()
+		}
+		if seen[t] {
+			return schema, nil
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		info, err := getStructInfo(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range info.fields {
+			ft, err := schemaOf(t.FieldByIndex(f.index).Type, seen)
+			if err != nil {
+				return nil, err
+			}
+			schema.Fields = append(schema.Fields, &FieldSchema{Name: f.name, Type: ft})
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("elko.protocol: unsupported type: %s", t)
+}
+
+func methodKey(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[size:]
+}
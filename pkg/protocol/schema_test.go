@@ -0,0 +1,45 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestServiceSchemaMethod(t *testing.T) {
+	s := &ServiceSchema{
+		Methods: []*MethodSchema{
+			{Name: "GetUser"},
+			{Name: "listUsers"},
+			{Name: "Éclair"},
+		},
+		ServiceID: "users",
+	}
+	for _, tt := range []struct {
+		name   string
+		method string
+		want   string
+	}{
+		{"exact", "GetUser", "GetUser"},
+		{"lower first letter", "getUser", "GetUser"},
+		{"upper first letter", "ListUsers", "listUsers"},
+		{"exact lower", "listUsers", "listUsers"},
+		{"multi-byte first letter", "éclair", "Éclair"},
+		{"different case elsewhere", "GetUSER", ""},
+		{"unknown", "DeleteUser", ""},
+		{"empty", "", ""},
+	} {
+		m := s.Method(tt.method)
+		got := ""
+		if m != nil {
+			got = m.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s: got method %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if m := (&ServiceSchema{}).Method("GetUser"); m != nil {
+		t.Errorf("got method %q from a schema without methods", m.Name)
+	}
+}
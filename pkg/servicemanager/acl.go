@@ -0,0 +1,92 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/tav/elko/pkg/config"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+type accessControl struct {
+	dryRun bool
+	rules  []config.ACLRule
+}
+
+func (a *accessControl) allows(caller string, principal *protocol.Principal, target string) bool {
+	subject := ""
+	if principal != nil {
+		subject = principal.Subject
+	}
+	for _, rule := range a.rules {
+		if !matchAny(rule.Callers, caller) || !matchAny(rule.Targets, target) {
+			continue
+		}
+		if len(rule.Principals) == 0 || (subject != "" && matchAny(rule.Principals, subject)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, v string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newAccessControl(acl *config.ACL) (*accessControl, error) {
+	if acl == nil || len(acl.Rules) == 0 {
+		return nil, nil
+	}
+	for i, rule := range acl.Rules {
+		if len(rule.Callers) == 0 || len(rule.Targets) == 0 {
+			return nil, fmt.Errorf("servicemanager: acl rule %d needs both callers and targets", i+1)
+		}
+		for _, list := range [][]string{rule.Callers, rule.Principals, rule.Targets} {
+			for _, pattern := range list {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("servicemanager: invalid pattern %q in acl rule %d", pattern, i+1)
+				}
+			}
+		}
+	}
+	return &accessControl{
+		dryRun: acl.DryRun,
+		rules:  acl.Rules,
+	}, nil
+}
+
+// authorize checks the request against the configured ACL and logs any
+// denials for auditing. In dry-run mode, violations are logged but allowed.
+//
+// Services can always persist their own logs, as the entries are attributed to
+// the calling instance.
+func (s *Server) authorize(from *service, req *protocol.ClientRequest, principal *protocol.Principal) bool {
+	if s.acl == nil || req.ServiceID == logService {
+		return true
+	}
+	target := req.ServiceID + "/" + req.ServiceMethod
+	if s.acl.allows(from.serviceID, principal, target) {
+		return true
+	}
+	subject := ""
+	if principal != nil {
+		subject = principal.Subject
+	}
+	if s.acl.dryRun {
+		log.Infof("audit: would deny %s (instance %d, principal %q) calling %s",
+			from.serviceID, from.id, subject, target)
+		return true
+	}
+	log.Infof("audit: denied %s (instance %d, principal %q) calling %s",
+		from.serviceID, from.id, subject, target)
+	return false
+}
@@ -0,0 +1,95 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"testing"
+
+	"github.com/tav/elko/pkg/config"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+var testACL = &config.ACL{
+	Rules: []config.ACLRule{
+		{Callers: []string{"web"}, Targets: []string{"billing/Get*"}},
+		{Callers: []string{"web"}, Principals: []string{"admin:*"}, Targets: []string{"billing/*"}},
+		{Callers: []string{"jobs.*"}, Targets: []string{"*/Sync"}},
+	},
+}
+
+func TestAccessControl(t *testing.T) {
+	acl, err := newAccessControl(testACL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		caller  string
+		subject string
+		target  string
+		allowed bool
+	}{
+		{"matching method", "web", "", "billing/GetInvoice", true},
+		{"unmatched method", "web", "", "billing/Refund", false},
+		{"matching principal", "web", "admin:alice", "billing/Refund", true},
+		{"unmatched principal", "web", "user:bob", "billing/Refund", false},
+		{"unmatched caller", "search", "admin:alice", "billing/GetInvoice", false},
+		{"caller pattern", "jobs.nightly", "", "billing/Sync", true},
+		{"caller pattern needs a suffix", "jobs", "", "billing/Sync", false},
+		{"pattern doesn't cross slashes", "web", "", "billing/Get/Invoice", false},
+		{"unlisted target", "web", "", "users/GetProfile", false},
+	} {
+		var principal *protocol.Principal
+		if tt.subject != "" {
+			principal = &protocol.Principal{Subject: tt.subject}
+		}
+		if allowed := acl.allows(tt.caller, principal, tt.target); allowed != tt.allowed {
+			t.Errorf("%s: got %v for %s calling %s, want %v", tt.name, allowed, tt.caller, tt.target, tt.allowed)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	dryRun := *testACL
+	dryRun.DryRun = true
+	for _, tt := range []struct {
+		name    string
+		acl     *config.ACL
+		service string
+		method  string
+		allowed bool
+	}{
+		{"allowed", testACL, "billing", "GetInvoice", true},
+		{"denied", testACL, "billing", "Refund", false},
+		{"denied in dry run", &dryRun, "billing", "Refund", true},
+		{"log service", testACL, logService, "Add", true},
+		{"no rules", &config.ACL{}, "billing", "Refund", true},
+	} {
+		acl, err := newAccessControl(tt.acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{acl: acl}
+		req := &protocol.ClientRequest{ServiceID: tt.service, ServiceMethod: tt.method}
+		if allowed := s.authorize(&service{serviceID: "web"}, req, nil); allowed != tt.allowed {
+			t.Errorf("%s: got %v, want %v", tt.name, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestNewAccessControlErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rule config.ACLRule
+	}{
+		{"missing callers", config.ACLRule{Targets: []string{"*"}}},
+		{"missing targets", config.ACLRule{Callers: []string{"*"}}},
+		{"invalid pattern", config.ACLRule{Callers: []string{"["}, Targets: []string{"*"}}},
+	} {
+		_, err := newAccessControl(&config.ACL{Rules: []config.ACLRule{tt.rule}})
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
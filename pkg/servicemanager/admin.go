@@ -0,0 +1,138 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tav/elko/pkg/logstore"
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/golly/log"
+)
+
+// instanceInfo describes a connected service instance in the admin API's
+// /services endpoint.
+type instanceInfo struct {
+	DeployID uint64   `json:"deploy_id,omitempty"`
+	ID       uint64   `json:"id"`
+	Methods  []string `json:"methods,omitempty"`
+	PID      int      `json:"pid,omitempty"`
+	Runtime  string   `json:"runtime,omitempty"`
+	Service  string   `json:"service"`
+	Version  string   `json:"version,omitempty"`
+}
+
+// parseLogQuery builds a log query from the parameters accepted by the admin
+// API's /logs endpoint.
+func parseLogQuery(params map[string][]string) (*logstore.Query, error) {
+	get := func(key string) string {
+		if v := params[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	q := &logstore.Query{
+		Context:   get("context"),
+		ErrorOnly: get("errors") == "1",
+		Service:   get("service"),
+		TraceID:   get("trace"),
+	}
+	if q.Service != "" && !rtproto.IsValidServiceID(q.Service) {
+		return nil, fmt.Errorf("invalid service ID: %q", q.Service)
+	}
+	if since := get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return nil, err
+		}
+		q.Since = t
+	}
+	return q, nil
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if s.logs == nil {
+		http.Error(w, "the log.persist service is not enabled", http.StatusNotFound)
+		return
+	}
+	q, err := parseLogQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	write := func(e *rtproto.LogEntry) bool {
+		if enc.Encode(e) != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	offsets, err := logstore.Scan(s.config.LogDir, q, write)
+	if (err == nil || os.IsNotExist(err)) && r.URL.Query().Get("follow") == "1" {
+		stop := make(chan struct{})
+		go func() {
+			<-r.Context().Done()
+			close(stop)
+		}()
+		err = logstore.Follow(s.config.LogDir, q, offsets, stop, write)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("servicemanager: couldn't query logs: %s", err)
+	}
+}
+
+// handleServices lists the service instances connected to this node, along
+// with the metadata they registered with.
+func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	infos := []instanceInfo{}
+	s.serviceMap.RLock()
+	for _, instances := range s.serviceMap.services {
+		for _, svc := range instances {
+			svc.RLock()
+			infos = append(infos, instanceInfo{
+				DeployID: svc.deployID,
+				ID:       svc.id,
+				Methods:  svc.methods,
+				PID:      svc.pid,
+				Runtime:  svc.runtime,
+				Service:  svc.serviceID,
+				Version:  svc.version,
+			})
+			svc.RUnlock()
+		}
+	}
+	s.serviceMap.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Service != infos[j].Service {
+			return infos[i].Service < infos[j].Service
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func (s *Server) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/purge", s.handleCachePurge)
+	mux.HandleFunc("/logs", s.handleLogs)
+	mux.HandleFunc("/schemas", s.handleSchemas)
+	mux.HandleFunc("/services", s.handleServices)
+	mux.HandleFunc("/status", s.handleStatus)
+	log.Infof("Admin API is listening on %s", s.config.AdminAddr)
+	err := http.ListenAndServe(s.config.AdminAddr, mux)
+	if err != nil {
+		log.Errorf("servicemanager: admin API failed: %s", err)
+	}
+}
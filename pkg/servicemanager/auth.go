@@ -0,0 +1,393 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/tav/elko/pkg/authtoken"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+// Leeway allowed for clock skew when validating token expiry times.
+const authLeeway = 30 * time.Second
+
+// The minimum size of the RSA keys accepted for verifying JWTs.
+const minRSAKeyBits = 2048
+
+var errMissingToken = errors.New("servicemanager: missing auth token")
+
+// The JWT algorithm for each of the supported curves.
+var ecdsaAlgorithms = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
+
+// Authenticator validates the authToken of incoming requests.
+type Authenticator interface {
+	// Accepts returns whether the token is in a format that the
+	// authenticator understands.
+	Accepts(token string) bool
+	Authenticate(token string) (*protocol.Principal, error)
+}
+
+type hmacAuthenticator struct {
+	key []byte
+}
+
+func (a *hmacAuthenticator) Accepts(token string) bool {
+	return authtoken.Is(token)
+}
+
+func (a *hmacAuthenticator) Authenticate(token string) (*protocol.Principal, error) {
+	claims, err := authtoken.Verify(a.key, token, time.Now().Add(-authLeeway))
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := ptypes.TimestampProto(time.Unix(claims.Expiry, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Principal{
+		Expiry:  expiry,
+		Subject: claims.Subject,
+	}, nil
+}
+
+type jwtAuthenticator struct {
+	audience string
+	issuers  map[string]bool
+	keys     map[string]crypto.PublicKey
+}
+
+type jwtClaims struct {
+	Audience  interface{} `json:"aud"`
+	Expiry    int64       `json:"exp"`
+	Issuer    string      `json:"iss"`
+	NotBefore int64       `json:"nbf"`
+	Subject   string      `json:"sub"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (a *jwtAuthenticator) Accepts(token string) bool {
+	return strings.Count(token, ".") == 2 && !authtoken.Is(token)
+}
+
+func (a *jwtAuthenticator) Authenticate(token string) (*protocol.Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("servicemanager: malformed JWT")
+	}
+	header := &jwtHeader{}
+	err := decodeJWTPart(parts[0], header)
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("servicemanager: malformed JWT signature")
+	}
+	err = verifyJWT(header.Algorithm, key, parts[0]+"."+parts[1], sig)
+	if err != nil {
+		return nil, err
+	}
+	claims := &jwtClaims{}
+	err = decodeJWTPart(parts[1], claims)
+	if err != nil {
+		return nil, err
+	}
+	if !a.issuers[claims.Issuer] {
+		return nil, fmt.Errorf("servicemanager: JWT from untrusted issuer: %q", claims.Issuer)
+	}
+	now := time.Now()
+	if claims.Expiry == 0 || now.Add(-authLeeway).Unix() >= claims.Expiry {
+		return nil, errors.New("servicemanager: JWT has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(authLeeway).Unix() < claims.NotBefore {
+		return nil, errors.New("servicemanager: JWT is not valid yet")
+	}
+	if a.audience != "" && !hasAudience(claims.Audience, a.audience) {
+		return nil, fmt.Errorf("servicemanager: JWT is not intended for audience %q", a.audience)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("servicemanager: JWT is missing a subject")
+	}
+	expiry, err := ptypes.TimestampProto(time.Unix(claims.Expiry, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Principal{
+		Expiry:  expiry,
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+	}, nil
+}
+
+func (a *jwtAuthenticator) key(id string) (crypto.PublicKey, error) {
+	if key, ok := a.keys[id]; ok {
+		return key, nil
+	}
+	if id == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("servicemanager: unknown JWT key id: %q", id)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("servicemanager: malformed JWT")
+	}
+	err = json.Unmarshal(raw, v)
+	if err != nil {
+		return errors.New("servicemanager: malformed JWT")
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, expected string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, elem := range v {
+			if s, ok := elem.(string); ok && s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifyJWT(alg string, key crypto.PublicKey, payload string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("servicemanager: unsupported JWT algorithm: %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(payload))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("servicemanager: JWT algorithm %s doesn't match the RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		// Each ECDSA algorithm is bound to a specific curve, as per RFC 7518
+		// §3.4.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg != ecdsaAlgorithms[k.Curve.Params().Name] || len(sig) != 2*size {
+			return fmt.Errorf("servicemanager: JWT algorithm %s doesn't match the EC key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("servicemanager: invalid JWT signature")
+		}
+		return nil
+	}
+	return errors.New("servicemanager: unsupported JWT key type")
+}
+
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := struct {
+		Keys []struct {
+			Crv string `json:"crv"`
+			E   string `json:"e"`
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			Use string `json:"use"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("servicemanager: couldn't decode JWKS file %s: %s", path, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return nil, err
+			}
+			if n.BitLen() < minRSAKeyBits {
+				return nil, fmt.Errorf("servicemanager: JWKS key %q is smaller than %d bits", k.Kid, minRSAKeyBits)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("servicemanager: unsupported JWKS curve: %q", k.Crv)
+			}
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		default:
+			return nil, fmt.Errorf("servicemanager: unsupported JWKS key type: %q", k.Kty)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("servicemanager: no signing keys found in JWKS file %s", path)
+	}
+	return keys, nil
+}
+
+func decodeBigInt(v string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("servicemanager: invalid JWKS key parameter: %s", err)
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// authenticate validates the given token against the configured
+// authenticators. A nil principal is returned for requests without a token if
+// authentication isn't required.
+func (s *Server) authenticate(token string) (*protocol.Principal, error) {
+	if token == "" {
+		if s.config.AuthRequired {
+			return nil, errMissingToken
+		}
+		return nil, nil
+	}
+	for _, a := range s.auth {
+		if a.Accepts(token) {
+			return a.Authenticate(token)
+		}
+	}
+	return nil, errors.New("servicemanager: unsupported auth token format")
+}
+
+// identify returns the principal for a request. Requests are authenticated at
+// the edge, i.e. when they come from the gateway or the CLI, or when they carry
+// a token of their own. Otherwise, the request was made by a service, which
+// acts on behalf of the principal of the request that it was handling. If that
+// request has already been responded to, the service acts as itself. Carried
+// principals stop being valid once the token they came from has expired.
+func (s *Server) identify(from *service, req *protocol.ClientRequest) (*protocol.Principal, error) {
+	if from.local != nil || from.serviceID == cliServiceID || req.AuthToken != "" {
+		return s.authenticate(req.AuthToken)
+	}
+	if req.ParentID == 0 {
+		return nil, nil
+	}
+	principal := from.principal(callKey{id: req.ParentID, instance: req.ParentInstanceID})
+	if principal == nil || principal.Expiry == nil {
+		return principal, nil
+	}
+	expiry, err := ptypes.Timestamp(principal.Expiry)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Add(-authLeeway).Before(expiry) {
+		return nil, errors.New("servicemanager: the auth token of the parent request has expired")
+	}
+	return principal, nil
+}
+
+func newAuthenticators(cfg *Config) ([]Authenticator, error) {
+	auth := []Authenticator{}
+	for _, mode := range strings.Split(cfg.Auth, ",") {
+		switch strings.TrimSpace(mode) {
+		case "":
+		case "hmac":
+			key := cfg.AuthKey
+			if key == "" {
+				key = cfg.ClusterKey
+			}
+			if key == "" {
+				return nil, errors.New("servicemanager: hmac auth needs --auth-key or --cluster-key to be set")
+			}
+			auth = append(auth, &hmacAuthenticator{key: []byte(key)})
+		case "jwt":
+			if cfg.JWKSFile == "" {
+				return nil, errors.New("servicemanager: jwt auth needs --jwks-file to be set")
+			}
+			if len(cfg.JWTIssuers) == 0 {
+				return nil, errors.New("servicemanager: jwt auth needs --jwt-issuers to be set")
+			}
+			keys, err := loadJWKS(cfg.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			issuers := map[string]bool{}
+			for _, iss := range cfg.JWTIssuers {
+				issuers[iss] = true
+			}
+			auth = append(auth, &jwtAuthenticator{
+				audience: cfg.JWTAudience,
+				issuers:  issuers,
+				keys:     keys,
+			})
+		default:
+			return nil, fmt.Errorf("servicemanager: unknown auth type: %q", mode)
+		}
+	}
+	if cfg.AuthRequired && len(auth) == 0 {
+		return nil, errors.New("servicemanager: --auth-required needs at least one --auth type")
+	}
+	return auth, nil
+}
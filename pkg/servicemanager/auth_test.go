@@ -0,0 +1,269 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/tav/elko/pkg/authtoken"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+// signJWT creates a JWT with the given header and claims, signed by key using
+// the hash for alg. ECDSA signatures are sized for the key's own curve.
+func signJWT(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := crypto.SHA256
+	switch alg[2:] {
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		if err == nil {
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	a := &hmacAuthenticator{key: []byte("cluster-key")}
+	now := time.Now()
+	for _, tt := range []struct {
+		name   string
+		key    string
+		expiry time.Time
+		ok     bool
+	}{
+		{"valid", "cluster-key", now.Add(time.Hour), true},
+		{"within leeway", "cluster-key", now.Add(-authLeeway / 2), true},
+		{"expired", "cluster-key", now.Add(-2 * authLeeway), false},
+		{"wrong key", "other-key", now.Add(time.Hour), false},
+	} {
+		token, err := authtoken.Sign([]byte(tt.key), "user:42", tt.expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.Accepts(token) {
+			t.Errorf("%s: token was not accepted by the HMAC authenticator", tt.name)
+			continue
+		}
+		principal, err := a.Authenticate(token)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v, want success to be %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && principal.Subject != "user:42" {
+			t.Errorf("%s: got subject %q, want %q", tt.name, principal.Subject, "user:42")
+		}
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &jwtAuthenticator{
+		audience: "elko",
+		issuers:  map[string]bool{"https://issuer.example": true},
+		keys: map[string]crypto.PublicKey{
+			"rsa":  &rsaKey.PublicKey,
+			"p256": &p256.PublicKey,
+			"p384": &p384.PublicKey,
+			"p521": &p521.PublicKey,
+		},
+	}
+	now := time.Now().Unix()
+	claims := func(override map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"aud": "elko",
+			"exp": now + 3600,
+			"iss": "https://issuer.example",
+			"sub": "user:42",
+		}
+		for k, v := range override {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	for _, tt := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), true},
+		{"RS512", signJWT(t, "RS512", "rsa", rsaKey, claims(nil)), true},
+		{"ES256 with P-256", signJWT(t, "ES256", "p256", p256, claims(nil)), true},
+		{"ES384 with P-384", signJWT(t, "ES384", "p384", p384, claims(nil)), true},
+		{"ES512 with P-521", signJWT(t, "ES512", "p521", p521, claims(nil)), true},
+		{"audience list", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "elko"}})), true},
+		{"ES256 with P-521", signJWT(t, "ES256", "p521", p521, claims(nil)), false},
+		{"ES512 with P-256", signJWT(t, "ES512", "p256", p256, claims(nil)), false},
+		{"ES256 with RSA key", signJWT(t, "ES256", "rsa", p256, claims(nil)), false},
+		{"RS256 with EC key", signJWT(t, "RS256", "p256", rsaKey, claims(nil)), false},
+		{"wrong signing key", signJWT(t, "RS256", "rsa", otherRSA, claims(nil)), false},
+		{"unknown key id", signJWT(t, "RS256", "missing", rsaKey, claims(nil)), false},
+		{"alg none", signJWT(t, "none", "rsa", rsaKey, claims(nil)), false},
+		{"HS256", signJWT(t, "HS256", "rsa", rsaKey, claims(nil)), false},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now - 3600})), false},
+		{"missing expiry", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})), false},
+		{"not valid yet", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": now + 3600})), false},
+		{"untrusted issuer", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"wrong audience", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})), false},
+		{"missing subject", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"sub": nil})), false},
+		{"malformed", "a.b.c", false},
+	} {
+		if !a.Accepts(tt.token) {
+			t.Errorf("%s: token was not accepted by the JWT authenticator", tt.name)
+			continue
+		}
+		principal, err := a.Authenticate(tt.token)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v, want success to be %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (principal.Subject != "user:42" || principal.Issuer != "https://issuer.example") {
+			t.Errorf("%s: got unexpected principal: %+v", tt.name, principal)
+		}
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elko-jwks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	encode := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+	for _, tt := range []struct {
+		name string
+		bits int
+		ok   bool
+	}{
+		{"2048-bit RSA key", 2048, true},
+		{"1024-bit RSA key", 1024, false},
+	} {
+		key, err := rsa.GenerateKey(rand.Reader, tt.bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"keys": []map[string]string{{
+				"e":   encode(big.NewInt(int64(key.E))),
+				"kid": "rsa",
+				"kty": "RSA",
+				"n":   encode(key.N),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1)+".json")
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := loadJWKS(path)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v, want success to be %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && keys["rsa"] == nil {
+			t.Errorf("%s: key was not loaded", tt.name)
+		}
+	}
+}
+
+func TestIdentifyCarriedPrincipal(t *testing.T) {
+	s := &Server{config: &Config{}}
+	for _, tt := range []struct {
+		name   string
+		expiry time.Duration
+		ok     bool
+	}{
+		{"valid", time.Hour, true},
+		{"within leeway", -authLeeway / 2, true},
+		{"expired", -2 * authLeeway, false},
+	} {
+		expiry, err := ptypes.TimestampProto(time.Now().Add(tt.expiry))
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := &service{serviceID: "billing"}
+		from.track(callKey{id: 1, instance: 7}, &call{
+			principal: &protocol.Principal{Expiry: expiry, Subject: "user:42"},
+		})
+		principal, err := s.identify(from, &protocol.ClientRequest{ParentID: 1, ParentInstanceID: 7})
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v, want success to be %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (principal == nil || principal.Subject != "user:42") {
+			t.Errorf("%s: got unexpected principal: %+v", tt.name, principal)
+		}
+	}
+}
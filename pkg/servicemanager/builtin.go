@@ -0,0 +1,93 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/elko/pkg/trace"
+	"github.com/tav/golly/log"
+)
+
+const logService = "log.persist"
+
+// builtin handles requests for the services which are implemented by the
+// service manager itself. It returns false if the request is for some other
+// service.
+func (s *Server) builtin(from *service, req *protocol.ClientRequest, principal *protocol.Principal, span *trace.Span) bool {
+	switch req.ServiceID {
+	case deployService:
+		if from.serviceID != cliServiceID {
+			s.reject(from, req, protocol.ErrorCode_PERMISSION_DENIED,
+				fmt.Sprintf("%s is not allowed to reload services", from.serviceID), span)
+			return true
+		}
+		// Any process can claim to be the CLI, so reloads need to come over the
+		// Unix socket, which only the user running the service manager can
+		// access, or be authenticated.
+		if !from.socket && principal == nil {
+			s.reject(from, req, protocol.ErrorCode_UNAUTHENTICATED,
+				"reloads need to be made over the Unix socket or be authenticated", span)
+			return true
+		}
+		err := s.reload(req)
+		if err != nil {
+			log.Error(err)
+			s.reject(from, req, protocol.ErrorCode_SERVICE_ERROR, err.Error(), span)
+			return true
+		}
+	case logService:
+		if s.logs == nil {
+			return false
+		}
+		err := s.persistLog(from, req)
+		if err != nil {
+			log.Errorf("servicemanager: couldn't persist log entry from %s: %s", from.serviceID, err)
+			s.reject(from, req, protocol.ErrorCode_SERVICE_ERROR, err.Error(), span)
+			return true
+		}
+	case websocketService:
+		go s.webSocketCall(from, req, span)
+		return true
+	default:
+		return false
+	}
+	span.Finish()
+	s.tracer.Record(span)
+	if !req.Async {
+		from.write(protocol.OP_SERVER_RESPONSE, &protocol.ServerResponse{
+			ID: req.ID,
+		})
+	}
+	return true
+}
+
+func (s *Server) persistLog(from *service, req *protocol.ClientRequest) error {
+	args := [][]byte{}
+	err := rtproto.Decode(req.ServiceParam, &args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("servicemanager: log.persist expects a single LogEntry argument")
+	}
+	entry := &rtproto.LogEntry{}
+	err = rtproto.Decode(args[0], entry)
+	if err != nil {
+		return err
+	}
+	// The identity of the logging service is taken from its connection
+	// rather than trusting what it claims.
+	entry.InstanceID = from.id
+	entry.ServiceID = from.serviceID
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	s.logs.Add(entry)
+	return nil
+}
@@ -0,0 +1,338 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Bodies which are spilled to disk are stored in files with this extension, so
+// that leftovers from previous runs can be safely cleared out. Each spilled
+// entry gets a file of its own, so that a body which is being read is never
+// rewritten in place when the entry is replaced.
+const cacheFileExt = ".elkocache"
+
+type cacheEntry struct {
+	body    []byte
+	etag    string
+	expires time.Time
+	file    string
+	header  map[string]string
+	key     string
+	length  int
+	onDisk  bool
+	path    string
+	size    int64
+	status  int
+	stored  time.Time
+}
+
+// responseCache is an LRU cache of gateway responses. Entries are held in
+// memory up to maxMem bytes, beyond which the least recently used are spilled
+// to disk up to maxDisk bytes if a directory has been configured.
+type responseCache struct {
+	dir      string
+	disk     *list.List
+	diskSize int64
+	entries  map[string]*list.Element
+	lastFile uint64
+	maxDisk  int64
+	maxMem   int64
+	mem      *list.List
+	memSize  int64
+	mu       sync.Mutex
+	vary     []string
+}
+
+// get returns the fresh entry for the key, if any, along with its body. Bodies
+// which have been spilled are read outside of the lock, and are treated as a
+// miss if the entry has since been removed or the file is incomplete.
+func (c *responseCache) get(key string) (*cacheEntry, []byte) {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		c.mu.Unlock()
+		return nil, nil
+	}
+	if !entry.onDisk {
+		c.mem.MoveToFront(elem)
+		c.mu.Unlock()
+		return entry, entry.body
+	}
+	c.disk.MoveToFront(elem)
+	c.mu.Unlock()
+	body, err := ioutil.ReadFile(entry.file)
+	if err != nil || len(body) != entry.length {
+		return nil, nil
+	}
+	return entry, body
+}
+
+// key returns the cache key for the request.
+func (c *responseCache) key(r *http.Request) string {
+	b := &strings.Builder{}
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(r.Host)
+	b.WriteByte('\n')
+	b.WriteString(r.URL.Path)
+	b.WriteByte('\n')
+	b.WriteString(r.URL.Query().Encode())
+	for _, name := range c.vary {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header[name], ", "))
+	}
+	return b.String()
+}
+
+// purge removes all entries for paths with the given prefix, and returns the
+// number of entries removed.
+func (c *responseCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, elem := range c.entries {
+		if strings.HasPrefix(elem.Value.(*cacheEntry).path, prefix) {
+			c.remove(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// put caches the response if it is cacheable, and returns the new entry.
+func (c *responseCache) put(key string, path string, resp *rtproto.WebResponse) *cacheEntry {
+	ttl := cacheTTL(resp)
+	if ttl <= 0 {
+		return nil
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		body:    resp.Body,
+		etag:    resp.Header["etag"],
+		expires: now.Add(ttl),
+		header:  resp.Header,
+		key:     key,
+		length:  len(resp.Body),
+		path:    path,
+		status:  resp.Status,
+		stored:  now,
+	}
+	if entry.status == 0 {
+		entry.status = http.StatusOK
+	}
+	if entry.etag == "" {
+		sum := sha256.Sum256(resp.Body)
+		entry.etag = `"` + hex.EncodeToString(sum[:12]) + `"`
+	}
+	entry.size = int64(len(key) + len(resp.Body))
+	for name, value := range resp.Header {
+		entry.size += int64(len(name) + len(value))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	if entry.size > c.maxMem {
+		if !c.spill(entry) {
+			return entry
+		}
+	} else {
+		c.entries[key] = c.mem.PushFront(entry)
+		c.memSize += entry.size
+	}
+	for c.memSize > c.maxMem {
+		elem := c.mem.Back()
+		evicted := elem.Value.(*cacheEntry)
+		c.mem.Remove(elem)
+		c.memSize -= evicted.size
+		delete(c.entries, evicted.key)
+		c.spill(evicted)
+	}
+	for c.diskSize > c.maxDisk {
+		c.remove(c.disk.Back())
+	}
+	return entry
+}
+
+// remove needs to be called with the lock held.
+func (c *responseCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	delete(c.entries, entry.key)
+	if entry.onDisk {
+		c.disk.Remove(elem)
+		c.diskSize -= entry.size
+		os.Remove(entry.file)
+		return
+	}
+	c.mem.Remove(elem)
+	c.memSize -= entry.size
+}
+
+// spill moves the entry to disk, if a directory has been configured and it
+// fits. It needs to be called with the lock held.
+func (c *responseCache) spill(entry *cacheEntry) bool {
+	if c.dir == "" || entry.size > c.maxDisk || time.Now().After(entry.expires) {
+		return false
+	}
+	c.lastFile++
+	file := filepath.Join(c.dir, strconv.FormatUint(c.lastFile, 10)+cacheFileExt)
+	err := ioutil.WriteFile(file, entry.body, 0600)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't write cached response to disk: %s", err)
+		os.Remove(file)
+		return false
+	}
+	entry.body = nil
+	entry.file = file
+	entry.onDisk = true
+	c.entries[entry.key] = c.disk.PushFront(entry)
+	c.diskSize += entry.size
+	return true
+}
+
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if s.cache == nil {
+		http.Error(w, "the gateway cache is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !strings.HasPrefix(prefix, "/") {
+		http.Error(w, "the prefix parameter needs to be a path starting with /", http.StatusBadRequest)
+		return
+	}
+	n := s.cache.purge(prefix)
+	log.Infof("Purged %d cached responses under %s", n, prefix)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"purged":` + strconv.Itoa(n) + "}\n"))
+}
+
+// writeCached writes a cached response, replying with a 304 if the client
+// already has the current version.
+func (s *Server) writeCached(w http.ResponseWriter, r *http.Request, entry *cacheEntry, body []byte, hit bool) {
+	header := w.Header()
+	for name, value := range entry.header {
+		header.Set(name, value)
+	}
+	header.Set("Etag", entry.etag)
+	if hit {
+		header.Set("Age", strconv.FormatInt(int64(time.Since(entry.stored)/time.Second), 10))
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), entry.etag) {
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// cacheTTL returns how long the response can be cached for by a shared cache.
+// Only complete 200 responses which are explicitly marked as public and don't
+// set cookies are cached.
+func cacheTTL(resp *rtproto.WebResponse) time.Duration {
+	if (resp.Status != 0 && resp.Status != http.StatusOK) || resp.Stream || len(resp.Cookies) > 0 {
+		return 0
+	}
+	public := false
+	maxAge := -1
+	for _, directive := range strings.Split(resp.Header["cache-control"], ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "public":
+			public = true
+		case directive == "private" || directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "s-maxage="):
+			if n, err := strconv.Atoi(directive[len("s-maxage="):]); err == nil {
+				// The shared max age overrides max-age.
+				maxAge = n
+				public = true
+			}
+		case strings.HasPrefix(directive, "max-age="):
+			if n, err := strconv.Atoi(directive[len("max-age="):]); err == nil && maxAge == -1 {
+				maxAge = n
+			}
+		}
+	}
+	if !public || maxAge <= 0 {
+		return 0
+	}
+	return time.Duration(maxAge) * time.Second
+}
+
+func etagMatch(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func newResponseCache(dir string, maxMem int64, maxDisk int64, vary []string) (*responseCache, error) {
+	c := &responseCache{
+		dir:     dir,
+		disk:    list.New(),
+		entries: map[string]*list.Element{},
+		maxDisk: maxDisk,
+		maxMem:  maxMem,
+		mem:     list.New(),
+	}
+	for _, name := range vary {
+		c.vary = append(c.vary, http.CanonicalHeaderKey(name))
+	}
+	if dir == "" {
+		return c, nil
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	// The index of spilled entries only lives in memory, so files left over
+	// from a previous run are removed.
+	files, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return c, nil
+}
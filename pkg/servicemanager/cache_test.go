@@ -0,0 +1,185 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+)
+
+func TestCacheTTL(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		resp *rtproto.WebResponse
+		ttl  time.Duration
+	}{
+		{"public max-age", &rtproto.WebResponse{Header: map[string]string{"cache-control": "public, max-age=60"}}, time.Minute},
+		{"s-maxage", &rtproto.WebResponse{Header: map[string]string{"cache-control": "max-age=10, s-maxage=30"}}, 30 * time.Second},
+		{"s-maxage first", &rtproto.WebResponse{Header: map[string]string{"cache-control": "s-maxage=30, max-age=10"}}, 30 * time.Second},
+		{"mixed case", &rtproto.WebResponse{Header: map[string]string{"cache-control": "Public, Max-Age=60"}}, time.Minute},
+		{"explicit 200", &rtproto.WebResponse{Status: 200, Header: map[string]string{"cache-control": "public, max-age=60"}}, time.Minute},
+		{"max-age without public", &rtproto.WebResponse{Header: map[string]string{"cache-control": "max-age=60"}}, 0},
+		{"private", &rtproto.WebResponse{Header: map[string]string{"cache-control": "public, private, max-age=60"}}, 0},
+		{"no-store", &rtproto.WebResponse{Header: map[string]string{"cache-control": "public, max-age=60, no-store"}}, 0},
+		{"zero max-age", &rtproto.WebResponse{Header: map[string]string{"cache-control": "public, max-age=0"}}, 0},
+		{"invalid max-age", &rtproto.WebResponse{Header: map[string]string{"cache-control": "public, max-age=soon"}}, 0},
+		{"no header", &rtproto.WebResponse{}, 0},
+		{"error status", &rtproto.WebResponse{Status: 404, Header: map[string]string{"cache-control": "public, max-age=60"}}, 0},
+		{"cookies", &rtproto.WebResponse{Cookies: []string{"session=1"}, Header: map[string]string{"cache-control": "public, max-age=60"}}, 0},
+		{"stream", &rtproto.WebResponse{Stream: true, Header: map[string]string{"cache-control": "public, max-age=60"}}, 0},
+	} {
+		if ttl := cacheTTL(tt.resp); ttl != tt.ttl {
+			t.Errorf("%s: got TTL %s, want %s", tt.name, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		etag   string
+		match  bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`"xyz", "abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"xyz"`, `"abc"`, false},
+		{`abc`, `"abc"`, false},
+		{``, `"abc"`, false},
+	} {
+		if match := etagMatch(tt.header, tt.etag); match != tt.match {
+			t.Errorf("etagMatch(%q, %q) = %v, want %v", tt.header, tt.etag, match, tt.match)
+		}
+	}
+}
+
+func TestResponseCacheSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elko-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := map[string]string{"cache-control": "public, max-age=60"}
+	body := func(key string) []byte {
+		return bytes.Repeat([]byte(key), 100)
+	}
+	put := func(c *responseCache, key string) *cacheEntry {
+		entry := c.put(key, "/"+key, &rtproto.WebResponse{Body: body(key), Header: header})
+		if entry == nil {
+			t.Fatalf("response for %s wasn't cached", key)
+		}
+		return entry
+	}
+	// Each entry is the same size, so that two fit in memory and one on disk.
+	size := int64(1 + 100 + len("cache-control") + len(header["cache-control"]))
+	c, err := newResponseCache(dir, 2*size+size/2, size+size/2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := put(c, "a"); entry.size != size {
+		t.Fatalf("got entry size %d, want %d", entry.size, size)
+	}
+	put(c, "b")
+	// Reading a makes b the least recently used entry, so that it is the one
+	// spilled to disk.
+	if _, data := c.get("a"); !bytes.Equal(data, body("a")) {
+		t.Fatalf("got unexpected body for a: %q", data)
+	}
+	put(c, "c")
+	entry, data := c.get("b")
+	if entry == nil || !entry.onDisk {
+		t.Fatalf("expected b to have been spilled to disk")
+	}
+	if !bytes.Equal(data, body("b")) {
+		t.Fatalf("got unexpected body for b from disk: %q", data)
+	}
+	// Spilling a pushes b off the end of the disk cache.
+	put(c, "d")
+	if entry, _ := c.get("b"); entry != nil {
+		t.Errorf("expected b to have been evicted")
+	}
+	if _, err := os.Stat(entry.file); !os.IsNotExist(err) {
+		t.Errorf("expected the file for b to have been removed: %v", err)
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, data := c.get(key); !bytes.Equal(data, body(key)) {
+			t.Errorf("got unexpected body for %s: %q", key, data)
+		}
+	}
+	if c.memSize != 2*size || c.diskSize != size {
+		t.Errorf("got memory size %d and disk size %d, want %d and %d", c.memSize, c.diskSize, 2*size, size)
+	}
+	if n := c.purge("/"); n != 3 || len(c.entries) != 0 {
+		t.Errorf("purged %d entries, leaving %d, want 3 and 0", n, len(c.entries))
+	}
+}
+
+func TestResponseCacheConcurrentSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elko-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Nothing fits in memory, so every response is written straight to disk,
+	// replacing the previous entry for the key.
+	c, err := newResponseCache(dir, 1, 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := map[string]string{"cache-control": "public, max-age=60"}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				body := bytes.Repeat([]byte(fmt.Sprintf("%d.%d;", i, j)), 1000)
+				c.put("key", "/key", &rtproto.WebResponse{Body: body, Header: header})
+			}
+		}(i)
+	}
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				entry, data := c.get("key")
+				if entry == nil {
+					continue
+				}
+				// Without an etag from the service, the etag is derived from
+				// the body, so a torn or stale read would not match it.
+				sum := sha256.Sum256(data)
+				if etag := `"` + hex.EncodeToString(sum[:12]) + `"`; etag != entry.etag {
+					errs <- fmt.Errorf("got a body of %d bytes which doesn't match etag %s", len(data), entry.etag)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files in the cache directory, want 1", len(files))
+	}
+}
@@ -0,0 +1,120 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"time"
+
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+// call is a request which has been dispatched to an instance. It is tracked
+// until the instance responds, so that responses and streams from the instance
+// can be checked against the requests that it was actually sent.
+type call struct {
+	async     bool
+	expires   time.Time
+	principal *protocol.Principal
+}
+
+// complete records that the instance has responded to the call with the given
+// key, and shuts it down if it is draining and has no other calls left to
+// respond to. It returns false if the instance isn't handling such a call.
+func (s *service) complete(key callKey) bool {
+	s.Lock()
+	c, ok := s.calls[key]
+	if !ok || c.async {
+		s.Unlock()
+		return false
+	}
+	delete(s.calls, key)
+	if s.inflight > 0 {
+		s.inflight--
+	}
+	idle := s.draining && s.inflight == 0
+	s.Unlock()
+	if idle {
+		s.shutdown()
+	}
+	return true
+}
+
+// extend pushes back the expiry of the call with the given key, e.g. as the
+// instance streams its response. It returns false if the instance isn't
+// handling such a call.
+func (s *service) extend(key callKey, expires time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.calls[key]
+	if !ok || c.async {
+		return false
+	}
+	c.expires = expires
+	return true
+}
+
+// principal returns the principal of the call with the given key, or nil if
+// the instance isn't handling such a call.
+func (s *service) principal(key callKey) *protocol.Principal {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.calls[key]; ok {
+		return c.principal
+	}
+	return nil
+}
+
+// track records a call dispatched to the instance.
+func (s *service) track(key callKey, c *call) {
+	s.Lock()
+	if s.calls == nil {
+		s.calls = map[callKey]*call{}
+	}
+	s.calls[key] = c
+	if !c.async {
+		s.inflight++
+	}
+	s.Unlock()
+}
+
+// expireCalls forgets the calls which instances have gone without responding
+// to for too long, as well as async calls, which are never responded to.
+func (s *Server) expireCalls() {
+	for {
+		time.Sleep(s.config.CallTimeout)
+		now := time.Now()
+		s.serviceMap.RLock()
+		instances := make([]*service, 0, len(s.serviceMap.instances))
+		for _, svc := range s.serviceMap.instances {
+			instances = append(instances, svc)
+		}
+		s.serviceMap.RUnlock()
+		for _, svc := range instances {
+			var expired []callKey
+			svc.Lock()
+			for key, c := range svc.calls {
+				if now.After(c.expires) {
+					if c.async {
+						delete(svc.calls, key)
+					} else {
+						expired = append(expired, key)
+					}
+				}
+			}
+			svc.Unlock()
+			for _, key := range expired {
+				svc.complete(key)
+			}
+		}
+	}
+}
+
+// expiry returns when a call for the request should be forgotten if the target
+// hasn't responded to it by then.
+func (s *Server) expiry(deadline time.Time) time.Time {
+	if deadline.IsZero() {
+		return time.Now().Add(2 * s.config.CallTimeout)
+	}
+	return deadline.Add(s.config.CallTimeout)
+}
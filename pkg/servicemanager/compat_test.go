@@ -0,0 +1,91 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+// readSession reads a recorded connection from a hex file, in which lines
+// starting with # are comments.
+func readSession(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		data, err := hex.DecodeString(line)
+		if err != nil {
+			t.Fatalf("invalid line in %s: %s", path, err)
+		}
+		buf.Write(data)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestNodeRuntimeSession replays the frames written by the Node.js runtime, as
+// recorded by runtime/nodejs/bin/record-session, and checks that the service
+// manager accepts them.
+func TestNodeRuntimeSession(t *testing.T) {
+	s, err := New(&Config{CallTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handle(conn, false)
+	session := readSession(t, "testdata/nodejs-session.hex")
+	go client.Write(session)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := rtproto.NewFrameReader(client, rtproto.DefaultLimits())
+	r.SetKey(rtproto.Key("replay"))
+	read := func(expected protocol.OP, msg proto.Message) {
+		op, body, err := r.Read(false)
+		if err != nil {
+			t.Fatalf("couldn't read %s: %s", expected, err)
+		}
+		defer body.Close()
+		if opcode := protocol.OP(op); opcode != expected {
+			t.Fatalf("got %s when expecting %s", opcode, expected)
+		}
+		if err := proto.Unmarshal(body.Bytes(), msg); err != nil {
+			t.Fatalf("couldn't decode %s: %s", expected, err)
+		}
+	}
+	hello := &protocol.ServerHello{}
+	read(protocol.OP_SERVER_HELLO, hello)
+	if hello.ProtocolVersion != rtproto.Version {
+		t.Errorf("got protocol version %d, want %d", hello.ProtocolVersion, rtproto.Version)
+	}
+	if hello.InstanceID == 0 {
+		t.Errorf("no instance ID was assigned")
+	}
+	resp := &protocol.ServerResponse{}
+	read(protocol.OP_SERVER_RESPONSE, resp)
+	if resp.ID != 1 || resp.ErrorCode != protocol.ErrorCode_SERVICE_NOT_FOUND {
+		t.Errorf("got response %d with %s, want 1 with SERVICE_NOT_FOUND", resp.ID, resp.ErrorCode)
+	}
+}
@@ -4,38 +4,207 @@
 package servicemanager
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"time"
+
+	"github.com/tav/elko/pkg/config"
+	"github.com/tav/elko/pkg/consul"
+	"github.com/tav/elko/pkg/lease"
+	"github.com/tav/golly/log"
 )
 
 type Config struct {
-	CallTimeout      time.Duration
-	ClusterEndpoints string
-	ClusterID        string
-	ClusterKey       string
-	ClusterType      string
-	Heartbeat        time.Duration
-	HostMetadata     string
-	LeaseDuration    time.Duration
-	Port             int
-	ProductionMode   bool
-	ShutdownTimeout  time.Duration
+	ACL                  *config.ACL
+	AdminAddr            string
+	Auth                 string
+	AuthKey              string
+	AuthRequired         bool
+	CallTimeout          time.Duration
+	ClusterEndpoints     string
+	ClusterID            string
+	ClusterKey           string
+	ClusterType          string
+	Compression          []string
+	CompressionThreshold int
+	Gateway              *config.Gateway
+	GatewayAddr          string
+	GatewayCacheDir      string
+	GatewayCacheDiskSize int64
+	GatewayCacheSize     int64
+	GatewayMaxBodySize   int64
+	GatewayTLSCert       string
+	GatewayTLSKey        string
+	Heartbeat            time.Duration
+	HostMetadata         string
+	JWKSFile             string
+	JWTAudience          string
+	JWTIssuers           []string
+	LeaseDuration        time.Duration
+	LogDir               string
+	LogForward           string
+	LogLevel             string
+	LogMaxFileSize       int64
+	LogMaxFiles          int
+	LogSamplePercent     int
+	MaxBodySize          int64
+	MaxFrameSize         int
+	NodeAddr             string
+	Port                 int
+	ProductionMode       bool
+	ShutdownTimeout      time.Duration
+	SocketPath           string
+	SocketVerifyPID      bool
+	SpillThreshold       int64
+	TLSCA                string
+	TLSCert              string
+	TLSKey               string
+	TLSReloadInterval    time.Duration
+	TraceExport          string
 }
 
 type ConsulCluster struct {
+	ID      string
 	Key     string
 	Servers []string
 }
 
-func (c *ConsulCluster) Maintain() {
+// Maintain holds the lease for the node for as long as it is up, and tries to
+// acquire it again if it is lost. It doesn't return.
+func (c *ConsulCluster) Maintain(nodeID string, period time.Duration) {
+	entry := lease.New("node/"+nodeID, nil, period)
+	for {
+		expiry, err := entry.Acquire()
+		if err == nil {
+			err = entry.Maintain(expiry)
+		}
+		log.Errorf("servicemanager: couldn't hold the lease for node %s: %s", nodeID, err)
+		time.Sleep(period)
+	}
+}
+
+// Nodes returns the status of the nodes in the cluster, as last published by
+// them, along with the state of their leases.
+func (c *ConsulCluster) Nodes() ([]*NodeStatus, error) {
+	list, err := consul.GetMulti("nodes/")
+	if err != nil {
+		if err == consul.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	leases := map[string]string{}
+	held, err := consul.GetMulti("lease/node/")
+	if err != nil && err != consul.NotFound {
+		return nil, err
+	}
+	if held != nil {
+		for _, item := range held.Items {
+			leases[path.Base(item.Key)] = leaseState(item.Value)
+		}
+	}
+	nodes := []*NodeStatus{}
+	for _, item := range list.Items {
+		node := &NodeStatus{}
+		err = json.Unmarshal(item.Value, node)
+		if err != nil {
+			log.Errorf("servicemanager: couldn't decode the status of node %s: %s", path.Base(item.Key), err)
+			continue
+		}
+		node.Lease = leases[node.ID]
+		if node.Lease == "" {
+			node.Lease = "expired"
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// PublishSchema stores the encoded schema for the service under the cluster's
+// key prefix, so that other nodes pick it up.
+func (c *ConsulCluster) PublishSchema(serviceID string, data []byte) error {
+	ok, err := consul.Put("schemas/"+serviceID, data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("servicemanager: consul didn't store the schema for %s", serviceID)
+	}
+	return nil
+}
+
+// PublishStatus stores the status of the node, so that it can be seen from the
+// other nodes.
+func (c *ConsulCluster) PublishStatus(status *NodeStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	ok, err := consul.Put("nodes/"+status.ID, data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("servicemanager: consul didn't store the status of node %s", status.ID)
+	}
+	return nil
+}
+
+// WatchSchemas calls update with every schema published by the nodes in the
+// cluster, and then again whenever they change. It doesn't return.
+func (c *ConsulCluster) WatchSchemas(update func(serviceID string, data []byte)) {
+	index := uint64(0)
+	for {
+		list, err := consul.WaitMulti("schemas/", 5*time.Minute, index)
+		if err != nil {
+			if err != consul.NotFound {
+				log.Errorf("servicemanager: couldn't watch schemas in consul: %s", err)
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if list.Index == index {
+			continue
+		}
+		index = list.Index
+		for _, item := range list.Items {
+			update(path.Base(item.Key), item.Value)
+		}
+	}
+}
+
+func (c *ConsulCluster) connect() {
+	consul.SetEndpoint(c.Servers...)
+	consul.SetRootPrefix("elko/" + c.ID + "/")
 }
 
 type SoloCluster struct {
 }
 
-func (c *SoloCluster) Maintain() {
+// Maintain returns immediately, as solo nodes don't hold a lease.
+func (c *SoloCluster) Maintain(nodeID string, period time.Duration) {
+}
+
+// Nodes returns nothing, as there are no other nodes.
+func (c *SoloCluster) Nodes() ([]*NodeStatus, error) {
+	return nil, nil
+}
+
+// PublishSchema is a no-op, as there are no other nodes to replicate to.
+func (c *SoloCluster) PublishSchema(serviceID string, data []byte) error {
+	return nil
+}
+
+// PublishStatus is a no-op, as there are no other nodes to publish to.
+func (c *SoloCluster) PublishStatus(status *NodeStatus) error {
+	return nil
+}
+
+// WatchSchemas returns immediately, as there are no other nodes to watch.
+func (c *SoloCluster) WatchSchemas(update func(serviceID string, data []byte)) {
 }
 
 func getAzureInstanceID() (string, error) {
@@ -63,3 +232,19 @@ func getAzureInstanceID() (string, error) {
 	}
 	return string(id), nil
 }
+
+// leaseState describes the value of a lease key, as set by the lease package.
+func leaseState(value []byte) string {
+	if len(value) == 0 {
+		return "unknown"
+	}
+	switch value[0] {
+	case 'A':
+		return "active"
+	case 'C':
+		return "contested"
+	case 'I':
+		return "invalidated"
+	}
+	return "unknown"
+}
@@ -0,0 +1,120 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+const deployService = "elko.deploy"
+
+// shutdown tells the instance to exit. It is only sent once.
+func (s *service) shutdown() {
+	s.Lock()
+	stopping := s.stopping
+	s.stopping = true
+	s.Unlock()
+	if stopping || s.isClosed() {
+		return
+	}
+	s.write(protocol.OP_SERVER_SHUTDOWN, &protocol.ServerShutdown{})
+}
+
+// supersede removes the instances of the service which belong to a deploy
+// older than the current one, so that requests are no longer routed to them,
+// and returns them. Nothing is removed until an instance from the current
+// deploy has connected, so that the service stays available.
+func (m *serviceMap) supersede(serviceID string) []*service {
+	m.Lock()
+	defer m.Unlock()
+	current := m.deploys[serviceID]
+	if current == 0 {
+		return nil
+	}
+	var (
+		kept []*service
+		old  []*service
+		up   bool
+	)
+	for _, svc := range m.services[serviceID] {
+		svc.RLock()
+		deployID := svc.deployID
+		svc.RUnlock()
+		if deployID < current {
+			old = append(old, svc)
+			continue
+		}
+		if !svc.isClosed() {
+			up = true
+		}
+		kept = append(kept, svc)
+	}
+	if !up || len(old) == 0 {
+		return nil
+	}
+	m.services[serviceID] = kept
+	return old
+}
+
+// drain stops routing requests to the instance, and shuts it down once it has
+// responded to the requests it was already handling, or once the shutdown
+// timeout has passed.
+func (s *Server) drain(svc *service) {
+	svc.Lock()
+	svc.draining = true
+	deployID, idle := svc.deployID, svc.inflight == 0
+	svc.Unlock()
+	log.Infof("Draining %s instance %d from deploy %d", svc.serviceID, svc.id, deployID)
+	if idle {
+		svc.shutdown()
+		return
+	}
+	if s.config.ShutdownTimeout > 0 {
+		time.AfterFunc(s.config.ShutdownTimeout, svc.shutdown)
+	}
+}
+
+// drainSuperseded drains the instances of the service from older deploys, once
+// an instance from the current deploy is up.
+func (s *Server) drainSuperseded(serviceID string) {
+	for _, svc := range s.serviceMap.supersede(serviceID) {
+		s.drain(svc)
+	}
+}
+
+// reload handles a Reload sent to the elko.deploy service, which makes the
+// given deploy of a service the current one. Deploy IDs only move forward, so
+// a stale Reload has no effect.
+func (s *Server) reload(req *protocol.ClientRequest) error {
+	args := [][]byte{}
+	err := rtproto.Decode(req.ServiceParam, &args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("servicemanager: elko.deploy expects a single Reload argument")
+	}
+	msg := &rtproto.Reload{}
+	err = rtproto.Decode(args[0], msg)
+	if err != nil {
+		return err
+	}
+	if !rtproto.IsValidServiceID(msg.ServiceID) || msg.DeployID == 0 {
+		return fmt.Errorf("servicemanager: invalid Reload for %q with deploy %d", msg.ServiceID, msg.DeployID)
+	}
+	s.serviceMap.Lock()
+	if msg.DeployID > s.serviceMap.deploys[msg.ServiceID] {
+		s.serviceMap.deploys[msg.ServiceID] = msg.DeployID
+	}
+	s.serviceMap.Unlock()
+	log.Infof("Reloading %s with deploy %d", msg.ServiceID, msg.DeployID)
+	s.drainSuperseded(msg.ServiceID)
+	return nil
+}
@@ -0,0 +1,560 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/tav/elko/pkg/config"
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Requests from the gateway are made as the gatewayServiceID caller, which can
+// be used to allow them in ACL rules. Responses are routed back to the gateway
+// via gatewayInstanceID, which is never allocated to a service instance.
+const (
+	gatewayInstanceID = 0
+	gatewayServiceID  = "elko.gateway"
+)
+
+// The most data from a streamed response which is buffered for a slow HTTP
+// client. The stream is cancelled if the client falls further behind.
+const gatewayStreamBuffer = 4 << 20
+
+// Headers which aren't passed on to services. The auth token is verified by
+// the service manager, and cookies are passed separately.
+var gatewayStripHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+}
+
+type gateway struct {
+	conns    map[string]*wsConn
+	lastConn uint64
+	lastID   uint64
+	mu       sync.Mutex
+	pending  map[uint64]*gatewayCall
+	routes   []*gatewayRoute
+	svc      *service
+	timeout  time.Duration
+	upgrader *websocket.Upgrader
+}
+
+// gatewayCall receives the response to a request from the gateway, followed by
+// the chunks of its body if the response is streamed. The chunks are buffered
+// until the HTTP client is ready for them, so that the read loop of the
+// streaming service is never held up.
+type gatewayCall struct {
+	buffered int
+	chunks   []*protocol.ServerStream
+	mu       sync.Mutex
+	overflow bool
+	ready    chan struct{}
+	resp     chan *protocol.ServerResponse
+}
+
+// push buffers a chunk of the streamed response. It returns false if the HTTP
+// client has fallen too far behind, in which case the stream is abandoned.
+func (c *gatewayCall) push(chunk *protocol.ServerStream) bool {
+	c.mu.Lock()
+	if c.overflow || (len(c.chunks) > 0 && c.buffered+len(chunk.Data) > gatewayStreamBuffer) {
+		c.overflow = true
+		c.mu.Unlock()
+		c.signal()
+		return false
+	}
+	c.buffered += len(chunk.Data)
+	c.chunks = append(c.chunks, chunk)
+	c.mu.Unlock()
+	c.signal()
+	return true
+}
+
+// pop returns the chunks buffered since the last call, and whether the stream
+// has been abandoned.
+func (c *gatewayCall) pop() ([]*protocol.ServerStream, bool) {
+	c.mu.Lock()
+	chunks := c.chunks
+	c.buffered = 0
+	c.chunks = nil
+	overflow := c.overflow
+	c.mu.Unlock()
+	return chunks, overflow
+}
+
+func (c *gatewayCall) signal() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+type gatewayRoute struct {
+	host      string
+	method    string
+	methods   map[string]bool
+	rest      bool
+	segments  []string
+	serviceID string
+	websocket bool
+}
+
+// deliver hands a message routed to the gateway over to the pending request.
+// It returns false if the request is no longer pending, or if its HTTP client
+// can't keep up with a streamed response. It never blocks.
+func (g *gateway) deliver(opcode protocol.OP, msg proto.Message) bool {
+	switch msg := msg.(type) {
+	case *protocol.ServerResponse:
+		call := g.get(msg.ID)
+		if call == nil {
+			return false
+		}
+		select {
+		case call.resp <- msg:
+			return true
+		default:
+			return false
+		}
+	case *protocol.ServerStream:
+		call := g.get(msg.ID)
+		if call == nil {
+			return false
+		}
+		return call.push(msg)
+	}
+	log.Errorf("servicemanager: gateway received unexpected %s", opcode)
+	return false
+}
+
+func (g *gateway) get(id uint64) *gatewayCall {
+	g.mu.Lock()
+	call := g.pending[id]
+	g.mu.Unlock()
+	return call
+}
+
+// match returns the first route matching the request, along with the path
+// args captured by it.
+func (g *gateway) match(r *http.Request) (*gatewayRoute, []string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for _, route := range g.routes {
+		if args, ok := route.match(r.Method, host, segments); ok {
+			return route, args
+		}
+	}
+	return nil, nil
+}
+
+func (g *gateway) register() (uint64, *gatewayCall) {
+	call := &gatewayCall{
+		ready: make(chan struct{}, 1),
+		resp:  make(chan *protocol.ServerResponse, 1),
+	}
+	g.mu.Lock()
+	g.lastID++
+	id := g.lastID
+	g.pending[id] = call
+	g.mu.Unlock()
+	return id, call
+}
+
+func (g *gateway) remove(id uint64) {
+	g.mu.Lock()
+	delete(g.pending, id)
+	g.mu.Unlock()
+}
+
+func (r *gatewayRoute) match(method string, host string, segments []string) ([]string, bool) {
+	if len(r.methods) > 0 && !r.methods[method] {
+		return nil, false
+	}
+	if r.host != "" {
+		if ok, _ := path.Match(r.host, host); !ok {
+			return nil, false
+		}
+	}
+	last := len(r.segments) - 1
+	if len(segments) < len(r.segments) || (!r.rest && len(segments) != len(r.segments)) {
+		return nil, false
+	}
+	var args []string
+	for i, pattern := range r.segments {
+		if r.rest && i == last {
+			rest, err := url.PathUnescape(strings.Join(segments[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			return append(args, rest), true
+		}
+		seg, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return nil, false
+		}
+		if isPathCapture(pattern) {
+			if seg == "" {
+				return nil, false
+			}
+			args = append(args, seg)
+		} else if seg != pattern {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// awaitGateway routes a request from the gateway and waits for the response.
+// Requests which time out get a TIMEOUT error response, and a nil response is
+// returned if ctx is done first.
+func (s *Server) awaitGateway(ctx context.Context, req *protocol.ClientRequest, deadline time.Time, call *gatewayCall) *protocol.ServerResponse {
+	s.route(s.gateway.svc, req, nil)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case resp := <-call.resp:
+		return resp
+	case <-timer.C:
+		return &protocol.ServerResponse{
+			ErrorCode:    protocol.ErrorCode_TIMEOUT,
+			ErrorMessage: fmt.Sprintf("%s/%s didn't respond in time", req.ServiceID, req.ServiceMethod),
+			ID:           req.ID,
+		}
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (s *Server) handleGateway(w http.ResponseWriter, r *http.Request) {
+	route, args := s.gateway.match(r)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if route.websocket {
+		s.serveWebSocket(w, r, route, args)
+		return
+	}
+	// Cached responses are served without calling the service, unless the
+	// client has asked for a fresh response.
+	cacheKey := ""
+	if s.cache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		cacheKey = s.cache.key(r)
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			if entry, body := s.cache.get(cacheKey); entry != nil {
+				s.writeCached(w, r, entry, body, true)
+				return
+			}
+		}
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.config.GatewayMaxBodySize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	req, deadline, err := s.newGatewayRequest(r, route, newWebRequest(r, args, body))
+	if err != nil {
+		log.Errorf("servicemanager: couldn't encode web request for %s: %s", r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	id, call := s.gateway.register()
+	defer s.gateway.remove(id)
+	req.ID = id
+	resp := s.awaitGateway(r.Context(), req, deadline, call)
+	if resp == nil {
+		return
+	}
+	if s.writeWebResponse(w, r, resp, cacheKey) {
+		s.streamWebResponse(w, r, call)
+	}
+}
+
+// newGatewayRequest builds the request for a call to the target of the route,
+// with arg as its only arg. The auth token and traceparent are taken from the
+// HTTP request.
+func (s *Server) newGatewayRequest(r *http.Request, route *gatewayRoute, arg interface{}) (*protocol.ClientRequest, time.Time, error) {
+	data, err := rtproto.Marshal(arg)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	param, err := rtproto.Marshal([][]byte{data})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	deadline := time.Now().Add(s.config.CallTimeout)
+	ts, err := ptypes.TimestampProto(deadline)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	token := r.Header.Get("Authorization")
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = token[7:]
+	} else {
+		token = ""
+	}
+	return &protocol.ClientRequest{
+		AuthToken:     token,
+		Deadline:      ts,
+		ServiceID:     route.serviceID,
+		ServiceMethod: route.method,
+		ServiceParam:  param,
+		TraceID:       r.Header.Get("Traceparent"),
+	}, deadline, nil
+}
+
+func (s *Server) serveGateway() {
+	srv := &http.Server{
+		Addr:              s.config.GatewayAddr,
+		ReadHeaderTimeout: s.config.CallTimeout,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleGateway)
+	var err error
+	log.Infof("HTTP gateway is listening on %s", s.config.GatewayAddr)
+	if s.config.GatewayTLSCert != "" {
+		// HTTP/2 is negotiated via ALPN over TLS.
+		srv.Handler = mux
+		err = srv.ListenAndServeTLS(s.config.GatewayTLSCert, s.config.GatewayTLSKey)
+	} else {
+		// Without TLS, HTTP/2 is supported with prior knowledge, e.g. from
+		// load balancers which have already terminated TLS.
+		srv.Handler = h2c.NewHandler(mux, &http2.Server{})
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Errorf("servicemanager: HTTP gateway failed: %s", err)
+	}
+}
+
+// streamWebResponse copies the chunks of a streamed response to the HTTP client
+// until the stream ends or the client goes away. Streams aren't bound by the
+// call timeout as a whole, so that they can be used for long-lived server-sent
+// events, but are abandoned if the service sends nothing for longer than it,
+// e.g. because the streaming instance has died.
+//
+// Streams which are cut short, including when the client falls too far behind,
+// are aborted rather than ended cleanly, so that the client can tell that the
+// response is incomplete.
+func (s *Server) streamWebResponse(w http.ResponseWriter, r *http.Request, call *gatewayCall) {
+	flusher, _ := w.(http.Flusher)
+	idle := time.NewTimer(s.config.CallTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-call.ready:
+		case <-idle.C:
+			log.Errorf("servicemanager: abandoning stream for %s as the service has stopped sending", r.URL.Path)
+			panic(http.ErrAbortHandler)
+		case <-r.Context().Done():
+			return
+		}
+		chunks, overflow := call.pop()
+		for _, chunk := range chunks {
+			if len(chunk.Data) > 0 {
+				_, err := w.Write(chunk.Data)
+				if err != nil {
+					return
+				}
+			}
+			if chunk.End {
+				if chunk.Error != "" {
+					log.Errorf("servicemanager: stream for %s failed: %s", r.URL.Path, chunk.Error)
+					panic(http.ErrAbortHandler)
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+				return
+			}
+		}
+		if overflow {
+			log.Errorf("servicemanager: abandoning stream for %s as the client is too slow", r.URL.Path)
+			panic(http.ErrAbortHandler)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(s.config.CallTimeout)
+	}
+}
+
+// writeWebResponse writes the response of a service method to the HTTP client,
+// and returns whether its body is to be streamed. Cacheable responses are
+// cached under cacheKey if it is set. Error details are only exposed outside
+// of production mode.
+func (s *Server) writeWebResponse(w http.ResponseWriter, r *http.Request, resp *protocol.ServerResponse, cacheKey string) bool {
+	if resp.ErrorCode != protocol.ErrorCode_NONE {
+		status := http.StatusInternalServerError
+		switch resp.ErrorCode {
+		case protocol.ErrorCode_METHOD_NOT_FOUND:
+			status = http.StatusNotFound
+		case protocol.ErrorCode_PERMISSION_DENIED:
+			status = http.StatusForbidden
+		case protocol.ErrorCode_SERVICE_NOT_FOUND:
+			status = http.StatusServiceUnavailable
+		case protocol.ErrorCode_TIMEOUT:
+			status = http.StatusGatewayTimeout
+		case protocol.ErrorCode_UNAUTHENTICATED:
+			status = http.StatusUnauthorized
+		}
+		msg := http.StatusText(status)
+		if !s.config.ProductionMode && resp.ErrorMessage != "" {
+			msg = resp.ErrorMessage
+		}
+		http.Error(w, msg, status)
+		return false
+	}
+	wresp := &rtproto.WebResponse{}
+	if len(resp.Result) > 0 {
+		err := rtproto.Decode(resp.Result, wresp)
+		if err != nil {
+			log.Errorf("servicemanager: couldn't decode web response: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return false
+		}
+	}
+	if cacheKey != "" {
+		if entry := s.cache.put(cacheKey, r.URL.Path, wresp); entry != nil {
+			s.writeCached(w, r, entry, wresp.Body, false)
+			return false
+		}
+	}
+	header := w.Header()
+	for name, value := range wresp.Header {
+		header.Set(name, value)
+	}
+	for _, cookie := range wresp.Cookies {
+		header.Add("Set-Cookie", cookie)
+	}
+	status := wresp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if wresp.Stream {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return true
+	}
+	w.Write(wresp.Body)
+	return false
+}
+
+func newWebRequest(r *http.Request, pathArgs []string, body []byte) *rtproto.WebRequest {
+	req := &rtproto.WebRequest{
+		Body:      body,
+		Cookies:   map[string][]string{},
+		Header:    map[string]string{},
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		PathArgs:  pathArgs,
+		QueryArgs: map[string]string{},
+		Scheme:    "http",
+	}
+	if r.TLS != nil {
+		req.Scheme = "https"
+	}
+	for _, cookie := range r.Cookies() {
+		req.Cookies[cookie.Name] = append(req.Cookies[cookie.Name], cookie.Value)
+	}
+	for name, values := range r.Header {
+		if gatewayStripHeaders[name] {
+			continue
+		}
+		req.Header[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			req.QueryArgs[name] = values[0]
+		}
+	}
+	return req
+}
+
+func isPathCapture(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+func newGateway(cfg *config.Gateway, timeout time.Duration) (*gateway, error) {
+	if cfg == nil || len(cfg.Routes) == 0 {
+		return nil, nil
+	}
+	g := &gateway{
+		conns:   map[string]*wsConn{},
+		pending: map[uint64]*gatewayCall{},
+		timeout: timeout,
+		// The default upgrader only accepts same-origin WebSocket
+		// connections.
+		upgrader: &websocket.Upgrader{},
+	}
+	for i, r := range cfg.Routes {
+		idx := strings.IndexByte(r.Target, '/')
+		if idx == -1 || !rtproto.IsValidServiceID(r.Target[:idx]) || idx == len(r.Target)-1 {
+			return nil, fmt.Errorf("servicemanager: gateway route %d needs a target of the form \"service/method\"", i+1)
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("servicemanager: path in gateway route %d needs to start with a /", i+1)
+		}
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return nil, fmt.Errorf("servicemanager: invalid host pattern %q in gateway route %d", r.Host, i+1)
+		}
+		route := &gatewayRoute{
+			host:      r.Host,
+			method:    r.Target[idx+1:],
+			segments:  strings.Split(r.Path[1:], "/"),
+			serviceID: r.Target[:idx],
+			websocket: r.WebSocket,
+		}
+		for j, seg := range route.segments {
+			if !strings.HasSuffix(seg, "...}") {
+				continue
+			}
+			if j != len(route.segments)-1 || !isPathCapture(seg) {
+				return nil, fmt.Errorf("servicemanager: only the last segment in gateway route %d can match the rest of the path", i+1)
+			}
+			route.rest = true
+		}
+		if len(r.Methods) > 0 {
+			route.methods = map[string]bool{}
+			for _, method := range r.Methods {
+				route.methods[strings.ToUpper(method)] = true
+			}
+		}
+		g.routes = append(g.routes, route)
+	}
+	g.svc = &service{
+		id:        gatewayInstanceID,
+		local:     g.deliver,
+		serviceID: gatewayServiceID,
+	}
+	return g, nil
+}
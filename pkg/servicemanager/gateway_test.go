@@ -0,0 +1,193 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tav/elko/pkg/config"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+func TestGatewayRouteMatch(t *testing.T) {
+	newRoute := func(pattern string, host string, methods ...string) *gatewayRoute {
+		g, err := newGateway(&config.Gateway{
+			Routes: []config.Route{{Host: host, Methods: methods, Path: pattern, Target: "web/Handle"}},
+		}, time.Second)
+		if err != nil {
+			t.Fatalf("couldn't create route for %s: %s", pattern, err)
+		}
+		return g.routes[0]
+	}
+	for _, tt := range []struct {
+		name   string
+		route  *gatewayRoute
+		method string
+		host   string
+		path   string
+		args   []string
+		ok     bool
+	}{
+		{"static", newRoute("/status", ""), "GET", "", "/status", nil, true},
+		{"static mismatch", newRoute("/status", ""), "GET", "", "/health", nil, false},
+		{"root", newRoute("/", ""), "GET", "", "/", nil, true},
+		{"capture", newRoute("/users/{id}", ""), "GET", "", "/users/42", []string{"42"}, true},
+		{"unescaped capture", newRoute("/users/{id}", ""), "GET", "", "/users/a%2Fb", []string{"a/b"}, true},
+		{"multiple captures", newRoute("/users/{id}/posts/{post}", ""), "GET", "", "/users/42/posts/7", []string{"42", "7"}, true},
+		{"empty capture", newRoute("/users/{id}", ""), "GET", "", "/users/", nil, false},
+		{"too many segments", newRoute("/users/{id}", ""), "GET", "", "/users/42/posts", nil, false},
+		{"too few segments", newRoute("/users/{id}", ""), "GET", "", "/users", nil, false},
+		{"rest", newRoute("/files/{path...}", ""), "GET", "", "/files/a/b%20c.txt", []string{"a/b c.txt"}, true},
+		{"rest after capture", newRoute("/{bucket}/{key...}", ""), "GET", "", "/media/x/y", []string{"media", "x/y"}, true},
+		{"invalid escape", newRoute("/users/{id}", ""), "GET", "", "/users/%zz", nil, false},
+		{"allowed method", newRoute("/users", "", "POST"), "POST", "", "/users", nil, true},
+		{"lowercase method", newRoute("/users", "", "post"), "POST", "", "/users", nil, true},
+		{"disallowed method", newRoute("/users", "", "POST"), "GET", "", "/users", nil, false},
+		{"host pattern", newRoute("/", "*.example.com"), "GET", "api.example.com", "/", nil, true},
+		{"host mismatch", newRoute("/", "*.example.com"), "GET", "example.org", "/", nil, false},
+	} {
+		segments := strings.Split(strings.TrimPrefix(tt.path, "/"), "/")
+		args, ok := tt.route.match(tt.method, tt.host, segments)
+		if ok != tt.ok {
+			t.Errorf("%s: got match %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: got args %q, want %q", tt.name, args, tt.args)
+		}
+	}
+}
+
+func TestGatewayMatch(t *testing.T) {
+	g, err := newGateway(&config.Gateway{
+		Routes: []config.Route{
+			{Path: "/live", Target: "events/Subscribe", WebSocket: true},
+			{Host: "api.example.com", Path: "/users/{id}", Target: "users/Get"},
+			{Path: "/{rest...}", Target: "web.static/Serve"},
+		},
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		url       string
+		serviceID string
+		method    string
+		websocket bool
+		args      []string
+	}{
+		{"http://example.com/live", "events", "Subscribe", true, nil},
+		{"http://api.example.com:8080/users/42", "users", "Get", false, []string{"42"}},
+		{"http://www.example.com/users/42", "web.static", "Serve", false, []string{"users/42"}},
+	} {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		route, args := g.match(r)
+		if route == nil {
+			t.Errorf("%s: no route matched", tt.url)
+			continue
+		}
+		if route.serviceID != tt.serviceID || route.method != tt.method || route.websocket != tt.websocket {
+			t.Errorf("%s: got route to %s/%s (websocket %v), want %s/%s (websocket %v)", tt.url,
+				route.serviceID, route.method, route.websocket, tt.serviceID, tt.method, tt.websocket)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: got args %q, want %q", tt.url, args, tt.args)
+		}
+	}
+}
+
+func TestNewGatewayErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		route config.Route
+	}{
+		{"missing method", config.Route{Path: "/", Target: "web/"}},
+		{"missing service", config.Route{Path: "/", Target: "/Handle"}},
+		{"missing slash in target", config.Route{Path: "/", Target: "web"}},
+		{"invalid service ID", config.Route{Path: "/", Target: "Web/Handle"}},
+		{"relative path", config.Route{Path: "users", Target: "web/Handle"}},
+		{"invalid host pattern", config.Route{Host: "[", Path: "/", Target: "web/Handle"}},
+		{"rest before the end", config.Route{Path: "/{rest...}/edit", Target: "web/Handle"}},
+		{"rest outside a capture", config.Route{Path: "/files/path...}", Target: "web/Handle"}},
+	} {
+		_, err := newGateway(&config.Gateway{Routes: []config.Route{tt.route}}, time.Second)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if g, err := newGateway(&config.Gateway{}, time.Second); g != nil || err != nil {
+		t.Errorf("got gateway %v and error %v without routes, want neither", g, err)
+	}
+}
+
+func TestStreamWebResponse(t *testing.T) {
+	s := &Server{config: &Config{CallTimeout: 200 * time.Millisecond}}
+	g := &gateway{pending: map[uint64]*gatewayCall{}}
+	for _, tt := range []struct {
+		name   string
+		chunks []*protocol.ServerStream
+		body   string
+		ok     bool
+	}{
+		{"complete", []*protocol.ServerStream{{Data: []byte("hello ")}, {Data: []byte("world"), End: true}}, "hello world", true},
+		{"empty end", []*protocol.ServerStream{{Data: []byte("hello")}, {End: true}}, "hello", true},
+		{"failed", []*protocol.ServerStream{{Data: []byte("hello ")}, {End: true, Error: "boom"}}, "hello ", false},
+		{"idle", []*protocol.ServerStream{{Data: []byte("hello ")}}, "hello ", false},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, call := g.register()
+			defer g.remove(id)
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			go func() {
+				for _, chunk := range tt.chunks {
+					chunk.ID = id
+					if !g.deliver(protocol.OP_SERVER_STREAM, chunk) {
+						t.Errorf("%s: chunk wasn't delivered", tt.name)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+			s.streamWebResponse(w, r, call)
+		}))
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v reading the body, want success to be %v", tt.name, err, tt.ok)
+		}
+		if string(body) != tt.body {
+			t.Errorf("%s: got body %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
+
+func TestGatewayStreamOverflow(t *testing.T) {
+	g := &gateway{pending: map[uint64]*gatewayCall{}}
+	id, call := g.register()
+	chunk := &protocol.ServerStream{Data: make([]byte, gatewayStreamBuffer/2+1), ID: id}
+	// The first chunk is always buffered, however large it is.
+	for i, want := range []bool{true, false, false} {
+		if ok := g.deliver(protocol.OP_SERVER_STREAM, chunk); ok != want {
+			t.Errorf("got %v delivering chunk %d, want %v", ok, i+1, want)
+		}
+	}
+	if chunks, overflow := call.pop(); len(chunks) != 1 || !overflow {
+		t.Errorf("got %d chunks with overflow %v, want 1 with overflow", len(chunks), overflow)
+	}
+	g.remove(id)
+	if g.deliver(protocol.OP_SERVER_STREAM, chunk) {
+		t.Errorf("chunk was delivered after the call was removed")
+	}
+}
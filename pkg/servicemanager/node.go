@@ -0,0 +1,408 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/golly/log"
+)
+
+// Frames on node connections are hashed with the key derived from the ID of
+// the node which dialed the connection.
+//
+// Requests sent over the connection are tracked in pending until the remote
+// node responds, or the connection is closed, at which point done is closed.
+// Writes are serialised by writeMu.
+type node struct {
+	conn    net.Conn
+	done    chan struct{}
+	id      string
+	key     []byte
+	lastID  uint64
+	mu      sync.Mutex
+	pending map[uint64]chan *protocol.ServerResponse
+	reader  *rtproto.FrameReader
+	timeout time.Duration
+	writeMu sync.Mutex
+}
+
+// call sends a request to the node and waits for its response.
+func (n *node) call(req *protocol.ClientRequest) (*protocol.ServerResponse, error) {
+	ch := make(chan *protocol.ServerResponse, 1)
+	n.mu.Lock()
+	n.lastID++
+	id := n.lastID
+	n.pending[id] = ch
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, id)
+		n.mu.Unlock()
+	}()
+	req.ID = id
+	err := n.writeMessage(protocol.OP_NODE_REQUEST, req)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(n.timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-n.done:
+		return nil, fmt.Errorf("servicemanager: lost connection to node %s", n.id)
+	case <-timer.C:
+		return nil, fmt.Errorf("servicemanager: timed out waiting for node %s", n.id)
+	}
+}
+
+// deliver hands a response over to the pending request.
+func (n *node) deliver(resp *protocol.ServerResponse) {
+	n.mu.Lock()
+	ch, ok := n.pending[resp.ID]
+	n.mu.Unlock()
+	if !ok {
+		log.Errorf("servicemanager: dropping unexpected response %d from node %s", resp.ID, n.id)
+		return
+	}
+	ch <- resp
+}
+
+// nodeMap holds the connections dialed to the other nodes in the cluster. Each
+// node dials the others, so that requests are always sent over the connection
+// dialed by the sender.
+type nodeMap struct {
+	sync.Mutex
+	conns map[string]*node
+}
+
+func (m *nodeMap) add(n *node) {
+	m.Lock()
+	m.conns[n.id] = n
+	m.Unlock()
+}
+
+func (m *nodeMap) get(nodeID string) *node {
+	m.Lock()
+	n := m.conns[nodeID]
+	m.Unlock()
+	return n
+}
+
+// prune closes the connections to nodes which aren't in live.
+func (m *nodeMap) prune(live map[string]bool) {
+	m.Lock()
+	defer m.Unlock()
+	for id, n := range m.conns {
+		if !live[id] {
+			log.Infof("Disconnecting from node %s as it has gone away", id)
+			n.conn.Close()
+			delete(m.conns, id)
+		}
+	}
+}
+
+func (m *nodeMap) remove(n *node) {
+	m.Lock()
+	if m.conns[n.id] == n {
+		delete(m.conns, n.id)
+	}
+	m.Unlock()
+}
+
+func (n *node) readMessage(expected protocol.OP, msg proto.Message) error {
+	n.conn.SetReadDeadline(time.Now().Add(n.timeout))
+	op, body, err := n.reader.Read(false)
+	if err != nil {
+		return err
+	}
+	opcode := protocol.OP(op)
+	if opcode != expected {
+		return fmt.Errorf("servicemanager: received %s from node when expecting %s", opcode, expected)
+	}
+	return proto.Unmarshal(body.Bytes(), msg)
+}
+
+func (n *node) writeMessage(opcode protocol.OP, msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := rtproto.AppendFrame(nil, n.key, byte(opcode), data, 0)
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+	n.conn.SetWriteDeadline(time.Now().Add(n.timeout))
+	_, err = n.conn.Write(frame)
+	return err
+}
+
+// forwardNode forwards a call for a builtin service to the node with the
+// given ID, and returns the error, if any, that it failed with there.
+func (s *Server) forwardNode(nodeID string, req *protocol.ClientRequest) error {
+	n := s.nodes.get(nodeID)
+	if n == nil {
+		return fmt.Errorf("servicemanager: not connected to node %s", nodeID)
+	}
+	resp, err := n.call(&protocol.ClientRequest{
+		ServiceID:     req.ServiceID,
+		ServiceMethod: req.ServiceMethod,
+		ServiceParam:  req.ServiceParam,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode != protocol.ErrorCode_NONE {
+		return errors.New(resp.ErrorMessage)
+	}
+	return nil
+}
+
+// handleNodeRequest handles a call forwarded by another node, which has
+// already authorized it.
+func (s *Server) handleNodeRequest(n *node, req *protocol.ClientRequest) {
+	var err error
+	if req.ServiceID == websocketService {
+		err = s.webSocketSend(req, false)
+	} else {
+		err = fmt.Errorf("servicemanager: calls to %s can't be forwarded between nodes", req.ServiceID)
+	}
+	resp := &protocol.ServerResponse{ID: req.ID}
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCode_SERVICE_ERROR
+		resp.ErrorMessage = err.Error()
+	}
+	err = n.writeMessage(protocol.OP_NODE_RESPONSE, resp)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't respond to node %s: %s", n.id, err)
+	}
+}
+
+// connectNodes keeps connections open to the other live nodes in the cluster,
+// as found from the statuses that they publish. It doesn't return.
+func (s *Server) connectNodes() {
+	for {
+		nodes, err := s.cluster.Nodes()
+		if err != nil {
+			log.Errorf("servicemanager: couldn't get the nodes in the cluster: %s", err)
+			time.Sleep(statusInterval)
+			continue
+		}
+		live := map[string]bool{}
+		now := time.Now()
+		for _, status := range nodes {
+			if status.ID == s.nodeID || status.Addr == "" || now.Sub(status.Updated) > staleNodeAge {
+				continue
+			}
+			live[status.ID] = true
+			if s.nodes.get(status.ID) != nil {
+				continue
+			}
+			n, err := s.dialNode(status.Addr, status.ID)
+			if err != nil {
+				log.Errorf("servicemanager: couldn't connect to node %s at %s: %s", status.ID, status.Addr, err)
+				continue
+			}
+			log.Infof("Connected to node %s at %s", n.id, status.Addr)
+			s.nodes.add(n)
+			go s.serveNode(n)
+		}
+		s.nodes.prune(live)
+		time.Sleep(statusInterval)
+	}
+}
+
+// dialNode connects to the node with the given ID at addr. If TLS has been
+// configured, the remote node needs to present a certificate bound to nodeID.
+func (s *Server) dialNode(addr string, nodeID string) (*node, error) {
+	conn, err := net.DialTimeout("tcp", addr, s.config.CallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.config.CallTimeout))
+	_, err = conn.Write([]byte{2})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.certs != nil {
+		tconn := tls.Client(conn, s.certs.clientConfig(nodeID))
+		tconn.SetDeadline(time.Now().Add(s.config.CallTimeout))
+		err = tconn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	} else if s.config.ProductionMode {
+		conn.Close()
+		return nil, fmt.Errorf("servicemanager: refusing to dial node %s without TLS in production mode", nodeID)
+	}
+	n := &node{
+		conn:    conn,
+		done:    make(chan struct{}),
+		id:      nodeID,
+		key:     rtproto.Key(s.nodeID),
+		pending: map[uint64]chan *protocol.ServerResponse{},
+		reader:  s.newNodeReader(conn),
+		timeout: s.config.CallTimeout,
+	}
+	n.reader.SetKey(n.key)
+	err = n.writeMessage(protocol.OP_NODE_HELLO, &protocol.NodeHello{
+		NodeID:          s.nodeID,
+		ProtocolVersion: rtproto.Version,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hello := &protocol.NodeHello{}
+	err = n.readMessage(protocol.OP_NODE_HELLO, hello)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if hello.NodeID != nodeID {
+		conn.Close()
+		return nil, fmt.Errorf("servicemanager: dialed node %s but got hello from %q", nodeID, hello.NodeID)
+	}
+	if hello.ProtocolVersion != 0 && hello.ProtocolVersion != rtproto.Version {
+		conn.Close()
+		return nil, fmt.Errorf("servicemanager: node %s replied with unsupported protocol version %d", nodeID, hello.ProtocolVersion)
+	}
+	return n, nil
+}
+
+func handleNode(s *Server, conn net.Conn) {
+	certID := ""
+	if s.certs != nil {
+		tconn := tls.Server(conn, s.certs.serverConfig())
+		tconn.SetDeadline(time.Now().Add(s.config.CallTimeout))
+		err := tconn.Handshake()
+		if err != nil {
+			log.Errorf("servicemanager: TLS handshake with node at %s failed: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		certID, err = nodeIDFromCert(tconn.ConnectionState().PeerCertificates[0])
+		if err != nil {
+			log.Error(err)
+			conn.Close()
+			return
+		}
+		conn = tconn
+	} else if s.config.ProductionMode {
+		log.Errorf("servicemanager: rejecting plaintext node connection from %s in production mode", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	n := &node{
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: map[uint64]chan *protocol.ServerResponse{},
+		reader:  s.newNodeReader(conn),
+		timeout: s.config.CallTimeout,
+	}
+	hello := &protocol.NodeHello{}
+	err := n.readMessage(protocol.OP_NODE_HELLO, hello)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't read NODE_HELLO from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	n.key = rtproto.Key(hello.NodeID)
+	err = n.reader.SetKey(n.key)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't verify NODE_HELLO from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	version, err := rtproto.NegotiateVersion(hello.ProtocolVersion)
+	if err != nil {
+		log.Errorf("servicemanager: rejecting node connection from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if certID != "" && hello.NodeID != certID {
+		log.Errorf("servicemanager: node at %s claimed to be %q but presented a certificate for %q",
+			conn.RemoteAddr(), hello.NodeID, certID)
+		conn.Close()
+		return
+	}
+	n.id = hello.NodeID
+	err = n.writeMessage(protocol.OP_NODE_HELLO, &protocol.NodeHello{
+		NodeID:          s.nodeID,
+		ProtocolVersion: version,
+	})
+	if err != nil {
+		log.Errorf("servicemanager: couldn't write NODE_HELLO to node %s: %s", n.id, err)
+		conn.Close()
+		return
+	}
+	log.Infof("Received node connection from %s", n.id)
+	s.serveNode(n)
+}
+
+// serveNode handles the messages from a node until its connection is closed.
+func (s *Server) serveNode(n *node) {
+	defer func() {
+		n.conn.Close()
+		close(n.done)
+		s.nodes.remove(n)
+	}()
+	for {
+		// Nodes are allowed to sit idle, so the deadline set by the reader
+		// for the previous message is cleared.
+		n.conn.SetReadDeadline(time.Time{})
+		op, body, err := n.reader.Read(false)
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("servicemanager: got error when reading from node %s: %s", n.id, err)
+			}
+			return
+		}
+		opcode := protocol.OP(op)
+		switch opcode {
+		case protocol.OP_NODE_REQUEST:
+			req := &protocol.ClientRequest{}
+			err = proto.Unmarshal(body.Bytes(), req)
+			if err == nil {
+				go s.handleNodeRequest(n, req)
+			}
+		case protocol.OP_NODE_RESPONSE:
+			resp := &protocol.ServerResponse{}
+			err = proto.Unmarshal(body.Bytes(), resp)
+			if err == nil {
+				n.deliver(resp)
+			}
+		default:
+			err = fmt.Errorf("servicemanager: received unexpected %s", opcode)
+		}
+		body.Close()
+		if err != nil {
+			log.Errorf("servicemanager: couldn't handle message from node %s: %s", n.id, err)
+			return
+		}
+	}
+}
+
+func (s *Server) newNodeReader(conn net.Conn) *rtproto.FrameReader {
+	r := rtproto.NewFrameReader(conn, rtproto.Limits{
+		MaxFrameSize: uint32(s.config.MaxFrameSize),
+	})
+	r.SetDeadlineFunc(func() {
+		conn.SetReadDeadline(time.Now().Add(s.config.CallTimeout))
+	})
+	return r
+}
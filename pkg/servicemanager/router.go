@@ -0,0 +1,334 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/elko/pkg/trace"
+	"github.com/tav/golly/log"
+)
+
+// bind adds the connection to the map under the given instance ID, or under a
+// newly allocated one if it is 0, and returns the instance ID. Instance IDs
+// are unique across all services, as responses are routed by instance ID
+// alone. An ID can only be reused once its previous connection has closed,
+// e.g. when an instance reconnects.
+func (m *serviceMap) bind(svc *service, serviceID string, instanceID uint64) (uint64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if instanceID == 0 {
+		for {
+			m.lastID++
+			if _, exists := m.instances[m.lastID]; !exists && m.lastID != gatewayInstanceID {
+				break
+			}
+		}
+		instanceID = m.lastID
+	} else if existing, ok := m.instances[instanceID]; ok {
+		if !existing.isClosed() {
+			return 0, fmt.Errorf("servicemanager: instance ID %d is already in use by %s", instanceID, existing.serviceID)
+		}
+		m.remove(existing)
+	}
+	svc.Lock()
+	svc.id = instanceID
+	svc.serviceID = serviceID
+	svc.Unlock()
+	m.instances[instanceID] = svc
+	if serviceID != cliServiceID {
+		m.services[serviceID] = append(m.services[serviceID], svc)
+	}
+	return instanceID, nil
+}
+
+// pick returns a random live instance of the given service.
+func (m *serviceMap) pick(serviceID string) *service {
+	m.RLock()
+	defer m.RUnlock()
+	instances := m.services[serviceID]
+	if len(instances) == 0 {
+		return nil
+	}
+	start := rand.Intn(len(instances))
+	for i := range instances {
+		svc := instances[(start+i)%len(instances)]
+		if !svc.isClosed() {
+			return svc
+		}
+	}
+	return nil
+}
+
+// remove needs to be called with the lock held.
+func (m *serviceMap) remove(svc *service) {
+	if m.instances[svc.id] == svc {
+		delete(m.instances, svc.id)
+	}
+	instances := m.services[svc.serviceID]
+	for i, other := range instances {
+		if other == svc {
+			instances = append(instances[:i:i], instances[i+1:]...)
+			break
+		}
+	}
+	if len(instances) == 0 {
+		delete(m.services, svc.serviceID)
+	} else {
+		m.services[svc.serviceID] = instances
+	}
+}
+
+// unbind removes the connection from the map once it has closed.
+func (m *serviceMap) unbind(svc *service) {
+	m.Lock()
+	m.remove(svc)
+	m.Unlock()
+}
+
+// dispatch forwards an authorized request to an instance of the target
+// service. If param is set, it holds the request's spilled serviceParam.
+func (s *Server) dispatch(from *service, req *protocol.ClientRequest, principal *protocol.Principal, span *trace.Span, param *spilled) {
+	target := s.serviceMap.pick(req.ServiceID)
+	if target == nil {
+		param.close()
+		s.reject(from, req, protocol.ErrorCode_SERVICE_NOT_FOUND,
+			fmt.Sprintf("no instances of %q are available", req.ServiceID), span)
+		return
+	}
+	// The target service sees the execution span as the parent of any calls
+	// that it makes in turn.
+	exec := span.Child("execute")
+	exec.Set("elko.instance", strconv.FormatUint(target.id, 10))
+	req.TraceID = exec.Traceparent()
+	msg, err := proto.Marshal(req)
+	if err != nil {
+		param.close()
+		log.Errorf("servicemanager: couldn't encode request for %s: %s", req.ServiceID, err)
+		return
+	}
+	var deadline time.Time
+	if req.Deadline != nil {
+		deadline, _ = ptypes.Timestamp(req.Deadline)
+	}
+	key := callKey{id: req.ID, instance: from.id}
+	target.track(key, &call{
+		async:     req.Async,
+		expires:   s.expiry(deadline),
+		principal: principal,
+	})
+	trackExec := s.tracer != nil && !req.Async
+	if trackExec {
+		s.inflight.add(key, exec)
+	}
+	span.Finish()
+	s.tracer.Record(span)
+	queue := span.Child("queue")
+	sreq := &protocol.ServerRequest{
+		InstanceID: from.id,
+		Message:    msg,
+		NodeID:     s.nodeID,
+		Principal:  principal,
+	}
+	sent := func() {
+		queue.Finish()
+		s.tracer.Record(queue)
+		if trackExec {
+			s.inflight.started(key)
+		}
+	}
+	if param == nil {
+		target.send(protocol.OP_SERVER_REQUEST, sreq, sent)
+		return
+	}
+	// Fields can be encoded in any order, so the message is appended to the
+	// rest of the ServerRequest, with the param following on from the rest of
+	// the request.
+	sreq.Message = nil
+	head, err := proto.Marshal(sreq)
+	if err != nil {
+		param.close()
+		log.Errorf("servicemanager: couldn't encode request for %s: %s", req.ServiceID, err)
+		return
+	}
+	msg = appendField(msg, fieldClientRequestParam, param.len())
+	head = appendField(head, fieldServerRequestMessage, int64(len(msg))+param.len())
+	target.sendSpilled(protocol.OP_SERVER_REQUEST, append(head, msg...), param, sent)
+}
+
+// forward routes a service's response back to the calling instance.
+func (s *Server) forward(from *service, resp *protocol.ClientResponse) {
+	msg := &protocol.ServerResponse{}
+	err := proto.Unmarshal(resp.Message, msg)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't decode response for instance %d: %s", resp.InstanceID, err)
+		return
+	}
+	s.relay(from, resp, msg, nil)
+}
+
+// forwardStream routes a chunk of a streamed response back to the calling
+// instance. If the caller has gone away, the streaming service is told to stop.
+func (s *Server) forwardStream(from *service, msg *protocol.ClientStream) {
+	chunk := &protocol.ServerStream{}
+	err := proto.Unmarshal(msg.Message, chunk)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't decode stream for instance %d: %s", msg.InstanceID, err)
+		return
+	}
+	key := callKey{id: chunk.ID, instance: msg.InstanceID}
+	if msg.NodeID != s.nodeID || !from.extend(key, s.expiry(time.Time{})) {
+		log.Errorf("servicemanager: dropping unexpected stream %d from %s/%d for instance %d on node %s",
+			chunk.ID, from.serviceID, from.id, msg.InstanceID, msg.NodeID)
+		return
+	}
+	if chunk.End {
+		from.complete(key)
+	}
+	s.serviceMap.RLock()
+	caller := s.serviceMap.instances[msg.InstanceID]
+	s.serviceMap.RUnlock()
+	if caller != nil && !caller.isClosed() && caller.write(protocol.OP_SERVER_STREAM, chunk) == nil {
+		return
+	}
+	if chunk.End {
+		return
+	}
+	from.write(protocol.OP_SERVER_CANCEL, &protocol.ServerCancel{
+		ID:         chunk.ID,
+		InstanceID: msg.InstanceID,
+		NodeID:     msg.NodeID,
+	})
+}
+
+// relay sends the response to the calling instance. If data is set, it holds
+// the spilled encoding of msg, which is forwarded as is, and msg only has the
+// fields needed to route it.
+//
+// Responses are only relayed for calls which were dispatched to the instance,
+// so that it can't send responses to instances which never called it. Calls
+// with streamed responses are kept open until the end of the stream.
+func (s *Server) relay(from *service, resp *protocol.ClientResponse, msg *protocol.ServerResponse, data *spilled) {
+	key := callKey{id: msg.ID, instance: resp.InstanceID}
+	ok := false
+	if resp.NodeID == s.nodeID {
+		if msg.Stream {
+			ok = from.extend(key, s.expiry(time.Time{}))
+		} else {
+			ok = from.complete(key)
+		}
+	}
+	if !ok {
+		data.close()
+		log.Errorf("servicemanager: dropping unexpected response %d from %s/%d for instance %d on node %s",
+			msg.ID, from.serviceID, from.id, resp.InstanceID, resp.NodeID)
+		return
+	}
+	s.serviceMap.RLock()
+	caller := s.serviceMap.instances[resp.InstanceID]
+	s.serviceMap.RUnlock()
+	if caller == nil || caller.isClosed() {
+		data.close()
+		log.Errorf("servicemanager: dropping response for disconnected instance %d", resp.InstanceID)
+		return
+	}
+	if s.tracer != nil {
+		if span := s.inflight.remove(key); span != nil {
+			if msg.ErrorCode != protocol.ErrorCode_NONE {
+				span.Error = msg.ErrorCode.String()
+			}
+			span.Finish()
+			s.tracer.Record(span)
+		}
+	}
+	if data == nil {
+		caller.write(protocol.OP_SERVER_RESPONSE, msg)
+		return
+	}
+	if caller.local == nil {
+		caller.sendSpilled(protocol.OP_SERVER_RESPONSE, nil, data, nil)
+		return
+	}
+	// Callers within the service manager itself are handed decoded messages.
+	buf := make([]byte, data.len())
+	_, err := readAt(data.body, buf, data.start)
+	data.close()
+	if err == nil {
+		err = proto.Unmarshal(buf, msg)
+	}
+	if err != nil {
+		log.Errorf("servicemanager: couldn't decode response for instance %d: %s", resp.InstanceID, err)
+		return
+	}
+	caller.write(protocol.OP_SERVER_RESPONSE, msg)
+}
+
+// reject sends an error response for the given request to the caller, unless
+// it was made asynchronously.
+func (s *Server) reject(from *service, req *protocol.ClientRequest, code protocol.ErrorCode, msg string, span *trace.Span) {
+	span.Error = code.String()
+	span.Finish()
+	s.tracer.Record(span)
+	if req.Async {
+		return
+	}
+	from.write(protocol.OP_SERVER_RESPONSE, &protocol.ServerResponse{
+		ErrorCode:    code,
+		ErrorMessage: msg,
+		ID:           req.ID,
+	})
+}
+
+// route identifies and authorizes a request and dispatches it. The raw token
+// is stripped so that it isn't passed on to the target service, which gets the
+// verified principal instead. A new trace is started if the
+// request doesn't carry a valid traceparent.
+//
+// If param is set, it holds the request's spilled serviceParam, and is closed
+// if the request isn't dispatched.
+func (s *Server) route(from *service, req *protocol.ClientRequest, param *spilled) {
+	span := trace.Start("route", req.TraceID)
+	span.Set("elko.caller", from.serviceID)
+	span.Set("elko.method", req.ServiceMethod)
+	span.Set("elko.service", req.ServiceID)
+	principal, err := s.identify(from, req)
+	if err != nil {
+		log.Errorf("servicemanager: rejecting request from %s to %s.%s: %s",
+			from.serviceID, req.ServiceID, req.ServiceMethod, err)
+		param.close()
+		s.reject(from, req, protocol.ErrorCode_UNAUTHENTICATED, err.Error(), span)
+		return
+	}
+	if !s.authorize(from, req, principal) {
+		param.close()
+		s.reject(from, req, protocol.ErrorCode_PERMISSION_DENIED,
+			fmt.Sprintf("%s is not allowed to call %s.%s", from.serviceID, req.ServiceID, req.ServiceMethod), span)
+		return
+	}
+	if param != nil && rtproto.IsBuiltinServiceID(req.ServiceID) {
+		param.close()
+		s.reject(from, req, protocol.ErrorCode_SERVICE_ERROR,
+			fmt.Sprintf("request to %s is too large", req.ServiceID), span)
+		return
+	}
+	if s.builtin(from, req, principal, span) {
+		return
+	}
+	if schema := s.schemas.get(req.ServiceID); schema != nil && schema.Method(req.ServiceMethod) == nil {
+		param.close()
+		s.reject(from, req, protocol.ErrorCode_METHOD_NOT_FOUND,
+			fmt.Sprintf("%s has no method %q", req.ServiceID, req.ServiceMethod), span)
+		return
+	}
+	req.AuthToken = ""
+	s.dispatch(from, req, principal, span, param)
+}
@@ -0,0 +1,112 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+func TestRelayStreamedResponse(t *testing.T) {
+	var received []proto.Message
+	caller := &service{
+		id: 1,
+		local: func(opcode protocol.OP, msg proto.Message) bool {
+			received = append(received, msg)
+			return true
+		},
+		serviceID: "web",
+	}
+	target := &service{id: 2, serviceID: "files"}
+	s := &Server{
+		config: &Config{CallTimeout: time.Second},
+		nodeID: "node",
+		serviceMap: &serviceMap{
+			instances: map[uint64]*service{1: caller, 2: target},
+		},
+	}
+	key := callKey{id: 7, instance: caller.id}
+	target.track(key, &call{expires: s.expiry(time.Time{})})
+	respond := func(msg *protocol.ServerResponse) {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.forward(target, &protocol.ClientResponse{InstanceID: caller.id, Message: data, NodeID: "node"})
+	}
+	stream := func(chunk *protocol.ServerStream) {
+		data, err := proto.Marshal(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.forwardStream(target, &protocol.ClientStream{InstanceID: caller.id, Message: data, NodeID: "node"})
+	}
+	respond(&protocol.ServerResponse{ID: 7, Stream: true})
+	stream(&protocol.ServerStream{ID: 7, Data: []byte("hello ")})
+	stream(&protocol.ServerStream{ID: 7, Data: []byte("world"), End: true})
+	// The call is complete once the stream has ended, so anything further from
+	// the target is dropped.
+	stream(&protocol.ServerStream{ID: 7, Data: []byte("late")})
+	respond(&protocol.ServerResponse{ID: 7})
+	if len(received) != 3 {
+		t.Fatalf("got %d messages, want 3", len(received))
+	}
+	if resp, ok := received[0].(*protocol.ServerResponse); !ok || resp.ID != 7 || !resp.Stream {
+		t.Errorf("got %v, want the streamed response for call 7", received[0])
+	}
+	body := ""
+	for i, msg := range received[1:] {
+		chunk, ok := msg.(*protocol.ServerStream)
+		if !ok || chunk.ID != 7 {
+			t.Fatalf("got %v, want a stream chunk for call 7", msg)
+		}
+		if chunk.End != (i == 1) {
+			t.Errorf("got end %v for chunk %d", chunk.End, i)
+		}
+		body += string(chunk.Data)
+	}
+	if body != "hello world" {
+		t.Errorf("got streamed body %q, want %q", body, "hello world")
+	}
+	if len(target.calls) != 0 || target.inflight != 0 {
+		t.Errorf("got %d calls and %d in flight after the stream ended, want none", len(target.calls), target.inflight)
+	}
+}
+
+func TestRelayResponse(t *testing.T) {
+	var received []proto.Message
+	caller := &service{
+		id: 1,
+		local: func(opcode protocol.OP, msg proto.Message) bool {
+			received = append(received, msg)
+			return true
+		},
+	}
+	target := &service{id: 2, serviceID: "files"}
+	s := &Server{
+		config:     &Config{CallTimeout: time.Second},
+		nodeID:     "node",
+		serviceMap: &serviceMap{instances: map[uint64]*service{1: caller}},
+	}
+	target.track(callKey{id: 7, instance: caller.id}, &call{expires: s.expiry(time.Time{})})
+	for _, msg := range []*protocol.ServerResponse{{ID: 7}, {ID: 7}, {ID: 8}} {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.forward(target, &protocol.ClientResponse{InstanceID: caller.id, Message: data, NodeID: "node"})
+	}
+	// Only the first response is relayed, as the call is then complete, and
+	// the target was never sent call 8.
+	if len(received) != 1 {
+		t.Errorf("got %d responses, want 1", len(received))
+	}
+	if len(target.calls) != 0 {
+		t.Errorf("got %d calls after the response, want none", len(target.calls))
+	}
+}
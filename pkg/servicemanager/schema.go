@@ -0,0 +1,135 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/golly/log"
+)
+
+// schemaRegistry holds the schemas published by services, both by instances
+// connected to this node and, via the cluster backend, to other nodes. The
+// most recently published schema for a service wins, so the registry follows
+// the latest deploy.
+type schemaRegistry struct {
+	encoded map[string][]byte
+	mu      sync.RWMutex
+	schemas map[string]*rtproto.ServiceSchema
+}
+
+func (r *schemaRegistry) all() []*rtproto.ServiceSchema {
+	r.mu.RLock()
+	schemas := make([]*rtproto.ServiceSchema, 0, len(r.schemas))
+	for _, schema := range r.schemas {
+		schemas = append(schemas, schema)
+	}
+	r.mu.RUnlock()
+	sort.Slice(schemas, func(i, j int) bool {
+		return schemas[i].ServiceID < schemas[j].ServiceID
+	})
+	return schemas
+}
+
+func (r *schemaRegistry) get(serviceID string) *rtproto.ServiceSchema {
+	r.mu.RLock()
+	schema := r.schemas[serviceID]
+	r.mu.RUnlock()
+	return schema
+}
+
+// set decodes and stores the encoded schema for the service, and returns
+// whether it differs from the one held previously.
+func (r *schemaRegistry) set(serviceID string, data []byte) (bool, error) {
+	schema := &rtproto.ServiceSchema{}
+	err := rtproto.Decode(data, schema)
+	if err != nil {
+		return false, fmt.Errorf("servicemanager: couldn't decode schema for %s: %s", serviceID, err)
+	}
+	if schema.ServiceID != serviceID {
+		return false, fmt.Errorf("servicemanager: schema for %s is for a different service: %q", serviceID, schema.ServiceID)
+	}
+	seen := map[string]bool{}
+	for _, m := range schema.Methods {
+		if m == nil || m.Name == "" || seen[m.Name] {
+			return false, fmt.Errorf("servicemanager: schema for %s has a missing or duplicate method name", serviceID)
+		}
+		seen[m.Name] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytes.Equal(r.encoded[serviceID], data) {
+		return false, nil
+	}
+	r.encoded[serviceID] = data
+	r.schemas[serviceID] = schema
+	return true, nil
+}
+
+// handleSchemas serves the schema of the service given by the service
+// parameter, or the schemas of all known services if it isn't set.
+func (s *Server) handleSchemas(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	if serviceID := r.URL.Query().Get("service"); serviceID != "" {
+		schema := s.schemas.get(serviceID)
+		if schema == nil {
+			http.Error(w, fmt.Sprintf("no schema has been published for %s", serviceID), http.StatusNotFound)
+			return
+		}
+		resp = schema
+	} else {
+		resp = s.schemas.all()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// publishSchema registers the schema sent by a service instance in its hello,
+// and replicates it to the rest of the cluster if it has changed.
+func (s *Server) publishSchema(serviceID string, data []byte) error {
+	changed, err := s.schemas.set(serviceID, data)
+	if err != nil || !changed {
+		return err
+	}
+	if s.gateway != nil {
+		schema := s.schemas.get(serviceID)
+		for _, route := range s.gateway.routes {
+			if route.serviceID == serviceID && schema.Method(route.method) == nil {
+				log.Errorf("servicemanager: gateway route targets %s/%s, which isn't in its schema",
+					serviceID, route.method)
+			}
+		}
+	}
+	go func() {
+		err := s.cluster.PublishSchema(serviceID, data)
+		if err != nil {
+			log.Errorf("servicemanager: couldn't replicate schema for %s: %s", serviceID, err)
+		}
+	}()
+	return nil
+}
+
+// watchSchemas keeps the registry up to date with the schemas published by
+// other nodes.
+func (s *Server) watchSchemas() {
+	s.cluster.WatchSchemas(func(serviceID string, data []byte) {
+		_, err := s.schemas.set(serviceID, data)
+		if err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{
+		encoded: map[string][]byte{},
+		schemas: map[string]*rtproto.ServiceSchema{},
+	}
+}
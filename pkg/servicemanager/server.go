@@ -10,16 +10,30 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/tav/elko/pkg/compress"
+	"github.com/tav/elko/pkg/logstore"
+	rtproto "github.com/tav/elko/pkg/protocol"
 	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/elko/pkg/trace"
 	"github.com/tav/golly/log"
 )
 
+const (
+	defaultCallTimeout        = 10 * time.Second
+	defaultGatewayMaxBodySize = 8 << 20
+	defaultLeaseDuration      = 7 * time.Second
+	defaultMaxFrameSize       = 16 << 20
+)
+
 type serviceMap struct {
 	sync.RWMutex
+	deploys   map[string]uint64
 	instances map[uint64]*service
 	lastID    uint64
 	services  map[string][]*service
@@ -27,16 +41,55 @@ type serviceMap struct {
 
 // Server represents a service manager instance.
 type Server struct {
-	cluster interface {
-		Maintain()
+	acl      *accessControl
+	auth     []Authenticator
+	cache    *responseCache
+	capacity *capacityLog
+	certs    *certStore
+	cluster  interface {
+		Maintain(nodeID string, period time.Duration)
+		Nodes() ([]*NodeStatus, error)
+		PublishSchema(serviceID string, data []byte) error
+		PublishStatus(status *NodeStatus) error
+		WatchSchemas(update func(serviceID string, data []byte))
 	}
 	config     *Config
+	gateway    *gateway
+	inflight   *inflightSpans
+	listener   net.Listener
+	logs       *logstore.Store
 	nodeID     string
+	nodes      *nodeMap
+	processes  *processMap
 	queues     map[string][]*protocol.ClientRequest
+	schemas    *schemaRegistry
 	serviceMap *serviceMap
+	socket     net.Listener
+	tracer     *trace.Exporter
+}
+
+// ExpectProcess registers the PID of a service process spawned by a
+// supervisor. When Config.SocketVerifyPID is set, only registered processes
+// (or their descendants) can connect over the Unix socket, and only as the
+// service they were registered for.
+func (s *Server) ExpectProcess(pid int, serviceID string) {
+	s.processes.Lock()
+	s.processes.pids[pid] = serviceID
+	close(s.processes.registered)
+	s.processes.registered = make(chan struct{})
+	s.processes.Unlock()
+}
+
+// ForgetProcess removes a PID registered with ExpectProcess.
+func (s *Server) ForgetProcess(pid int) {
+	s.processes.Lock()
+	delete(s.processes.pids, pid)
+	s.processes.Unlock()
 }
 
-func (s *Server) handle(c net.Conn) {
+// handle dispatches a fresh connection based on its type. Local connections
+// are those accepted from the Unix socket.
+func (s *Server) handle(c net.Conn, local bool) {
 	c.SetReadDeadline(time.Now().Add(s.config.CallTimeout))
 	data := make([]byte, 1)
 	for {
@@ -53,44 +106,167 @@ func (s *Server) handle(c net.Conn) {
 	}
 	switch data[0] {
 	case 1:
+		if !local && s.config.SocketPath != "" {
+			log.Errorf("servicemanager: rejecting service connection from %s as services need to connect via %s",
+				c.RemoteAddr(), s.config.SocketPath)
+			c.Close()
+			return
+		}
 		go handleService(s, c)
 	case 2:
-		// handle node connection
+		if local {
+			log.Error("servicemanager: rejecting node connection over the Unix socket")
+			c.Close()
+			return
+		}
+		go handleNode(s, c)
 	default:
 		log.Errorf("servicemanager: unknown connection type: %q", data[0])
 		c.Close()
 	}
 }
 
+// Listen binds the service manager to the configured port and Unix socket.
+// Connections made once it has returned are handled when Run is called, so
+// supervisors can call it before starting the services which connect to the
+// service manager. Run calls it if it hasn't been called already.
+func (s *Server) Listen() error {
+	if s.listener != nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
+	if err != nil {
+		return err
+	}
+	if s.config.SocketPath != "" {
+		ul, err := listenSocket(s.config.SocketPath)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		s.socket = ul
+	}
+	s.listener = l
+	return nil
+}
+
 // Run binds the service manager to the configured port and starts handling
 // requests.
 func (s *Server) Run() error {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
+	err := s.Listen()
 	if err != nil {
 		return err
 	}
+	l := s.listener
 	defer l.Close()
+	if s.socket != nil {
+		defer s.socket.Close()
+		log.Infof("Service Manager is listening on %s", s.config.SocketPath)
+		go s.serveSocket(s.socket)
+	}
+	if s.config.AdminAddr != "" {
+		go s.serveAdmin()
+	}
+	if s.gateway != nil {
+		go s.serveGateway()
+	}
+	go s.cluster.Maintain(s.nodeID, s.config.LeaseDuration)
+	go s.connectNodes()
+	go s.reportStatus()
+	go s.watchSchemas()
 	log.Infof("Service Manager is listening on port %d", s.config.Port)
-	// go s.removeDeadServices()
+	go s.expireCalls()
+	go s.removeDeadServices()
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			return err
 		}
-		go s.handle(c)
+		go s.handle(c, false)
+	}
+}
+
+// removeDeadServices closes the connections of instances which haven't been
+// heard from within three heartbeat intervals, so that they are unbound and
+// stop being routed to.
+func (s *Server) removeDeadServices() {
+	if s.config.Heartbeat <= 0 {
+		return
+	}
+	timeout := 3 * s.config.Heartbeat
+	for range time.Tick(s.config.Heartbeat) {
+		var dead []*service
+		now := time.Now()
+		s.serviceMap.RLock()
+		for _, svc := range s.serviceMap.instances {
+			// The CLI doesn't send heartbeats while it waits on a call.
+			if svc.local != nil || svc.serviceID == cliServiceID {
+				continue
+			}
+			svc.RLock()
+			if now.Sub(svc.lastSeen) > timeout {
+				dead = append(dead, svc)
+			}
+			svc.RUnlock()
+		}
+		s.serviceMap.RUnlock()
+		for _, svc := range dead {
+			log.Errorf("servicemanager: closing connection to %s/%d as it has missed its heartbeats",
+				svc.serviceID, svc.id)
+			svc.close()
+		}
+	}
+}
+
+func (s *Server) serveSocket(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Errorf("servicemanager: couldn't accept connection on %s: %s", s.config.SocketPath, err)
+			return
+		}
+		go s.handle(c, true)
 	}
 }
 
 // New instantiates a service manager with the given config.
 func New(cfg *Config) (*Server, error) {
 	s := &Server{
-		config: cfg,
+		capacity: &capacityLog{},
+		config:   cfg,
+	}
+	// The call timeout also paces the loops that expire calls and spans, so
+	// it can't be left at zero.
+	if cfg.CallTimeout <= 0 {
+		cfg.CallTimeout = defaultCallTimeout
+	}
+	if cfg.CompressionThreshold <= 0 {
+		cfg.CompressionThreshold = compress.DefaultThreshold
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = defaultLeaseDuration
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = rtproto.DefaultMaxBodySize
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = defaultMaxFrameSize
+	}
+	if cfg.NodeAddr == "" && cfg.Port != 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		cfg.NodeAddr = net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+	}
+	if cfg.SpillThreshold <= 0 {
+		cfg.SpillThreshold = rtproto.DefaultSpillThreshold
 	}
 	switch cfg.ClusterType {
 	case "":
 		s.cluster = &SoloCluster{}
 	case "consul":
-		consul := &ConsulCluster{Servers: []string{}}
+		consul := &ConsulCluster{ID: cfg.ClusterID, Servers: []string{}}
 		if cfg.ClusterEndpoints == "" {
 			return nil, errors.New("servicemanager: missing --cluster-endpoints value")
 		}
@@ -109,6 +285,7 @@ func New(cfg *Config) (*Server, error) {
 		if len(consul.Servers) == 0 {
 			return nil, errors.New("servicemanager: empty list specified in --cluster-endpoints")
 		}
+		consul.connect()
 		s.cluster = consul
 	default:
 		return nil, fmt.Errorf("servicemanager: unknown cluster type: %q", cfg.ClusterType)
@@ -126,16 +303,95 @@ func New(cfg *Config) (*Server, error) {
 	default:
 		return nil, fmt.Errorf("servicemanager: unknown metadata server type: %q", cfg.HostMetadata)
 	}
-	id, err := genNodeID(idPrefix)
+	if cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSCA != "" {
+		certs, err := newCertStore(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.TLSReloadInterval <= 0 {
+			cfg.TLSReloadInterval = time.Minute
+		}
+		go certs.reloadLoop(cfg.TLSReloadInterval)
+		s.certs = certs
+	}
+	if s.certs != nil {
+		// The node's identity is bound to its certificate so that other nodes
+		// can verify it.
+		s.nodeID = s.certs.nodeID
+	} else {
+		id, err := genNodeID(idPrefix)
+		if err != nil {
+			return nil, err
+		}
+		s.nodeID = id
+	}
+	auth, err := newAuthenticators(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.auth = auth
+	acl, err := newAccessControl(cfg.ACL)
 	if err != nil {
 		return nil, err
 	}
-	s.nodeID = id
+	s.acl = acl
+	if (cfg.GatewayTLSCert == "") != (cfg.GatewayTLSKey == "") {
+		return nil, errors.New("servicemanager: both --gateway-tls-cert and --gateway-tls-key need to be set")
+	}
+	if cfg.GatewayMaxBodySize <= 0 {
+		cfg.GatewayMaxBodySize = defaultGatewayMaxBodySize
+	}
+	s.gateway, err = newGateway(cfg.Gateway, cfg.CallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if s.gateway != nil && cfg.GatewayCacheSize > 0 {
+		s.cache, err = newResponseCache(cfg.GatewayCacheDir, cfg.GatewayCacheSize,
+			cfg.GatewayCacheDiskSize, cfg.Gateway.Vary)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.nodes = &nodeMap{
+		conns: map[string]*node{},
+	}
+	s.processes = &processMap{
+		pids:       map[int]string{},
+		registered: make(chan struct{}),
+	}
 	s.queues = map[string][]*protocol.ClientRequest{}
+	if cfg.LogDir != "" {
+		s.logs, err = logstore.New(logstore.Config{
+			Dir:           cfg.LogDir,
+			Forward:       cfg.LogForward,
+			Level:         cfg.LogLevel,
+			MaxFileSize:   cfg.LogMaxFileSize,
+			MaxFiles:      cfg.LogMaxFiles,
+			SamplePercent: cfg.LogSamplePercent,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.inflight = &inflightSpans{
+		spans: map[callKey]*trace.Span{},
+	}
+	if cfg.TraceExport != "" {
+		s.tracer, err = trace.NewExporter("elko-servicemanager", cfg.TraceExport, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		go s.expireSpans()
+	}
+	s.schemas = newSchemaRegistry()
 	s.serviceMap = &serviceMap{
+		deploys:   map[string]uint64{},
 		instances: map[uint64]*service{},
 		services:  map[string][]*service{},
 	}
+	if s.gateway != nil {
+		s.serviceMap.instances[gatewayInstanceID] = s.gateway.svc
+	}
 	return s, nil
 }
 
@@ -4,35 +4,113 @@
 package servicemanager
 
 import (
-	"encoding/binary"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 
+	"github.com/tav/elko/pkg/compress"
+	rtproto "github.com/tav/elko/pkg/protocol"
 	"github.com/tav/elko/pkg/servicemanager/protocol"
 	"github.com/tav/golly/log"
 )
 
+// Connections from the elko CLI, e.g. for elko call, use this service ID. They
+// can make calls, subject to the ACLs, but can't be called.
+const cliServiceID = "elko.cli"
+
+var errUndelivered = errors.New("servicemanager: message could not be delivered")
+
+// frame is a frame queued for writing to a service. Frames for spilled messages
+// are written with chunked transfer, with buf holding the start of the message
+// and the rest being read from the spilled body.
+type frame struct {
+	buf     []byte
+	opcode  protocol.OP
+	sent    func()
+	spilled *spilled
+}
+
 type service struct {
 	sync.RWMutex
-	closed   bool
-	conn     net.Conn
-	key      []byte
-	outgoing [][]byte
-	pending  chan []byte
-	timeout  time.Duration
+	calls     map[callKey]*call
+	closed    bool
+	codec     compress.Codec
+	conn      net.Conn
+	deployID  uint64
+	done      chan struct{}
+	draining  bool
+	id        uint64
+	inflight  int
+	key       []byte
+	lastSeen  time.Time
+	local     func(opcode protocol.OP, msg proto.Message) bool
+	methods   []string
+	outgoing  [][]byte
+	pending   chan *frame
+	pid       int
+	runtime   string
+	serviceID string
+	socket    bool
+	stopping  bool
+	threshold int
+	timeout   time.Duration
+	version   string
 }
 
 func (s *service) close() {
 	s.Lock()
-	s.conn.Close()
-	s.closed = true
+	if !s.closed {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		if s.done != nil {
+			close(s.done)
+		}
+		s.closed = true
+	}
 	s.Unlock()
 }
 
+// drain discards any queued frames, removing their spilled bodies.
+func (s *service) drain() {
+	for {
+		select {
+		case f := <-s.pending:
+			f.spilled.close()
+		default:
+			return
+		}
+	}
+}
+
+// enqueue queues the frame for the write loop. It returns false if the
+// connection has been closed, in which case the frame is discarded.
+func (s *service) enqueue(f *frame) bool {
+	select {
+	case s.pending <- f:
+	case <-s.done:
+		f.spilled.close()
+		return false
+	}
+	// The write loop drains the queue once the connection is closed, but could
+	// have done so before the frame was queued.
+	select {
+	case <-s.done:
+		s.drain()
+		return false
+	default:
+		return true
+	}
+}
+
 func (s *service) opcodeError(opcode protocol.OP, err error) {
 	log.Errorf("servicemanager: got error decoding %s: %s", opcode, err)
 	s.close()
@@ -45,115 +123,292 @@ func (s *service) isClosed() bool {
 	return closed
 }
 
-func (s *service) read(buf []byte, size int) error {
-	total := 0
-	for {
-		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
-		n, err := s.conn.Read(buf)
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok {
-				if nerr.Timeout() {
-					continue
-				}
-			}
-			return fmt.Errorf("servicemanager: got error when reading service connection: %s", err)
-		}
-		total += n
-		if total == size {
-			return nil
-		}
-	}
-}
-
+// heartbeat records that the instance is alive. Any message from the instance
+// counts, so that busy instances don't need to send heartbeats as well.
 func (s *service) heartbeat() {
+	s.Lock()
+	s.lastSeen = time.Now()
+	s.Unlock()
 }
 
 func (s *service) write(opcode protocol.OP, msg proto.Message) error {
+	return s.send(opcode, msg, nil)
+}
+
+// send queues the message for writing. If sent is not nil, it is called once
+// the message has been written to the connection. Messages for callers within
+// the service manager itself, e.g. the gateway, are handed over directly.
+func (s *service) send(opcode protocol.OP, msg proto.Message, sent func()) error {
+	if s.local != nil {
+		if !s.local(opcode, msg) {
+			return errUndelivered
+		}
+		if sent != nil {
+			sent()
+		}
+		return nil
+	}
 	data, err := proto.Marshal(msg)
 	if err != nil {
 		log.Errorf("servicemanager: got error encoding %s: %s", opcode, err)
 		s.close()
 		return err
 	}
-	dataLen := len(data)
-	buf := make([]byte, 13+dataLen)
-	buf[0] = byte(opcode)
-	binary.BigEndian.PutUint32(buf[1:], uint32(dataLen))
-	copy(buf[5:], data)
-	s.pending <- buf
+	s.RLock()
+	codec, key, threshold := s.codec, s.key, s.threshold
+	s.RUnlock()
+	data, flags, err := rtproto.CompressFrame(codec, threshold, data)
+	if err != nil {
+		log.Errorf("servicemanager: got error compressing %s: %s", opcode, err)
+		s.close()
+		return err
+	}
+	if !s.enqueue(&frame{
+		buf:  rtproto.AppendFrame(nil, key, byte(opcode), data, flags),
+		sent: sent,
+	}) {
+		return errUndelivered
+	}
 	return nil
 }
 
+// sendSpilled queues a message whose data continues from head into a spilled
+// body, which is closed once it has been written. It can't be used for callers
+// within the service manager itself.
+func (s *service) sendSpilled(opcode protocol.OP, head []byte, data *spilled, sent func()) {
+	s.enqueue(&frame{
+		buf:     head,
+		opcode:  opcode,
+		sent:    sent,
+		spilled: data,
+	})
+}
+
+// writeLoop writes queued frames to the connection until it is closed.
+func (s *service) writeLoop() {
+	var err error
+	for {
+		var f *frame
+		select {
+		case <-s.done:
+			s.drain()
+			return
+		case f = <-s.pending:
+		}
+		if f.spilled != nil {
+			err = s.writeSpilled(f)
+		} else {
+			s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+			_, err = s.conn.Write(f.buf)
+		}
+		if err != nil {
+			log.Errorf("servicemanager: got error when writing to service connection: %s", err)
+			s.close()
+			s.drain()
+			return
+		}
+		if f.sent != nil {
+			f.sent()
+		}
+	}
+}
+
+// writeSpilled writes the frame using chunked transfer, with the write deadline
+// being extended for each chunk.
+func (s *service) writeSpilled(f *frame) error {
+	defer f.spilled.close()
+	s.RLock()
+	key := s.key
+	s.RUnlock()
+	w := rtproto.NewFrameWriter(s.conn)
+	w.SetKey(key)
+	err := w.WriteStream(byte(f.opcode), io.MultiReader(bytes.NewReader(f.buf), f.spilled.reader()), func() {
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
 func handleService(s *Server, conn net.Conn) {
+	var msgData []byte
 	opcode := protocol.OP(0)
-	dataBuf := make([]byte, 4096)
-	dataLen := 0
-	headerBuf := make([]byte, 5)
-	hashBuf := make([]byte, 8)
 	seen := false
 	log.Info("Received client connection")
 	svc := &service{
-		conn:    conn,
-		pending: make(chan []byte, 100),
-		timeout: s.config.CallTimeout,
+		conn:      conn,
+		done:      make(chan struct{}),
+		pending:   make(chan *frame, 100),
+		threshold: s.config.CompressionThreshold,
+		timeout:   s.config.CallTimeout,
 	}
 	var err error
+	if _, ok := conn.(*net.UnixConn); ok {
+		svc.socket = true
+		svc.pid, err = peerPID(conn)
+		if err != nil {
+			log.Errorf("servicemanager: couldn't get peer credentials for service connection: %s", err)
+			conn.Close()
+			return
+		}
+	}
+	// Services are allowed to sit idle, so the deadline set when the
+	// connection type was read is cleared.
+	conn.SetReadDeadline(time.Time{})
+	// Chunked messages beyond the spill threshold are spooled to disk, and
+	// forwarded from there.
+	r := rtproto.NewFrameReader(conn, rtproto.Limits{
+		MaxBodySize:    s.config.MaxBodySize,
+		MaxFrameSize:   uint32(s.config.MaxFrameSize),
+		SpillThreshold: s.config.SpillThreshold,
+	})
+	defer s.serviceMap.unbind(svc)
+	go svc.writeLoop()
 	for {
-		err = svc.read(headerBuf, 5)
+		op, body, err := r.Read(true)
 		if err != nil {
-			log.Error(err)
+			if !svc.isClosed() {
+				log.Errorf("servicemanager: got error when reading service connection: %s", err)
+				svc.close()
+			}
+			return
+		}
+		opcode = protocol.OP(op)
+		msgData = body.Bytes()
+		svc.heartbeat()
+		if body.Spilled() {
+			if seen && (opcode == protocol.OP_CLIENT_REQUEST || opcode == protocol.OP_CLIENT_RESPONSE) {
+				err = s.handleSpilled(svc, opcode, body)
+				if err != nil {
+					svc.opcodeError(opcode, err)
+					return
+				}
+				continue
+			}
+			body.Close()
+			log.Errorf("servicemanager: received %s from %s/%d that is too large", opcode, svc.serviceID, svc.id)
+			svc.close()
 			return
 		}
-		opcode = protocol.OP(headerBuf[0])
 		if !seen {
 			if opcode != protocol.OP_CLIENT_HELLO {
 				log.Errorf("servicemanager: received %s when expecting CLIENT_HELLO as first message", opcode)
 				svc.close()
 				return
 			}
-		}
-		dataLen = int(binary.BigEndian.Uint32(headerBuf[1:]))
-		if dataLen > cap(dataBuf) {
-			dataBuf = make([]byte, dataLen)
-		}
-		err = svc.read(dataBuf[:dataLen], dataLen)
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		err = svc.read(hashBuf, 8)
-		if err != nil {
-			log.Error(err)
+		} else if opcode == protocol.OP_CLIENT_HELLO {
+			log.Errorf("servicemanager: received CLIENT_HELLO from %s/%d after the hello exchange", svc.serviceID, svc.id)
+			svc.close()
 			return
 		}
 		switch opcode {
 		case protocol.OP_CLIENT_HEARTBEAT:
-			svc.heartbeat()
+			// The heartbeat has already been recorded above.
 		case protocol.OP_CLIENT_HELLO:
 			msg := &protocol.ClientHello{}
-			err := proto.Unmarshal(dataBuf[:dataLen], msg)
+			err := proto.Unmarshal(msgData, msg)
 			if err != nil {
 				svc.opcodeError(opcode, err)
 				return
 			}
-			fmt.Println(msg)
+			err = validateHello(msg)
+			if err != nil {
+				log.Error(err)
+				svc.close()
+				return
+			}
+			// The hello is hashed with the key derived from the service ID it
+			// carries, so it can only be verified once it has been decoded.
+			err = r.SetKey(rtproto.Key(msg.ServiceID))
+			if err != nil {
+				svc.opcodeError(opcode, err)
+				return
+			}
+			version, err := rtproto.NegotiateVersion(msg.ProtocolVersion)
+			if err != nil {
+				log.Error(err)
+				svc.close()
+				return
+			}
+			err = s.verifyPeer(svc, msg.ServiceID)
+			if err != nil {
+				log.Error(err)
+				svc.close()
+				return
+			}
+			svc.Lock()
+			svc.deployID = msg.DeployID
+			svc.key = rtproto.Key(msg.ServiceID)
+			svc.methods = msg.Methods
+			svc.runtime = msg.Runtime
+			svc.version = msg.Version
+			svc.Unlock()
+			if len(msg.Schema) > 0 {
+				err = s.publishSchema(msg.ServiceID, msg.Schema)
+				if err != nil {
+					log.Error(err)
+					svc.close()
+					return
+				}
+			}
+			instanceID, err := s.serviceMap.bind(svc, msg.ServiceID, msg.InstanceID)
+			if err != nil {
+				log.Error(err)
+				svc.close()
+				return
+			}
+			log.Infof("Registered %s instance %d (version: %q, runtime: %q, methods: %d)",
+				msg.ServiceID, instanceID, msg.Version, msg.Runtime, len(msg.Methods))
+			s.drainSuperseded(msg.ServiceID)
+			codec := compress.Negotiate(s.config.Compression, msg.Compression)
+			reply := &protocol.ServerHello{
+				Heartbeat:       ptypes.DurationProto(s.config.Heartbeat),
+				InstanceID:      instanceID,
+				MaxFrameSize:    uint32(s.config.MaxFrameSize),
+				ProtocolVersion: version,
+			}
+			if codec != nil {
+				reply.Compression = codec.Name()
+				reply.CompressionThreshold = uint32(svc.threshold)
+			}
+			err = svc.write(protocol.OP_SERVER_HELLO, reply)
+			if err != nil {
+				return
+			}
+			// The hello reply is always sent uncompressed.
+			svc.Lock()
+			svc.codec = codec
+			svc.Unlock()
+			r.SetCodec(codec)
+			seen = true
 		case protocol.OP_CLIENT_REQUEST:
 			msg := &protocol.ClientRequest{}
-			err := proto.Unmarshal(dataBuf[:dataLen], msg)
+			err := proto.Unmarshal(msgData, msg)
 			if err != nil {
 				svc.opcodeError(opcode, err)
 				return
 			}
+			s.route(svc, msg, nil)
 		case protocol.OP_CLIENT_RESPONSE:
 			msg := &protocol.ClientResponse{}
-			err := proto.Unmarshal(dataBuf[:dataLen], msg)
+			err := proto.Unmarshal(msgData, msg)
+			if err != nil {
+				svc.opcodeError(opcode, err)
+				return
+			}
+			s.forward(svc, msg)
+		case protocol.OP_CLIENT_STREAM:
+			msg := &protocol.ClientStream{}
+			err := proto.Unmarshal(msgData, msg)
 			if err != nil {
 				svc.opcodeError(opcode, err)
 				return
 			}
+			s.forwardStream(svc, msg)
 		case protocol.OP_CLIENT_SHUTDOWN:
 			msg := &protocol.ClientShutdown{}
-			err := proto.Unmarshal(dataBuf[:dataLen], msg)
+			err := proto.Unmarshal(msgData, msg)
 			if err != nil {
 				svc.opcodeError(opcode, err)
 				return
@@ -168,15 +423,24 @@ func handleService(s *Server, conn net.Conn) {
 	}
 }
 
-func isValidServiceID(id string) bool {
-	if id == "" {
-		return false
+// validateHello checks the identity and metadata that a service claims in its
+// hello, before anything else is done with it.
+func validateHello(msg *protocol.ClientHello) error {
+	if !rtproto.IsValidServiceID(msg.ServiceID) {
+		return fmt.Errorf("servicemanager: invalid service ID in CLIENT_HELLO: %q", msg.ServiceID)
+	}
+	if rtproto.IsBuiltinServiceID(msg.ServiceID) {
+		return fmt.Errorf("servicemanager: service ID %s is reserved for a builtin service", msg.ServiceID)
 	}
-	for _, char := range id {
-		if (char >= 'a' && char <= 'z') || char == '.' || (char >= '0' && char <= '9') {
-			continue
+	seen := map[string]bool{}
+	for _, method := range msg.Methods {
+		if method == "" || strings.ContainsAny(method, "/ ") {
+			return fmt.Errorf("servicemanager: invalid method name for %s in CLIENT_HELLO: %q", msg.ServiceID, method)
 		}
-		return false
+		if seen[method] {
+			return fmt.Errorf("servicemanager: duplicate method name for %s in CLIENT_HELLO: %q", msg.ServiceID, method)
+		}
+		seen[method] = true
 	}
-	return true
+	return nil
 }
@@ -0,0 +1,97 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const maxProcessDepth = 8
+
+// Supervisors can only register a process once it has started, so processes
+// which connect before then are given a short while to be registered.
+const lookupTimeout = time.Second
+
+type processMap struct {
+	sync.RWMutex
+	pids       map[int]string
+	registered chan struct{}
+}
+
+// lookup returns the service ID registered for the given PID or its closest
+// registered ancestor, as runtimes may be launched via wrapper scripts. If
+// there is none, it also returns a channel which is closed once another
+// process is registered.
+func (p *processMap) lookup(pid int) (string, bool, <-chan struct{}) {
+	p.RLock()
+	defer p.RUnlock()
+	for i := 0; i < maxProcessDepth && pid > 1; i++ {
+		if id, ok := p.pids[pid]; ok {
+			return id, true, nil
+		}
+		ppid, err := parentPID(pid)
+		if err != nil {
+			break
+		}
+		pid = ppid
+	}
+	return "", false, p.registered
+}
+
+func listenSocket(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("servicemanager: refusing to replace non-socket file at %s", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Access is restricted to the user running the service manager. The socket
+	// is created with these permissions, via the umask, as other users could
+	// otherwise connect before it is chmod-ed.
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// verifyPeer checks that the process on the other end of a Unix socket
+// connection is allowed to register as the given service. The CLI isn't spawned
+// by the supervisor, and is let through, as it can't be called.
+func (s *Server) verifyPeer(svc *service, serviceID string) error {
+	if svc.pid == 0 || !s.config.SocketVerifyPID || serviceID == cliServiceID {
+		return nil
+	}
+	timeout := time.NewTimer(lookupTimeout)
+	defer timeout.Stop()
+	expected, ok, registered := s.processes.lookup(svc.pid)
+	for !ok {
+		select {
+		case <-registered:
+		case <-svc.done:
+			return fmt.Errorf("servicemanager: process %d disconnected before it was verified", svc.pid)
+		case <-timeout.C:
+			return fmt.Errorf("servicemanager: process %d was not spawned by the supervisor", svc.pid)
+		}
+		expected, ok, registered = s.processes.lookup(svc.pid)
+	}
+	if expected != serviceID {
+		return fmt.Errorf("servicemanager: process %d was spawned for %q but registered as %q",
+			svc.pid, expected, serviceID)
+	}
+	return nil
+}
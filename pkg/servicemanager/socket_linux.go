@@ -0,0 +1,56 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+func parentPID(pid int) (int, error) {
+	out, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, so skip past its closing paren.
+	idx := bytes.LastIndexByte(out, ')')
+	if idx == -1 {
+		return 0, fmt.Errorf("servicemanager: unable to parse /proc/%d/stat", pid)
+	}
+	fields := bytes.Fields(out[idx+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("servicemanager: unable to parse /proc/%d/stat", pid)
+	}
+	return strconv.Atoi(string(fields[1]))
+}
+
+func peerPID(c net.Conn) (int, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, errors.New("servicemanager: peer credentials are only available for Unix sockets")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		cred *syscall.Ucred
+		cerr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if cerr != nil {
+		return 0, cerr
+	}
+	return int(cred.Pid), nil
+}
@@ -0,0 +1,85 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elko-socket-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "elko.sock")
+	l, err := listenSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("got socket permissions %o, want 600", perm)
+	}
+	// Files which aren't sockets are never replaced.
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenSocket(file); err == nil {
+		t.Errorf("expected an error when listening on a regular file")
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	pid := os.Getpid()
+	for _, tt := range []struct {
+		name     string
+		register string
+		delay    time.Duration
+		ok       bool
+	}{
+		{"registered", "billing", 0, true},
+		{"registered later", "billing", 50 * time.Millisecond, true},
+		{"registered as another service", "users", 0, false},
+		{"unregistered", "", 0, false},
+	} {
+		s := &Server{
+			config: &Config{SocketVerifyPID: true},
+			processes: &processMap{
+				pids:       map[int]string{},
+				registered: make(chan struct{}),
+			},
+		}
+		if tt.register != "" {
+			if tt.delay == 0 {
+				s.ExpectProcess(pid, tt.register)
+			} else {
+				go func(serviceID string, delay time.Duration) {
+					time.Sleep(delay)
+					// Registrations of other processes don't let it through.
+					s.ExpectProcess(1<<30, "other")
+					s.ExpectProcess(pid, serviceID)
+				}(tt.register, tt.delay)
+			}
+		}
+		start := time.Now()
+		err := s.verifyPeer(&service{done: make(chan struct{}), pid: pid}, "billing")
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: got error %v, want success to be %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && time.Since(start) >= lookupTimeout {
+			t.Errorf("%s: verification waited for the lookup timeout", tt.name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+)
+
+// Wire types used in the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Numbers of the fields in proto/protocol.proto that can hold large messages.
+const (
+	fieldClientRequestParam    = 8
+	fieldClientResponseMessage = 3
+	fieldServerRequestMessage  = 3
+	fieldServerResponseResult  = 2
+)
+
+var errTruncatedMessage = errors.New("servicemanager: truncated message in chunked frame")
+
+// spilled refers to a length-delimited field within a chunked message that has
+// been spilled to disk. Large request params and responses are forwarded from
+// the spilled body, instead of being read into memory.
+type spilled struct {
+	body  *rtproto.Body
+	end   int64
+	start int64
+}
+
+// close removes the spilled body. It is safe to call on a nil value.
+func (s *spilled) close() {
+	if s != nil {
+		s.body.Close()
+	}
+}
+
+func (s *spilled) len() int64 {
+	return s.end - s.start
+}
+
+func (s *spilled) reader() io.Reader {
+	return io.NewSectionReader(s.body, s.start, s.len())
+}
+
+// appendField appends the key and length of a length-delimited field to buf.
+// The field's data needs to follow.
+func appendField(buf []byte, field int, size int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(field)<<3|wireBytes)
+	buf = append(buf, tmp[:n]...)
+	n = binary.PutUvarint(tmp[:], uint64(size))
+	return append(buf, tmp[:n]...)
+}
+
+func readAt(r io.ReaderAt, buf []byte, off int64) (int64, error) {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return int64(n), nil
+	}
+	if err == nil || err == io.EOF {
+		err = errTruncatedMessage
+	}
+	return int64(n), err
+}
+
+func readUvarint(r io.ReaderAt, off int64, end int64) (uint64, int64, error) {
+	var buf [binary.MaxVarintLen64]byte
+	size := int64(len(buf))
+	if end-off < size {
+		size = end - off
+	}
+	n, err := r.ReadAt(buf[:size], off)
+	if n == 0 && err != nil {
+		return 0, 0, err
+	}
+	v, read := binary.Uvarint(buf[:n])
+	if read <= 0 {
+		return 0, 0, errTruncatedMessage
+	}
+	return v, int64(read), nil
+}
+
+// splitMessage scans the protobuf message held in [start, end) of the body.
+// The given length-delimited field is returned as a reference into the body,
+// while the other fields are copied into head, so that they can be decoded on
+// their own. The head is limited to max bytes.
+func splitMessage(body *rtproto.Body, start int64, end int64, field int, max int) ([]byte, *spilled, error) {
+	var (
+		head []byte
+		ref  *spilled
+	)
+	off := start
+	for off < end {
+		key, n, err := readUvarint(body, off, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		next := off + n
+		switch key & 7 {
+		case wireVarint:
+			_, n, err = readUvarint(body, next, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			next += n
+		case wireFixed64:
+			next += 8
+		case wireBytes:
+			size, n, err := readUvarint(body, next, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			next += n
+			if size > uint64(end-next) {
+				return nil, nil, errTruncatedMessage
+			}
+			if int(key>>3) == field {
+				if ref != nil {
+					return nil, nil, fmt.Errorf("servicemanager: field %d is repeated in chunked frame", field)
+				}
+				ref = &spilled{body: body, end: next + int64(size), start: next}
+				off = ref.end
+				continue
+			}
+			next += int64(size)
+		case wireFixed32:
+			next += 4
+		default:
+			return nil, nil, fmt.Errorf("servicemanager: unsupported wire type %d in chunked frame", key&7)
+		}
+		if next > end {
+			return nil, nil, errTruncatedMessage
+		}
+		if int64(len(head))+next-off > int64(max) {
+			return nil, nil, fmt.Errorf("servicemanager: fields other than %d exceed %d bytes in chunked frame", field, max)
+		}
+		buf := make([]byte, next-off)
+		_, err = readAt(body, buf, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		head = append(head, buf...)
+		off = next
+	}
+	return head, ref, nil
+}
+
+// handleSpilled routes a request or response that was spilled to disk. Only
+// the small fields are decoded, and the serviceParam of a request, or the
+// encoded ServerResponse within a response, is forwarded from the body.
+func (s *Server) handleSpilled(from *service, opcode protocol.OP, body *rtproto.Body) error {
+	max := s.config.MaxFrameSize
+	if opcode == protocol.OP_CLIENT_REQUEST {
+		req := &protocol.ClientRequest{}
+		head, param, err := splitMessage(body, 0, body.Len(), fieldClientRequestParam, max)
+		if err == nil {
+			err = proto.Unmarshal(head, req)
+		}
+		if err != nil {
+			body.Close()
+			return err
+		}
+		if param == nil {
+			body.Close()
+		}
+		s.route(from, req, param)
+		return nil
+	}
+	resp := &protocol.ClientResponse{}
+	head, data, err := splitMessage(body, 0, body.Len(), fieldClientResponseMessage, max)
+	if err == nil {
+		err = proto.Unmarshal(head, resp)
+	}
+	if err == nil && data == nil {
+		err = errors.New("servicemanager: missing message in chunked CLIENT_RESPONSE")
+	}
+	msg := &protocol.ServerResponse{}
+	if err == nil {
+		// The result is skipped, as only the ID and error code of the response
+		// are needed to route it.
+		head, _, err = splitMessage(body, data.start, data.end, fieldServerResponseResult, max)
+		if err == nil {
+			err = proto.Unmarshal(head, msg)
+		}
+	}
+	if err != nil {
+		body.Close()
+		return err
+	}
+	s.relay(from, resp, msg, data)
+	return nil
+}
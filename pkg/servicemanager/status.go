@@ -0,0 +1,181 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tav/elko/pkg/capacity"
+	"github.com/tav/golly/log"
+)
+
+// Capacity readings are taken as the 95th percentile of the load over the
+// past hour. The most recent readings are kept so that trends are visible in
+// elko status.
+const (
+	capacityInterval   = 15 * time.Second
+	capacityPercentile = 0.95
+	capacityReadings   = 8
+)
+
+// Nodes publish their status to the cluster at statusInterval. Nodes whose
+// status is older than staleNodeAge are assumed to have gone away.
+const (
+	staleNodeAge   = time.Minute
+	statusInterval = 10 * time.Second
+)
+
+// CapacityReading is a reading of the CPU and memory load on a node.
+type CapacityReading struct {
+	CPU       float64   `json:"cpu"`
+	Mem       float64   `json:"mem"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// InstanceStatus describes a service instance connected to a node. Queued is
+// the number of messages waiting to be written to the instance.
+type InstanceStatus struct {
+	HeartbeatAge  time.Duration `json:"heartbeat_age"`
+	ID            uint64        `json:"id"`
+	LastHeartbeat time.Time     `json:"last_heartbeat"`
+	Queued        int           `json:"queued"`
+	Service       string        `json:"service"`
+	Version       string        `json:"version,omitempty"`
+}
+
+// NodeStatus describes a node in the cluster. Addr is where other nodes can
+// connect to it. Lease is the state of the node's lease, and is empty for solo
+// nodes, which don't hold one. Services maps the services on the node to their
+// number of instances.
+type NodeStatus struct {
+	Addr      string            `json:"addr,omitempty"`
+	Capacity  []CapacityReading `json:"capacity"`
+	ID        string            `json:"id"`
+	Instances []*InstanceStatus `json:"instances"`
+	Lease     string            `json:"lease,omitempty"`
+	Services  map[string]int    `json:"services"`
+	Updated   time.Time         `json:"updated"`
+}
+
+// Status is the overview of the cluster served by the admin API's /status
+// endpoint. NodeID is the ID of the node which served it.
+type Status struct {
+	ClusterID string        `json:"cluster_id"`
+	NodeID    string        `json:"node_id"`
+	Nodes     []*NodeStatus `json:"nodes"`
+}
+
+type capacityLog struct {
+	mu       sync.Mutex
+	readings []CapacityReading
+}
+
+func (c *capacityLog) add(cpu float64, mem float64, timestamp time.Time) {
+	c.mu.Lock()
+	c.readings = append(c.readings, CapacityReading{CPU: cpu, Mem: mem, Timestamp: timestamp})
+	if len(c.readings) > capacityReadings {
+		c.readings = c.readings[len(c.readings)-capacityReadings:]
+	}
+	c.mu.Unlock()
+}
+
+func (c *capacityLog) recent() []CapacityReading {
+	c.mu.Lock()
+	readings := append([]CapacityReading{}, c.readings...)
+	c.mu.Unlock()
+	return readings
+}
+
+// handleStatus serves the status of this node, along with that of the other
+// nodes in the cluster, as last published by them.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := &Status{
+		ClusterID: s.config.ClusterID,
+		NodeID:    s.nodeID,
+		Nodes:     []*NodeStatus{},
+	}
+	nodes, err := s.cluster.Nodes()
+	if err != nil {
+		log.Errorf("servicemanager: couldn't get the status of the nodes in the cluster: %s", err)
+	}
+	local := s.nodeStatus()
+	now := time.Now()
+	for _, node := range nodes {
+		if node.ID == s.nodeID {
+			local.Lease = node.Lease
+			continue
+		}
+		if now.Sub(node.Updated) > staleNodeAge {
+			continue
+		}
+		status.Nodes = append(status.Nodes, node)
+	}
+	status.Nodes = append(status.Nodes, local)
+	for _, node := range status.Nodes {
+		for _, inst := range node.Instances {
+			inst.HeartbeatAge = now.Sub(inst.LastHeartbeat)
+		}
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].ID < status.Nodes[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// nodeStatus returns the current status of this node.
+func (s *Server) nodeStatus() *NodeStatus {
+	status := &NodeStatus{
+		Addr:      s.config.NodeAddr,
+		Capacity:  s.capacity.recent(),
+		ID:        s.nodeID,
+		Instances: []*InstanceStatus{},
+		Services:  map[string]int{},
+		Updated:   time.Now().UTC(),
+	}
+	s.serviceMap.RLock()
+	for serviceID, instances := range s.serviceMap.services {
+		for _, svc := range instances {
+			if svc.isClosed() {
+				continue
+			}
+			svc.RLock()
+			status.Instances = append(status.Instances, &InstanceStatus{
+				ID:            svc.id,
+				LastHeartbeat: svc.lastSeen,
+				Queued:        len(svc.pending),
+				Service:       serviceID,
+				Version:       svc.version,
+			})
+			svc.RUnlock()
+			status.Services[serviceID]++
+		}
+	}
+	s.serviceMap.RUnlock()
+	sort.Slice(status.Instances, func(i, j int) bool {
+		a, b := status.Instances[i], status.Instances[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.ID < b.ID
+	})
+	return status
+}
+
+// reportStatus takes capacity readings and publishes the status of this node
+// to the cluster. It doesn't return.
+func (s *Server) reportStatus() {
+	go capacity.Monitor(capacityPercentile, capacityInterval, s.capacity.add)
+	for {
+		err := s.cluster.PublishStatus(s.nodeStatus())
+		if err != nil {
+			log.Errorf("servicemanager: couldn't publish the status of node %s: %s", s.nodeID, err)
+		}
+		time.Sleep(statusInterval)
+	}
+}
@@ -0,0 +1,199 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tav/elko/pkg/devcert"
+	"github.com/tav/golly/log"
+)
+
+// certStore holds the node's TLS certificate and the CA pool used to
+// authenticate other nodes. Both are reloaded from disk whenever the
+// underlying files change.
+type certStore struct {
+	mu       sync.RWMutex
+	caFile   string
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	modTimes [3]time.Time
+	nodeID   string
+	pool     *x509.CertPool
+}
+
+func (c *certStore) certificate() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	cert, pool := c.cert, c.pool
+	c.mu.RUnlock()
+	return cert, pool
+}
+
+// clientConfig returns the config for dialing the node with the given ID.
+// Verification is done manually as node certificates are bound to node IDs
+// through URI SANs rather than hostnames.
+func (c *certStore) clientConfig(nodeID string) *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.certificate()
+			return cert, nil
+		},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := c.certificate()
+			id, err := verifyNodeCert(raw, pool, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return err
+			}
+			if id != nodeID {
+				return fmt.Errorf("servicemanager: expected certificate for node %q, got %q", nodeID, id)
+			}
+			return nil
+		},
+	}
+}
+
+func (c *certStore) load() (bool, error) {
+	var modTimes [3]time.Time
+	for i, path := range []string{c.caFile, c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	c.mu.RLock()
+	unchanged := modTimes == c.modTimes
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	caPEM, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return false, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return false, fmt.Errorf("servicemanager: no certificates found in %s", c.caFile)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	id, err := nodeIDFromCert(leaf)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodeID != "" && c.nodeID != id {
+		return false, fmt.Errorf(
+			"servicemanager: reloaded certificate is for node %q instead of %q", id, c.nodeID)
+	}
+	cert.Leaf = leaf
+	c.cert = &cert
+	c.modTimes = modTimes
+	c.nodeID = id
+	c.pool = pool
+	return true, nil
+}
+
+func (c *certStore) reloadLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		reloaded, err := c.load()
+		if err != nil {
+			log.Errorf("servicemanager: couldn't reload TLS certificates: %s", err)
+			continue
+		}
+		if reloaded {
+			log.Info("Reloaded TLS certificates")
+		}
+	}
+}
+
+func (c *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := c.certificate()
+			return cert, nil
+		},
+		MinVersion: tls.VersionTLS12,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := c.certificate()
+			_, err := verifyNodeCert(raw, pool, x509.ExtKeyUsageClientAuth)
+			return err
+		},
+	}
+}
+
+func newCertStore(caFile string, certFile string, keyFile string) (*certStore, error) {
+	if caFile == "" || certFile == "" || keyFile == "" {
+		return nil, errors.New("servicemanager: all of --tls-ca, --tls-cert and --tls-key need to be specified")
+	}
+	c := &certStore{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	_, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func nodeIDFromCert(cert *x509.Certificate) (string, error) {
+	for _, uri := range cert.URIs {
+		id := strings.TrimPrefix(uri.String(), devcert.NodeURIPrefix)
+		if id != uri.String() && id != "" {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("servicemanager: certificate %q has no %s URI SAN", cert.Subject.CommonName, devcert.NodeURIPrefix)
+}
+
+// verifyNodeCert verifies the peer's certificate chain against the CA pool and
+// returns the node ID that it is bound to.
+func verifyNodeCert(raw [][]byte, pool *x509.CertPool, usage x509.ExtKeyUsage) (string, error) {
+	if len(raw) == 0 {
+		return "", errors.New("servicemanager: peer did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+		Roots:         pool,
+	})
+	if err != nil {
+		return "", err
+	}
+	return nodeIDFromCert(certs[0])
+}
@@ -0,0 +1,71 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tav/elko/pkg/trace"
+)
+
+type callKey struct {
+	id       uint64
+	instance uint64
+}
+
+// inflightSpans tracks the execution spans of requests which are awaiting a
+// response from the target service.
+type inflightSpans struct {
+	sync.Mutex
+	spans map[callKey]*trace.Span
+}
+
+func (m *inflightSpans) add(key callKey, span *trace.Span) {
+	m.Lock()
+	m.spans[key] = span
+	m.Unlock()
+}
+
+func (m *inflightSpans) remove(key callKey) *trace.Span {
+	m.Lock()
+	span := m.spans[key]
+	delete(m.spans, key)
+	m.Unlock()
+	return span
+}
+
+// started resets the start of an execution span to when the request was
+// actually written to the target service.
+func (m *inflightSpans) started(key callKey) {
+	m.Lock()
+	if span, ok := m.spans[key]; ok {
+		span.Start = time.Now()
+	}
+	m.Unlock()
+}
+
+// expireSpans records the execution spans of requests which have gone
+// unanswered for too long, so that they aren't held onto forever.
+func (s *Server) expireSpans() {
+	timeout := 2 * s.config.CallTimeout
+	for {
+		time.Sleep(s.config.CallTimeout)
+		cutoff := time.Now().Add(-timeout)
+		expired := []*trace.Span{}
+		s.inflight.Lock()
+		for key, span := range s.inflight.spans {
+			if span.Start.Before(cutoff) {
+				delete(s.inflight.spans, key)
+				expired = append(expired, span)
+			}
+		}
+		s.inflight.Unlock()
+		for _, span := range expired {
+			span.Error = "no response received"
+			span.Finish()
+			s.tracer.Record(span)
+		}
+	}
+}
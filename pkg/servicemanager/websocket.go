@@ -0,0 +1,301 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package servicemanager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	rtproto "github.com/tav/elko/pkg/protocol"
+	"github.com/tav/elko/pkg/servicemanager/protocol"
+	"github.com/tav/elko/pkg/trace"
+	"github.com/tav/golly/log"
+)
+
+// The elko.websocket service is implemented by the gateway, and lets any
+// service instance send messages to, or close, a WebSocket connection.
+const websocketService = "elko.websocket"
+
+// WebSocket connections are pinged at webSocketPingInterval, and are closed if
+// nothing has been heard from the client for twice that long.
+const webSocketPingInterval = 30 * time.Second
+
+var errWebSocketPending = errors.New("servicemanager: websocket connection hasn't been accepted yet")
+
+// wsConn is a WebSocket connection on the gateway. The underlying connection
+// is nil until the connect event has been accepted and the request upgraded.
+type wsConn struct {
+	conn    *websocket.Conn
+	id      string
+	mu      sync.Mutex
+	timeout time.Duration
+}
+
+func (c *wsConn) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errWebSocketPending
+	}
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(c.timeout))
+	return c.conn.Close()
+}
+
+func (c *wsConn) keepalive(done chan struct{}) {
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.timeout))
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// reply sends the result of an event back over the connection if the service
+// method returned a []byte or string.
+func (c *wsConn) reply(resp *protocol.ServerResponse) error {
+	if len(resp.Result) == 0 {
+		return nil
+	}
+	var result interface{}
+	err := rtproto.Decode(resp.Result, &result)
+	if err != nil {
+		return err
+	}
+	switch result := result.(type) {
+	case []byte:
+		if len(result) > 0 {
+			return c.write(false, result)
+		}
+	case string:
+		if result != "" {
+			return c.write(true, []byte(result))
+		}
+	}
+	return nil
+}
+
+// write is called from both the read loop of the connection and calls to the
+// elko.websocket service, so writes are serialised.
+func (c *wsConn) write(text bool, data []byte) error {
+	typ := websocket.BinaryMessage
+	if text {
+		typ = websocket.TextMessage
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errWebSocketPending
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.conn.WriteMessage(typ, data)
+}
+
+func (g *gateway) addConn(nodeID string, conn *websocket.Conn) *wsConn {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastConn++
+	c := &wsConn{
+		conn:    conn,
+		id:      nodeID + "/" + strconv.FormatUint(g.lastConn, 10),
+		timeout: g.timeout,
+	}
+	g.conns[c.id] = c
+	return c
+}
+
+func (g *gateway) removeConn(id string) {
+	g.mu.Lock()
+	delete(g.conns, id)
+	g.mu.Unlock()
+}
+
+// sendWebSocket sends a message to, or closes, a connection on behalf of a
+// call to the elko.websocket service.
+func (g *gateway) sendWebSocket(method string, msg *rtproto.WebSocketSend) error {
+	g.mu.Lock()
+	c := g.conns[msg.ConnID]
+	g.mu.Unlock()
+	if c == nil {
+		return fmt.Errorf("servicemanager: websocket connection %s is not open", msg.ConnID)
+	}
+	switch method {
+	case "close":
+		return c.close()
+	case "send":
+		return c.write(msg.Text, msg.Data)
+	}
+	return fmt.Errorf("servicemanager: %s has no method %q", websocketService, method)
+}
+
+// serveWebSocket upgrades the request to a WebSocket connection once the
+// target method has accepted the connect event, and then passes the messages
+// received over the connection to the method as they arrive. Messages are
+// handled one at a time so that they are seen in order.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, route *gatewayRoute, args []string) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+		return
+	}
+	wreq := newWebRequest(r, args, nil)
+	// The connection ID is allocated up front so that the connect event can
+	// carry it.
+	conn := s.gateway.addConn(s.nodeID, nil)
+	resp := s.webSocketEvent(r, route, &rtproto.WebSocketEvent{
+		ConnID:  conn.id,
+		Event:   rtproto.WebSocketConnect,
+		Request: wreq,
+	})
+	if resp == nil || resp.ErrorCode != protocol.ErrorCode_NONE {
+		s.gateway.removeConn(conn.id)
+		if resp != nil {
+			s.writeWebResponse(w, r, resp, "")
+		}
+		return
+	}
+	wsc, err := s.gateway.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error.
+		s.gateway.removeConn(conn.id)
+		return
+	}
+	conn.mu.Lock()
+	conn.conn = wsc
+	conn.mu.Unlock()
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		s.gateway.removeConn(conn.id)
+		wsc.Close()
+		s.webSocketEvent(r, route, &rtproto.WebSocketEvent{
+			ConnID:  conn.id,
+			Event:   rtproto.WebSocketClose,
+			Request: wreq,
+		})
+	}()
+	wsc.SetReadLimit(s.config.GatewayMaxBodySize)
+	wsc.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+	wsc.SetPongHandler(func(string) error {
+		return wsc.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+	})
+	go conn.keepalive(done)
+	webSocketReply(conn, resp)
+	for {
+		typ, data, err := wsc.ReadMessage()
+		if err != nil {
+			return
+		}
+		wsc.SetReadDeadline(time.Now().Add(2 * webSocketPingInterval))
+		resp := s.webSocketEvent(r, route, &rtproto.WebSocketEvent{
+			ConnID:  conn.id,
+			Data:    data,
+			Event:   rtproto.WebSocketMessage,
+			Request: wreq,
+			Text:    typ == websocket.TextMessage,
+		})
+		if resp == nil {
+			return
+		}
+		if resp.ErrorCode != protocol.ErrorCode_NONE {
+			log.Errorf("servicemanager: %s/%s failed to handle websocket message on %s: %s",
+				route.serviceID, route.method, conn.id, resp.ErrorMessage)
+			continue
+		}
+		webSocketReply(conn, resp)
+	}
+}
+
+// webSocketCall handles calls to the elko.websocket service. It is run in its
+// own goroutine so that slow WebSocket clients and remote nodes don't hold up
+// the caller's connection.
+func (s *Server) webSocketCall(from *service, req *protocol.ClientRequest, span *trace.Span) {
+	err := s.webSocketSend(req, true)
+	if err != nil {
+		s.reject(from, req, protocol.ErrorCode_SERVICE_ERROR, err.Error(), span)
+		return
+	}
+	span.Finish()
+	s.tracer.Record(span)
+	if !req.Async {
+		from.write(protocol.OP_SERVER_RESPONSE, &protocol.ServerResponse{
+			ID: req.ID,
+		})
+	}
+}
+
+// webSocketEvent calls the target of the route with the event. Close events
+// are sent asynchronously, as there is no connection left to reply on.
+func (s *Server) webSocketEvent(r *http.Request, route *gatewayRoute, event *rtproto.WebSocketEvent) *protocol.ServerResponse {
+	req, deadline, err := s.newGatewayRequest(r, route, event)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't encode websocket event for %s: %s", event.ConnID, err)
+		return &protocol.ServerResponse{
+			ErrorCode:    protocol.ErrorCode_SERVICE_ERROR,
+			ErrorMessage: err.Error(),
+		}
+	}
+	if event.Event == rtproto.WebSocketClose {
+		req.Async = true
+		s.route(s.gateway.svc, req, nil)
+		return nil
+	}
+	id, call := s.gateway.register()
+	defer s.gateway.remove(id)
+	req.ID = id
+	return s.awaitGateway(r.Context(), req, deadline, call)
+}
+
+// webSocketSend handles a call to the elko.websocket service. Calls for
+// connections held by other nodes are forwarded to them if forward is set.
+func (s *Server) webSocketSend(req *protocol.ClientRequest, forward bool) error {
+	args := [][]byte{}
+	err := rtproto.Decode(req.ServiceParam, &args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("servicemanager: elko.websocket expects a single WebSocketSend argument")
+	}
+	msg := &rtproto.WebSocketSend{}
+	err = rtproto.Decode(args[0], msg)
+	if err != nil {
+		return err
+	}
+	idx := strings.LastIndexByte(msg.ConnID, '/')
+	if idx == -1 {
+		return fmt.Errorf("servicemanager: invalid websocket connection ID: %q", msg.ConnID)
+	}
+	if nodeID := msg.ConnID[:idx]; nodeID != s.nodeID {
+		if !forward {
+			return fmt.Errorf("servicemanager: websocket connection %s is not on node %s", msg.ConnID, s.nodeID)
+		}
+		return s.forwardNode(nodeID, req)
+	}
+	if s.gateway == nil {
+		return fmt.Errorf("servicemanager: websocket connection %s is not open", msg.ConnID)
+	}
+	return s.gateway.sendWebSocket(req.ServiceMethod, msg)
+}
+
+func webSocketReply(conn *wsConn, resp *protocol.ServerResponse) {
+	err := conn.reply(resp)
+	if err != nil {
+		log.Errorf("servicemanager: couldn't reply on websocket connection %s: %s", conn.id, err)
+	}
+}
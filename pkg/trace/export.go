@@ -0,0 +1,171 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tav/golly/log"
+)
+
+const maxBatch = 512
+
+// Exporter batches finished spans and periodically writes them out in the
+// OTLP/JSON format, either as lines appended to a file, or POSTed to an OTLP
+// collector's /v1/traces endpoint.
+type Exporter struct {
+	client   *http.Client
+	endpoint string
+	file     *os.File
+	mu       sync.Mutex
+	name     string
+	spans    []*Span
+}
+
+// Record queues a finished span for export. It is safe to call on a nil
+// Exporter, in which case the span is dropped, as are spans from traces that
+// aren't sampled.
+func (e *Exporter) Record(s *Span) {
+	if e == nil || !s.Sampled {
+		return
+	}
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= maxBatch
+	e.mu.Unlock()
+	if full {
+		go e.Flush()
+	}
+}
+
+// Flush exports all queued spans.
+func (e *Exporter) Flush() error {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	if e.file != nil {
+		e.mu.Lock()
+		_, err = e.file.Write(append(payload, '\n'))
+		e.mu.Unlock()
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("trace: got %d response code from the collector", resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *Exporter) encode(spans []*Span) map[string]interface{} {
+	out := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		span := map[string]interface{}{
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"kind":              1,
+			"name":              s.Name,
+			"spanId":            s.SpanID.String(),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"traceId":           s.TraceID.String(),
+		}
+		if !s.Parent.IsZero() {
+			span["parentSpanId"] = s.Parent.String()
+		}
+		if len(s.Attributes) > 0 {
+			span["attributes"] = attributes(s.Attributes)
+		}
+		if s.Error != "" {
+			span["status"] = map[string]interface{}{
+				"code":    2,
+				"message": s.Error,
+			}
+		}
+		out[i] = span
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]string{"service.name": e.name}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "elko"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (e *Exporter) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := e.Flush()
+		if err != nil {
+			log.Errorf("trace: couldn't export spans: %s", err)
+		}
+	}
+}
+
+func attributes(attrs map[string]string) []interface{} {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		out[i] = map[string]interface{}{
+			"key":   key,
+			"value": map[string]string{"stringValue": attrs[key]},
+		}
+	}
+	return out
+}
+
+// NewExporter creates an exporter for the given target, which is either a file
+// path or an http(s) URL for an OTLP collector. Spans are flushed at the given
+// interval.
+func NewExporter(name string, target string, interval time.Duration) (*Exporter, error) {
+	e := &Exporter{
+		name: name,
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		e.client = &http.Client{Timeout: 10 * time.Second}
+		e.endpoint = target
+		if !strings.HasSuffix(target, "/v1/traces") {
+			e.endpoint = strings.TrimSuffix(target, "/") + "/v1/traces"
+		}
+	} else {
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e.file = f
+	}
+	go e.run(interval)
+	return e, nil
+}
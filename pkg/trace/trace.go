@@ -0,0 +1,172 @@
+// Public Domain (-) 2018-present, The Elko Authors.
+// See the Elko UNLICENSE file for details.
+
+// Package trace implements W3C traceparent-compatible trace propagation and
+// the recording of spans for export in the OTLP/JSON format.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidParent = errors.New("trace: invalid traceparent value")
+
+type (
+	SpanID  [8]byte
+	TraceID [16]byte
+)
+
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsZero() bool {
+	return id == TraceID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Parent identifies the span which a new span is a child of. Its string form
+// is a version 00 W3C traceparent header value.
+type Parent struct {
+	SpanID  SpanID
+	TraceID TraceID
+	Sampled bool
+}
+
+func (p Parent) String() string {
+	flags := "00"
+	if p.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", p.TraceID, p.SpanID, flags)
+}
+
+// Span represents a timed operation within a trace. Sampled carries the
+// sampling decision of the trace, which is made upstream if the span continues
+// an incoming traceparent.
+type Span struct {
+	Attributes map[string]string
+	End        time.Time
+	Error      string
+	Name       string
+	Parent     SpanID
+	Sampled    bool
+	SpanID     SpanID
+	Start      time.Time
+	TraceID    TraceID
+}
+
+// Child starts a new span with s as its parent.
+func (s *Span) Child(name string) *Span {
+	return &Span{
+		Name:    name,
+		Parent:  s.SpanID,
+		Sampled: s.Sampled,
+		SpanID:  NewSpanID(),
+		Start:   time.Now(),
+		TraceID: s.TraceID,
+	}
+}
+
+// Finish marks the span as having ended.
+func (s *Span) Finish() {
+	s.End = time.Now()
+}
+
+// Set adds an attribute to the span.
+func (s *Span) Set(key string, value string) {
+	if s.Attributes == nil {
+		s.Attributes = map[string]string{}
+	}
+	s.Attributes[key] = value
+}
+
+// Traceparent returns the value to propagate so that downstream spans become
+// children of s.
+func (s *Span) Traceparent() string {
+	return Parent{
+		SpanID:  s.SpanID,
+		Sampled: s.Sampled,
+		TraceID: s.TraceID,
+	}.String()
+}
+
+func NewSpanID() SpanID {
+	id := SpanID{}
+	for id.IsZero() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func NewTraceID() TraceID {
+	id := TraceID{}
+	for id.IsZero() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// ParseParent parses a W3C traceparent value. Unknown future versions are
+// accepted as long as the leading fields are well-formed.
+func ParseParent(v string) (Parent, error) {
+	p := Parent{}
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return p, ErrInvalidParent
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return p, ErrInvalidParent
+	}
+	if !decodeHex(p.TraceID[:], parts[1]) || p.TraceID.IsZero() {
+		return p, ErrInvalidParent
+	}
+	if !decodeHex(p.SpanID[:], parts[2]) || p.SpanID.IsZero() {
+		return p, ErrInvalidParent
+	}
+	flags := [1]byte{}
+	if !decodeHex(flags[:], parts[3]) {
+		return p, ErrInvalidParent
+	}
+	p.Sampled = flags[0]&1 == 1
+	return p, nil
+}
+
+// Start begins a span which is a child of the given traceparent value. If the
+// value is empty or invalid, a new trace is started, which is always sampled.
+func Start(name string, traceparent string) *Span {
+	s := &Span{
+		Name:   name,
+		SpanID: NewSpanID(),
+		Start:  time.Now(),
+	}
+	if p, err := ParseParent(traceparent); err == nil {
+		s.Parent = p.SpanID
+		s.Sampled = p.Sampled
+		s.TraceID = p.TraceID
+	} else {
+		s.Sampled = true
+		s.TraceID = NewTraceID()
+	}
+	return s
+}
+
+func decodeHex(dst []byte, src string) bool {
+	if len(src) != 2*len(dst) || strings.ToLower(src) != src {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(src))
+	return err == nil
+}
@@ -41,6 +41,10 @@ class Queue<T> {
 	}
 }
 
+// The highest version of the framing in proto/protocol.proto that is
+// supported by this runtime.
+const PROTOCOL_VERSION = 1
+
 let client: PromiseSocket<net.Socket>
 let key: Buffer
 let incoming = new Queue()
@@ -50,45 +54,69 @@ function sleep(duration: number) {
 	return new Promise(resolve => setTimeout(resolve, duration))
 }
 
-async function write(op: number, param: any) {
-	const msg: Buffer = param.constructor.encode(param).finish()
+// encodeFrame returns the frame for an encoded message, as described in
+// pkg/protocol/frame.go.
+export function encodeFrame(key: Buffer, op: number, msg: Buffer) {
 	const idx = msg.length + 5
 	const buf = Buffer.alloc(idx + 8)
 	buf.writeUInt8(op, 0)
 	buf.writeUInt32BE(msg.length, 1)
 	msg.copy(buf, 5)
 	highwayhash.asBuffer(key, buf.slice(0, idx)).copy(buf, idx)
+	return buf
+}
+
+export function frameKey(serviceID: string) {
+	return crypto
+		.createHash('sha256')
+		.update(serviceID)
+		.digest()
+}
+
+async function write(op: number, param: any) {
+	const msg: Buffer = param.constructor.encode(param).finish()
+	const buf = encodeFrame(key, op, msg)
 	console.log(buf)
 	await client.write(buf)
 }
 
 export function run(serviceID: string) {
+	let deployID: Long | null = null
+	if (process.env.DEPLOY_ID) {
+		deployID = Long.fromString(process.env.DEPLOY_ID!)
+	}
 	let instanceID: Long | null = null
 	if (process.env.INSTANCE_ID) {
 		instanceID = Long.fromString(process.env.INSTANCE_ID!)
 	}
 	serviceID = process.env.SERVICE_ID || serviceID
-	key = crypto
-		.createHash('sha256')
-		.update(serviceID)
-		.digest()
-	const port = parseInt(process.env.ELKO_PORT || '9000', 10)
+	key = frameKey(serviceID)
 	const sock = new net.Socket()
 	client = new PromiseSocket(sock)
-	sock.connect(port, '127.0.0.1', async () => {
+	const onConnect = async () => {
 		console.log('>> Connecting to Elko ...')
 		await client.write('\x01')
 		write(
 			proto.OP.CLIENT_HELLO,
 			proto.ClientHello.create({
+				deployID,
 				instanceID,
+				protocolVersion: PROTOCOL_VERSION,
+				runtime: `nodejs ${process.version}`,
 				serviceID,
+				version: process.env.SERVICE_VERSION || '',
 			})
 		)
 		while (true) {
 			const req = await outgoing.pop()
 		}
-	})
+	}
+	if (process.env.ELKO_SOCKET) {
+		sock.connect(process.env.ELKO_SOCKET, onConnect)
+	} else {
+		const port = parseInt(process.env.ELKO_PORT || '9000', 10)
+		sock.connect(port, '127.0.0.1', onConnect)
+	}
 	sock.on('data', data => {
 		console.log('Received:', data)
 	})